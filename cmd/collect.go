@@ -0,0 +1,204 @@
+package cmd
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// collectCmd represents the collect command
+var collectCmd = &cobra.Command{
+	Use:   "collect",
+	Short: "Collect all metrics once and push them or write them to a file",
+	Long: `With the command collect --once all applicable metrics are collected once, afterwards they are pushed to a Pushgateway or written into a node_exporter textfile directory. The command exits with 1, if a tenant could not be connected or a select failed. For example:
+	hana_sql_exporter collect --once --pushgateway http://pushgateway:9091
+	hana_sql_exporter collect --once --textfile-dir /var/lib/node_exporter/textfile_collector`,
+	Run: func(cmd *cobra.Command, args []string) {
+		once, _ := cmd.Flags().GetBool("once")
+		pushgateway, _ := cmd.Flags().GetString("pushgateway")
+		textfileDir, _ := cmd.Flags().GetString("textfile-dir")
+		job, _ := cmd.Flags().GetString("job")
+
+		if !once {
+			exit("Problem with flags: ", errors.New("collect only supports --once, use the web command for continuous collection"))
+		}
+		if (pushgateway == "") == (textfileDir == "") {
+			exit("Problem with flags: ", errors.New("either --pushgateway or --textfile-dir is required"))
+		}
+
+		config, err := getConfig()
+		if err != nil {
+			exit("Can't handle config file: ", err)
+		}
+		err = config.ApplyFlags(cmd.Flags())
+		if err != nil {
+			exit("Problem with flags: ", err)
+		}
+		config.ApplyDefaults()
+
+		f, err := SetLogging(config)
+		if err != nil {
+			exit("Can't set up logging: ", err)
+		}
+		if f != nil {
+			defer f.Close()
+		}
+
+		failed, err := NewRuntime(config).CollectOnce(pushgateway, textfileDir, job)
+		if err != nil {
+			exit("Can't collect metrics: ", err)
+		}
+		if len(failed) > 0 {
+			exit("Collection failed for tenants: ", errors.New(strings.Join(failed, ", ")))
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(collectCmd)
+
+	collectCmd.Flags().Bool("once", false, "collect all metrics once and exit")
+	collectCmd.Flags().String("pushgateway", "", "url of the Pushgateway the metrics are pushed to")
+	collectCmd.Flags().String("textfile-dir", "", "node_exporter textfile directory the metrics are written to")
+	collectCmd.Flags().String("job", "hana_sql_exporter", "Pushgateway job and name of the .prom file")
+	collectCmd.Flags().UintP("timeout", "t", defaultTimeout, "scrape timeout of the hana_sql_exporter in seconds.")
+	collectCmd.Flags().StringP("log-file", "l", defaultLogFile, "logfile, the logfile location")
+	collectCmd.Flags().String("log-level", defaultLogLevel, "logfile, the log level")
+	collectCmd.Flags().String("log-format", defaultLogFormat, "format of the log entries, logfmt or json")
+}
+
+// CollectOnce - connect the tenants, collect all metrics once and push them
+// to the Pushgateway or write them into the textfile directory. The names of
+// tenants that could not be connected or had failing selects are returned.
+func (rt *Runtime) CollectOnce(pushgateway, textfileDir, job string) ([]string, error) {
+	err := rt.Connect()
+	if err != nil {
+		return nil, errors.Wrap(err, "CollectOnce(Connect)")
+	}
+	defer rt.Close()
+
+	data := rt.Scrape()
+	if rt.status.lastScrapeErr == errScrapeTimeout {
+		return nil, errors.Wrap(errScrapeTimeout, "CollectOnce(Scrape)")
+	}
+	if pushgateway != "" {
+		err = PushMetrics(pushgateway, job, data)
+	} else {
+		err = WriteTextfile(filepath.Join(textfileDir, job+".prom"), data)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "CollectOnce")
+	}
+	return rt.status.failedTenants(), nil
+}
+
+// PushMetrics - push the metrics of every tenant as separate group to the
+// Pushgateway, the tenant label is set by the grouping key
+func PushMetrics(url, job string, data []MetricData) error {
+	for tenant, tenantData := range SplitByTenant(data) {
+		tenantData := withoutLabel(tenantData, "tenant")
+		registry := prometheus.NewRegistry()
+		if err := registry.Register(newCollector(func() []MetricData { return tenantData })); err != nil {
+			return errors.Wrapf(err, "PushMetrics(%s)", tenant)
+		}
+
+		err := push.New(url, job).Gatherer(registry).Grouping("tenant", tenant).Push()
+		if err != nil {
+			return errors.Wrapf(err, "PushMetrics(%s)", tenant)
+		}
+		TenantLog(log.Fields{"tenant": tenant, "url": url}).Info("metrics pushed")
+	}
+	return nil
+}
+
+// WriteTextfile - write the metrics atomically into a .prom file
+func WriteTextfile(file string, data []MetricData) error {
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(newCollector(func() []MetricData { return data })); err != nil {
+		return errors.Wrap(err, "WriteTextfile(Register)")
+	}
+
+	// WriteToTextfile writes a temporary file and renames it
+	if err := prometheus.WriteToTextfile(file, registry); err != nil {
+		return errors.Wrap(err, "WriteTextfile")
+	}
+	return nil
+}
+
+// SplitByTenant - metric data grouped by the value of the tenant label
+func SplitByTenant(data []MetricData) map[string][]MetricData {
+	tenants := make(map[string][]MetricData)
+	for _, md := range data {
+		stats := make(map[string][]MetricRecord)
+		for _, record := range md.Stats {
+			tenant := ""
+			for i, label := range record.Labels {
+				if label == "tenant" && i < len(record.LabelValues) {
+					tenant = record.LabelValues[i]
+					break
+				}
+			}
+			stats[tenant] = append(stats[tenant], record)
+		}
+		for tenant, records := range stats {
+			tmd := md
+			tmd.Stats = records
+			tenants[tenant] = append(tenants[tenant], tmd)
+		}
+	}
+	return tenants
+}
+
+// withoutLabel - copy of the metric data without the label
+func withoutLabel(data []MetricData, label string) []MetricData {
+	res := make([]MetricData, len(data))
+	for i, md := range data {
+		res[i] = md
+		res[i].Stats = make([]MetricRecord, len(md.Stats))
+		for j, record := range md.Stats {
+			r := MetricRecord{Value: record.Value}
+			for k := range record.Labels {
+				if record.Labels[k] != label {
+					r.Labels = append(r.Labels, record.Labels[k])
+					r.LabelValues = append(r.LabelValues, record.LabelValues[k])
+				}
+			}
+			res[i].Stats[j] = r
+		}
+	}
+	return res
+}
+
+// failedTenants - sorted names of tenants without connection or with failed runs
+func (s *statusStore) failedTenants() []string {
+	if s == nil {
+		return nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	failed := make(map[string]bool)
+	for name, ts := range s.tenants {
+		if !ts.Connected {
+			failed[name] = true
+		}
+	}
+	for key, run := range s.runs {
+		if run.LastError != "" {
+			failed[key.tenant] = true
+		}
+	}
+
+	var names []string
+	for name := range failed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
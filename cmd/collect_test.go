@@ -0,0 +1,73 @@
+package cmd_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ulranh/hana_sql_exporter/cmd"
+)
+
+var collectData = []cmd.MetricData{
+	{
+		Name:       "hana_connections",
+		Help:       "connections",
+		MetricType: "gauge",
+		Stats: []cmd.MetricRecord{
+			{Value: 3, Labels: []string{"tenant", "host"}, LabelValues: []string{"q01", "h1"}},
+			{Value: 2, Labels: []string{"tenant", "host"}, LabelValues: []string{"q02", "h1"}},
+		},
+	},
+}
+
+func Test_SplitByTenant(t *testing.T) {
+	assert := assert.New(t)
+
+	tenants := cmd.SplitByTenant(collectData)
+	assert.Equal(2, len(tenants))
+	assert.Equal(1, len(tenants["q01"]))
+	assert.Equal(3.0, tenants["q01"][0].Stats[0].Value)
+	assert.Equal("hana_connections", tenants["q02"][0].Name)
+}
+
+func Test_WriteTextfile(t *testing.T) {
+	assert := assert.New(t)
+
+	file := filepath.Join(t.TempDir(), "hana_sql_exporter.prom")
+	assert.Nil(cmd.WriteTextfile(file, collectData))
+
+	content, err := ioutil.ReadFile(file)
+	assert.Nil(err)
+	assert.True(strings.Contains(string(content), `hana_connections{host="h1",tenant="q01"} 3`))
+	assert.True(strings.Contains(string(content), `hana_connections{host="h1",tenant="q02"} 2`))
+
+	files, _ := filepath.Glob(filepath.Join(filepath.Dir(file), "*"))
+	assert.Equal(1, len(files))
+}
+
+func Test_PushMetrics(t *testing.T) {
+	assert := assert.New(t)
+
+	var mu sync.Mutex
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		paths = append(paths, r.Method+" "+r.URL.Path)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	assert.Nil(cmd.PushMetrics(server.URL, "hana_sql_exporter", collectData))
+	sort.Strings(paths)
+	assert.Equal([]string{
+		"PUT /metrics/job/hana_sql_exporter/tenant/q01",
+		"PUT /metrics/job/hana_sql_exporter/tenant/q02",
+	}, paths)
+}
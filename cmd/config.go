@@ -1,20 +1,444 @@
 package cmd
 
 import (
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pelletier/go-toml"
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// prefix of all environment variables read by the exporter
+const envPrefix = "HANA_SQL_EXPORTER_"
+
+// default values of the config fields that can be set by flags
+const (
+	defaultTimeout  = 30
+	defaultIp       = "0.0.0.0"
+	defaultPort     = "9888"
+	defaultLogFile  = "log.log"
+	defaultLogLevel = "error"
+
+	defaultLogMaxSize      = 100
+	defaultLogMaxBackups   = 7
+	defaultReadyMinTenants = 1
 )
 
-func SetLogLevel(level string) {
-	switch level {
-	case "error":
-		log.SetLevel(log.ErrorLevel)
-	case "warn":
-		log.SetLevel(log.WarnLevel)
-	case "info":
-		log.SetLevel(log.InfoLevel)
-	case "debug":
-		log.SetLevel(log.DebugLevel)
+// values of the --set flag
+var setValues []string
+
+// configCmd represents the config command
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Inspect the configuration",
+}
+
+// configShowCmd represents the config show command
+var configShowCmd = &cobra.Command{
+	Use:   "show",
+	Short: "Print the configuration",
+	Long: `With the command config show you can print the configuration file. With --effective the configuration is printed after includes, metric packs, environment variables, --set values and defaults have been applied. Passwords are always masked. For example:
+	hana_sql_exporter config show --config ./hana_sql_exporter.toml
+	HANA_SQL_EXPORTER_TIMEOUT=5 hana_sql_exporter config show --effective`,
+	Run: func(cmd *cobra.Command, args []string) {
+		effective, err := cmd.Flags().GetBool("effective")
+		if err != nil {
+			exit("Problem with effective flag: ", err)
+		}
+
+		var config *Config
+		if effective {
+			config, err = getConfig()
+			if err == nil {
+				config.ApplyDefaults()
+			}
+		} else {
+			config, err = getFileConfig()
+		}
+		if err != nil {
+			exit("Can't handle config file: ", err)
+		}
+
+		out, err := config.Show()
+		if err != nil {
+			exit("Can't show config: ", err)
+		}
+		fmt.Print(out)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(configCmd)
+	configCmd.AddCommand(configShowCmd)
+
+	configShowCmd.Flags().Bool("effective", false, "print the resolved configuration")
+}
+
+// override - config value from the environment or the --set flag
+type override struct {
+	source string
+	path   []string
+	value  string
+}
+
+// ApplyOverrides - override config values with HANA_SQL_EXPORTER_* environment
+// variables, e.g. HANA_SQL_EXPORTER_TENANTS_Q01_CONNSTR, and afterwards with
+// key=value pairs of the --set flag, e.g. tenants.q01.connstr=host:30041.
+// The Include key is handled by ApplyIncludeOverride.
+func (config *Config) ApplyOverrides(environ, set []string) error {
+	return config.applyOverrides(environ, set, func(key string) bool { return key != "include" })
+}
+
+// ApplyIncludeOverride - override the Include key, must be called before the
+// includes are resolved
+func (config *Config) ApplyIncludeOverride(environ, set []string) error {
+	return config.applyOverrides(environ, set, func(key string) bool { return key == "include" })
+}
+
+// apply all overrides whose key matches
+func (config *Config) applyOverrides(environ, set []string, match func(key string) bool) error {
+	overrides, err := parseOverrides(environ, set)
+	if err != nil {
+		return errors.Wrap(err, "applyOverrides(parseOverrides)")
+	}
+	// the ConnStr creates a new tenant before its other values are set
+	sort.SliceStable(overrides, func(i, j int) bool {
+		return overrides[i].tenantConnStr() && !overrides[j].tenantConnStr()
+	})
+
+	for _, o := range overrides {
+		if !match(normalizeKey(o.path[0])) {
+			continue
+		}
+		err := config.SetValue(o.path, o.value)
+		if err == nil {
+			continue
+		}
+		if strings.HasPrefix(o.source, envPrefix) {
+			log.WithField("env", o.source).WithError(err).Warn("environment variable ignored")
+			continue
+		}
+		return errors.Wrapf(err, "applyOverrides(%s)", o.source)
+	}
+	return nil
+}
+
+// tenantConnStr - the override sets the ConnStr of a tenant
+func (o override) tenantConnStr() bool {
+	return len(o.path) == 3 && low(o.path[0]) == "tenants" && normalizeKey(o.path[2]) == "connstr"
+}
+
+// environment overrides sorted by name followed by --set overrides
+func parseOverrides(environ, set []string) ([]override, error) {
+	var overrides []override
+
+	env := append([]string{}, environ...)
+	sort.Strings(env)
+	for _, e := range env {
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) != 2 || !strings.HasPrefix(kv[0], envPrefix) {
+			continue
+		}
+
+		key := strings.TrimPrefix(kv[0], envPrefix)
+		path := []string{key}
+		if strings.HasPrefix(key, "TENANTS_") {
+			// tenant names can contain underscores, field names can't
+			key = strings.TrimPrefix(key, "TENANTS_")
+			pos := strings.LastIndex(key, "_")
+			if pos < 1 {
+				log.WithField("env", kv[0]).Warn("environment variable has no tenant field")
+				continue
+			}
+			path = []string{"tenants", key[:pos], key[pos+1:]}
+		}
+		overrides = append(overrides, override{kv[0], path, kv[1]})
+	}
+
+	for _, value := range set {
+		kv := strings.SplitN(value, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, errors.Errorf("parseOverrides(%q is not of the form key=value)", value)
+		}
+		overrides = append(overrides, override{kv[0], strings.Split(kv[0], "."), kv[1]})
+	}
+	return overrides, nil
+}
+
+// ApplyFlags - override config values with explicitly set command line flags
+func (config *Config) ApplyFlags(flags *pflag.FlagSet) error {
+	for _, name := range []string{"timeout", "ip", "port", "log-file", "log-level", "log-format", "state-dir"} {
+		flag := flags.Lookup(name)
+		if flag == nil || !flag.Changed {
+			continue
+		}
+		if err := config.SetValue([]string{name}, flag.Value.String()); err != nil {
+			return errors.Wrapf(err, "ApplyFlags(%s)", name)
+		}
+	}
+	return nil
+}
+
+// ApplyDefaults - set default values for all unset config values
+func (config *Config) ApplyDefaults() {
+	if config.Timeout == 0 {
+		config.Timeout = defaultTimeout
+	}
+	if config.Ip == "" {
+		config.Ip = defaultIp
+	}
+	if config.Port == "" {
+		config.Port = defaultPort
+	}
+	if config.LogFile == "" {
+		config.LogFile = defaultLogFile
+	}
+	if config.LogLevel == "" {
+		config.LogLevel = defaultLogLevel
+	}
+	if config.LogFormat == "" {
+		config.LogFormat = defaultLogFormat
+	}
+	if config.LogMaxSize == nil {
+		maxSize := uint(defaultLogMaxSize)
+		config.LogMaxSize = &maxSize
+	}
+	if config.LogMaxBackups == nil {
+		maxBackups := uint(defaultLogMaxBackups)
+		config.LogMaxBackups = &maxBackups
+	}
+	if config.ReadyMinTenants == nil {
+		minTenants := uint(defaultReadyMinTenants)
+		config.ReadyMinTenants = &minTenants
+	}
+}
+
+// SetValue - set a config value by its path, e.g. ["tenants", "q01", "user"]
+func (config *Config) SetValue(path []string, value string) error {
+	if len(path) == 3 && low(path[0]) == "tenants" {
+		return config.setTenantValue(path[1], path[2], value)
+	}
+	if len(path) == 4 && low(path[0]) == "tenants" && normalizeKey(path[2]) == "vars" {
+		return config.setTenantVar(path[1], path[3], value)
+	}
+	if len(path) != 1 {
+		return errors.Errorf("SetValue(unknown key %s)", strings.Join(path, "."))
+	}
+
+	var err error
+	switch normalizeKey(path[0]) {
+	case "timeout":
+		var timeout uint64
+		if timeout, err = strconv.ParseUint(value, 10, 32); err == nil {
+			config.Timeout = uint(timeout)
+		}
+	case "ip":
+		config.Ip = value
+	case "port":
+		config.Port = value
+	case "loglevel":
+		config.LogLevel = value
+	case "logfile":
+		config.LogFile = value
+	case "logformat":
+		config.LogFormat = value
+	case "logmaxsize":
+		var size uint64
+		if size, err = strconv.ParseUint(value, 10, 32); err == nil {
+			maxSize := uint(size)
+			config.LogMaxSize = &maxSize
+		}
+	case "logrotateinterval":
+		var interval uint64
+		if interval, err = strconv.ParseUint(value, 10, 32); err == nil {
+			config.LogRotateInterval = uint(interval)
+		}
+	case "logmaxbackups":
+		var backups uint64
+		if backups, err = strconv.ParseUint(value, 10, 32); err == nil {
+			maxBackups := uint(backups)
+			config.LogMaxBackups = &maxBackups
+		}
+	case "logmaxage":
+		var age uint64
+		if age, err = strconv.ParseUint(value, 10, 32); err == nil {
+			config.LogMaxAge = uint(age)
+		}
+	case "include":
+		config.Include = splitList(value)
+	case "enablemetrics":
+		config.EnableMetrics = splitList(value)
+	case "disablemetrics":
+		config.DisableMetrics = splitList(value)
+	case "readymintenants":
+		var n uint64
+		if n, err = strconv.ParseUint(value, 10, 32); err == nil {
+			minTenants := uint(n)
+			config.ReadyMinTenants = &minTenants
+		}
+	case "remotewriteinterval":
+		var interval uint64
+		if interval, err = strconv.ParseUint(value, 10, 32); err == nil {
+			config.RemoteWriteInterval = uint(interval)
+		}
+	case "otlpinterval":
+		var interval uint64
+		if interval, err = strconv.ParseUint(value, 10, 32); err == nil {
+			config.OTLPInterval = uint(interval)
+		}
+	case "disablemetricshandler":
+		var disable bool
+		if disable, err = strconv.ParseBool(value); err == nil {
+			config.DisableMetricsHandler = disable
+		}
+	case "statefile":
+		config.StateFile = value
+	case "statedir":
+		config.StateDir = value
+	case "readytenants":
+		config.ReadyTenants = splitList(value)
+	case "readymaxscrapeage":
+		var age uint64
+		if age, err = strconv.ParseUint(value, 10, 32); err == nil {
+			config.ReadyMaxScrapeAge = uint(age)
+		}
+	case "secret":
+		var secret []byte
+		if secret, err = base64.StdEncoding.DecodeString(value); err == nil {
+			config.Secret = secret
+		}
 	default:
-		log.Warnln("Unrecognized minimum log level; using 'info' as default")
+		return errors.Errorf("SetValue(unknown key %s)", path[0])
+	}
+	if err != nil {
+		return errors.Wrapf(err, "SetValue(%s)", path[0])
+	}
+	return nil
+}
+
+// set a tenant value, a tenant that does not exist is only created by its ConnStr
+func (config *Config) setTenantValue(name, field, value string) error {
+	if !ContainsString(normalizeKey(field), []string{"connstr", "hosts", "user", "usage", "tags", "schemas", "systemdb", "template", "exclude", "discoveryinterval", "loglevel"}) {
+		return errors.Errorf("setTenantValue(unknown tenant field %s)", field)
+	}
+
+	tPos := config.tenantPos(name)
+	if tPos < 0 {
+		if normalizeKey(field) != "connstr" {
+			return errors.Errorf("setTenantValue(unknown tenant %s, new tenants need a ConnStr)", name)
+		}
+		config.Tenants = append(config.Tenants, TenantInfo{Name: low(name)})
+		tPos = len(config.Tenants) - 1
+	}
+
+	switch normalizeKey(field) {
+	case "connstr":
+		config.Tenants[tPos].ConnStr = value
+	case "hosts":
+		config.Tenants[tPos].Hosts = splitList(value)
+	case "user":
+		config.Tenants[tPos].User = value
+	case "usage":
+		config.Tenants[tPos].Usage = value
+	case "tags":
+		config.Tenants[tPos].Tags = splitList(value)
+	case "schemas":
+		config.Tenants[tPos].Schemas = splitList(value)
+	case "systemdb":
+		systemDB, err := strconv.ParseBool(value)
+		if err != nil {
+			return errors.Wrapf(err, "setTenantValue(%s)", field)
+		}
+		config.Tenants[tPos].SystemDB = systemDB
+	case "template":
+		config.Tenants[tPos].Template = value
+	case "loglevel":
+		config.Tenants[tPos].LogLevel = value
+	case "exclude":
+		config.Tenants[tPos].Exclude = splitList(value)
+	case "discoveryinterval":
+		interval, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return errors.Wrapf(err, "setTenantValue(%s)", field)
+		}
+		config.Tenants[tPos].DiscoveryInterval = uint(interval)
+	}
+	return nil
+}
+
+// set a template variable of an existing tenant
+func (config *Config) setTenantVar(name, key, value string) error {
+	if key == "" {
+		return errors.New("setTenantVar(empty variable name)")
+	}
+	tPos := config.tenantPos(name)
+	if tPos < 0 {
+		return errors.Errorf("setTenantVar(unknown tenant %s)", name)
+	}
+	if config.Tenants[tPos].Vars == nil {
+		config.Tenants[tPos].Vars = make(map[string]string)
+	}
+	config.Tenants[tPos].Vars[low(key)] = value
+	return nil
+}
+
+// position of the tenant, -1 if it does not exist
+func (config *Config) tenantPos(name string) int {
+	for i := range config.Tenants {
+		if low(config.Tenants[i].Name) == low(name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Show - config as toml with masked passwords
+func (config *Config) Show() (string, error) {
+	c := *config
+	c.Secret = nil
+
+	out, err := toml.Marshal(c)
+	if err != nil {
+		return "", errors.Wrap(err, "Show(Marshal)")
+	}
+
+	secret, err := config.GetSecretMap()
+	if err != nil {
+		return "", errors.Wrap(err, "Show(GetSecretMap)")
+	}
+	var tenants []string
+	for name := range secret.Name {
+		if name != "secretkey" {
+			tenants = append(tenants, name)
+		}
+	}
+	sort.Strings(tenants)
+	if len(tenants) == 0 {
+		tenants = []string{"-"}
+	}
+
+	masked := fmt.Sprintf("# Secret is masked, passwords exist for: %s\n", strings.Join(tenants, ", "))
+	return masked + string(out), nil
+}
+
+// lower case key without separators, e.g. log-level -> loglevel
+func normalizeKey(key string) string {
+	return strings.NewReplacer("_", "", "-", "").Replace(low(key))
+}
+
+// comma separated list without empty entries
+func splitList(value string) []string {
+	var list []string
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			list = append(list, entry)
+		}
 	}
+	return list
 }
@@ -0,0 +1,91 @@
+package cmd_test
+
+import (
+	"testing"
+
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/assert"
+	"github.com/ulranh/hana_sql_exporter/cmd"
+)
+
+func Test_ApplyOverrides(t *testing.T) {
+	assert := assert.New(t)
+
+	config := getTestConfig(0, 2)
+	config.Port = "1111"
+	environ := []string{
+		"HANA_SQL_EXPORTER_PORT=2222",
+		"HANA_SQL_EXPORTER_LOG_LEVEL=debug",
+		"HANA_SQL_EXPORTER_TENANTS_D01_CONNSTR=host1:30041",
+		"HANA_SQL_EXPORTER_TENANTS_D02_TAGS=abap, erp",
+		"HANA_SQL_EXPORTER_TENANTS_Q_01_USER=monitor",
+		"HANA_SQL_EXPORTER_TENANTS_Q_01_CONNSTR=host2:30041",
+		"HANA_SQL_EXPORTER_TENANTS_D03_USER=typo",
+		"HANA_SQL_EXPORTER_UNKNOWN=1",
+		"PATH=/usr/bin",
+	}
+	set := []string{"port=3333", "tenants.d01.user=dbuser"}
+
+	assert.Nil(config.ApplyOverrides(environ, set))
+	assert.Equal("3333", config.Port)
+	assert.Equal("debug", config.LogLevel)
+	assert.Equal("host1:30041", config.Tenants[0].ConnStr)
+	assert.Equal("dbuser", config.Tenants[0].User)
+	assert.Equal([]string{"abap", "erp"}, config.Tenants[1].Tags)
+	assert.Equal(3, len(config.Tenants))
+	assert.Equal("q_01", config.Tenants[2].Name)
+	assert.Equal("host2:30041", config.Tenants[2].ConnStr)
+	assert.Equal("monitor", config.Tenants[2].User)
+
+	// unknown tenants are only created by their ConnStr
+	assert.NotNil(config.ApplyOverrides(nil, []string{"tenants.d03.user=dbuser"}))
+	assert.NotNil(config.ApplyOverrides(nil, []string{"tenants.d03.vars.client=100"}))
+	assert.Nil(config.ApplyOverrides(nil, []string{"tenants.d03.user=dbuser", "tenants.d03.connstr=host3:30041"}))
+	assert.Equal("dbuser", config.Tenants[3].User)
+	assert.Equal(4, len(config.Tenants))
+
+	// --set values must be valid
+	assert.NotNil(config.ApplyOverrides(nil, []string{"unknown=1"}))
+	assert.NotNil(config.ApplyOverrides(nil, []string{"timeout"}))
+	assert.NotNil(config.ApplyOverrides(nil, []string{"tenants.d01.password=secret"}))
+	assert.Equal(4, len(config.Tenants))
+
+	// Include is only changed by ApplyIncludeOverride
+	assert.Nil(config.ApplyOverrides([]string{"HANA_SQL_EXPORTER_INCLUDE=hana:core"}, nil))
+	assert.Nil(config.Include)
+	assert.Nil(config.ApplyIncludeOverride([]string{"HANA_SQL_EXPORTER_INCLUDE=hana:core,conf.d/*.toml"}, nil))
+	assert.Equal([]string{"hana:core", "conf.d/*.toml"}, config.Include)
+}
+
+func Test_ApplyFlags(t *testing.T) {
+	assert := assert.New(t)
+
+	flags := pflag.NewFlagSet("web", pflag.ContinueOnError)
+	flags.Uint("timeout", 30, "")
+	flags.String("port", "9888", "")
+	assert.Nil(flags.Parse([]string{"--timeout", "7"}))
+
+	// explicit flags win, defaults only fill unset values
+	config := cmd.Config{Timeout: 3, Port: "1111"}
+	assert.Nil(config.ApplyFlags(flags))
+	config.ApplyDefaults()
+	assert.Equal(uint(7), config.Timeout)
+	assert.Equal("1111", config.Port)
+	assert.Equal("0.0.0.0", config.Ip)
+	assert.Equal("error", config.LogLevel)
+}
+
+func Test_Show(t *testing.T) {
+	assert := assert.New(t)
+
+	config := getTestConfig(1, 1)
+	secret, err := config.AddSecret("d01", []byte(pw1))
+	assert.Nil(err)
+	config.Secret = secret
+
+	out, err := config.Show()
+	assert.Nil(err)
+	assert.Contains(out, "passwords exist for: d01")
+	assert.Contains(out, `Name = "d01"`)
+	assert.NotContains(out, pw1)
+}
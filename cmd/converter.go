@@ -1,159 +1,564 @@
-package cmd
-
-import (
-	"encoding/json"
-	"fmt"
-	"io/ioutil"
-	"log"
-	"os"
-	"strconv"
-	"strings"
-
-	"github.com/pelletier/go-toml"
-	"github.com/spf13/cobra"
-)
-
-var (
-	inputFile  string
-	outputFile string
-)
-
-// convertCmd represents the convert command
-var convertCmd = &cobra.Command{
-	Use:   "convert",
-	Short: "Convert metrics JSON file to TOML format",
-	Long: `Convert a metrics JSON configuration file to TOML format for HANA SQL exporter.
-Example: hana_sql_exporter convert -i test/metrics.json -o test/hana_sql_exporter.toml`,
-	RunE: func(cmd *cobra.Command, args []string) error {
-		return convertMetrics(inputFile, outputFile)
-	},
-}
-
-func init() {
-	RootCmd.AddCommand(convertCmd)
-
-	// Add flags for input and output files with default paths in test directory
-	convertCmd.Flags().StringVarP(&inputFile, "input", "i", "test/metrics.json", "Input JSON file path")
-	convertCmd.Flags().StringVarP(&outputFile, "output", "o", "test/hana_sql_exporter.toml", "Output TOML file path")
-}
-
-type Metric struct {
-	Name        string   `json:"name"`
-	Description string   `json:"description"`
-	Labels      []string `json:"labels"`
-	Value       string   `json:"value"`
-	Unit        string   `json:"unit"`
-	Type        string   `json:"type"`
-}
-
-type QueryConfig struct {
-	Enabled          bool      `json:"enabled"`
-	HanaVersionRange []string  `json:"hana_version_range,omitempty"`
-	Metrics          []*Metric `json:"metrics"`
-}
-
-// processVersionRange 处理HANA版本范围过滤条件
-func processVersionRange(hanaVersionRange []string) string {
-	if len(hanaVersionRange) == 2 {
-		minVersion := hanaVersionRange[0]
-		maxVersion := hanaVersionRange[1]
-
-		compare := func(v1, v2 string) int {
-			v1Parts := strings.Split(v1, ".")
-			v2Parts := strings.Split(v2, ".")
-			for i := 0; i < len(v1Parts) && i < len(v2Parts); i++ {
-				vp1, _ := strconv.Atoi(v1Parts[i])
-				vp2, _ := strconv.Atoi(v2Parts[i])
-				if vp1 > vp2 {
-					return 1
-				} else if vp1 < vp2 {
-					return -1
-				}
-			}
-			return 0
-		}
-
-		if compare(minVersion, maxVersion) > 0 {
-			minVersion, maxVersion = maxVersion, minVersion
-		}
-		log.Printf("Processing version range: %s - %s", minVersion, maxVersion)
-		return fmt.Sprintf(">=%s <=%s", minVersion, maxVersion)
-	} else if len(hanaVersionRange) == 1 {
-		minVersion := hanaVersionRange[0]
-		log.Printf("Minimum version requirement detected: %s", minVersion)
-		return fmt.Sprintf(">=%s", minVersion)
-	}
-
-	log.Printf("Invalid HanaVersionRange: expected 1 or 2 elements, got %d", len(hanaVersionRange))
-	return ""
-}
-
-// convertMetrics 将metrics.json转换为TOML格式
-func convertMetrics(input, output string) error {
-	jsonFile, err := os.Open(input)
-	if err != nil {
-		return fmt.Errorf("failed to open input file %s: %v", input, err)
-	}
-	defer jsonFile.Close()
-
-	byteValue, _ := ioutil.ReadAll(jsonFile)
-
-	// 使用map来解析JSON，其中key是SQL查询
-	var jsonConfig map[string]QueryConfig
-	err = json.Unmarshal(byteValue, &jsonConfig)
-	if err != nil {
-		return fmt.Errorf("failed to parse JSON: %v", err)
-	}
-
-	// 创建TOML配置结构
-	tomlConfig := Config{
-		Queries: make([]QueryInfo, 0),
-	}
-
-	for sql, queryConfig := range jsonConfig {
-		if !queryConfig.Enabled {
-			continue
-		}
-
-		query := QueryInfo{
-			SQL:     sql,
-			Metrics: make([]QueryMetricInfo, 0),
-		}
-
-		// 处理版本范围
-		query.VersionFilter = processVersionRange(queryConfig.HanaVersionRange)
-
-		// 转换指标
-		for _, metric := range queryConfig.Metrics {
-			tomlMetric := QueryMetricInfo{
-				Name:        metric.Name,
-				Help:        metric.Description,
-				MetricType:  strings.ToLower(metric.Type),
-				ValueColumn: metric.Value,
-				Unit:        metric.Unit,
-			}
-
-			if len(metric.Labels) > 0 {
-				tomlMetric.Labels = metric.Labels
-			}
-
-			query.Metrics = append(query.Metrics, tomlMetric)
-		}
-
-		tomlConfig.Queries = append(tomlConfig.Queries, query)
-	}
-
-	// 使用toml包直接写入文件
-	tomlBytes, err := toml.Marshal(tomlConfig)
-	if err != nil {
-		return fmt.Errorf("failed to marshal TOML: %v", err)
-	}
-
-	err = ioutil.WriteFile(output, tomlBytes, 0644)
-	if err != nil {
-		return fmt.Errorf("failed to write TOML file %s: %v", output, err)
-	}
-
-	fmt.Printf("Successfully converted %s to %s\n", input, output)
-	return nil
-}
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pelletier/go-toml"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	inputFile    string
+	outputFile   string
+	inputFormat  string
+	outputFormat string
+	mergeOutput  bool
+)
+
+// convertCmd represents the convert command
+var convertCmd = &cobra.Command{
+	Use:   "convert",
+	Short: "Convert config files between the metrics JSON, TOML, YAML and JSON formats",
+	Long: `Convert a configuration file for HANA SQL exporter from one format to another. The formats are detected by the file extensions or set with --from and --to:
+  toml, yaml        complete exporter configuration including tenants and secret
+  json              community metrics.json file like test/metrics.json, also written for .json output files
+  json-config       complete exporter configuration as JSON
+  sql_exporter      sql_exporter config or collector YAML file (input only)
+  hanadb_exporter   hanadb_exporter config.json or metrics.json file (input only)
+Features of sql_exporter and hanadb_exporter that can't be converted are listed after the conversion.
+With --merge the converted queries and new tenants are merged into the existing output file, its tenants, secret and settings are kept.
+Example: hana_sql_exporter convert -i test/metrics.json -o test/hana_sql_exporter.toml
+         hana_sql_exporter convert -i hana_sql_exporter.toml -o hana_sql_exporter.yaml
+         hana_sql_exporter convert -i hana_sql_exporter.toml -o metrics.json --to json
+         hana_sql_exporter convert -i hana_sql_exporter.toml -o hana_sql_exporter.json --to json-config
+         hana_sql_exporter convert -i test/metrics.json -o hana_sql_exporter.toml --merge
+         hana_sql_exporter convert -i hana.collector.yml -o hana_sql_exporter.toml --from sql_exporter`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return convertConfig(inputFile, outputFile, inputFormat, outputFormat, mergeOutput)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(convertCmd)
+
+	// Add flags for input and output files with default paths in test directory
+	convertCmd.Flags().StringVarP(&inputFile, "input", "i", "test/metrics.json", "Input file path")
+	convertCmd.Flags().StringVarP(&outputFile, "output", "o", "test/hana_sql_exporter.toml", "Output file path")
+	convertCmd.Flags().StringVar(&inputFormat, "from", "", "input format: toml, yaml, json (community metrics.json), json-config (complete config), sql_exporter or hanadb_exporter (default: detected)")
+	convertCmd.Flags().StringVar(&outputFormat, "to", "", "output format: toml, yaml, json (community metrics.json) or json-config (complete config) (default: output file extension)")
+	convertCmd.Flags().BoolVar(&mergeOutput, "merge", false, "merge the queries into the existing output file")
+}
+
+type Metric struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Labels      []string `json:"labels"`
+	Value       string   `json:"value"`
+	Unit        string   `json:"unit"`
+	Type        string   `json:"type"`
+}
+
+type QueryConfig struct {
+	Enabled          bool      `json:"enabled"`
+	HanaVersionRange []string  `json:"hana_version_range,omitempty"`
+	Metrics          []*Metric `json:"metrics"`
+}
+
+// processVersionRange 处理HANA版本范围过滤条件
+func processVersionRange(hanaVersionRange []string) string {
+	if len(hanaVersionRange) == 2 {
+		minVersion := hanaVersionRange[0]
+		maxVersion := hanaVersionRange[1]
+
+		compare := func(v1, v2 string) int {
+			v1Parts := strings.Split(v1, ".")
+			v2Parts := strings.Split(v2, ".")
+			for i := 0; i < len(v1Parts) && i < len(v2Parts); i++ {
+				vp1, _ := strconv.Atoi(v1Parts[i])
+				vp2, _ := strconv.Atoi(v2Parts[i])
+				if vp1 > vp2 {
+					return 1
+				} else if vp1 < vp2 {
+					return -1
+				}
+			}
+			return 0
+		}
+
+		if compare(minVersion, maxVersion) > 0 {
+			minVersion, maxVersion = maxVersion, minVersion
+		}
+		return fmt.Sprintf(">=%s <=%s", minVersion, maxVersion)
+	} else if len(hanaVersionRange) == 1 {
+		minVersion := hanaVersionRange[0]
+		return fmt.Sprintf(">=%s", minVersion)
+	}
+
+	if len(hanaVersionRange) > 2 {
+		log.Printf("Invalid HanaVersionRange: expected 1 or 2 elements, got %d", len(hanaVersionRange))
+	}
+	return ""
+}
+
+// convertConfig - convert input file to output file
+func convertConfig(input, output, from, to string, merge bool) error {
+	content, err := ioutil.ReadFile(input)
+	if err != nil {
+		return fmt.Errorf("failed to open input file %s: %v", input, err)
+	}
+
+	if from == "" {
+		from = DetectFormat(input, content)
+	} else {
+		from = convertFormat(from)
+	}
+	if to == "" {
+		to = convertFormat(formatByExtension(output))
+	} else {
+		to = convertFormat(to)
+	}
+
+	var config *Config
+	var report []string
+	if from == "sql_exporter" || from == "hanadb_exporter" {
+		config, report, err = ImportConfig(content, from)
+	} else {
+		config, err = UnmarshalConfig(content, from)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", input, err)
+	}
+
+	if merge {
+		existing, err := ioutil.ReadFile(output)
+		if err != nil {
+			return fmt.Errorf("failed to open output file %s: %v", output, err)
+		}
+		target, err := UnmarshalConfig(existing, DetectFormat(output, existing))
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %v", output, err)
+		}
+		target.MergeQueries(config)
+		target.MergeTenants(config)
+		config = target
+	}
+
+	out, err := MarshalConfig(config, to)
+	if err != nil {
+		return fmt.Errorf("failed to convert %s: %v", input, err)
+	}
+
+	err = ioutil.WriteFile(output, out, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write file %s: %v", output, err)
+	}
+
+	fmt.Printf("Successfully converted %s (%s) to %s (%s)\n", input, convertFormatName(from), output, convertFormatName(to))
+	if len(report) > 0 {
+		fmt.Println("Not converted, please check the output file:")
+		for _, msg := range report {
+			fmt.Printf("  - %s\n", msg)
+		}
+	}
+	return nil
+}
+
+// convertFormat - format of the --from and --to flags of convert: json is the
+// community metrics.json file, json-config the complete configuration as JSON
+func convertFormat(format string) string {
+	switch format {
+	case "json":
+		return "metrics"
+	case "json-config":
+		return "json"
+	}
+	return format
+}
+
+// convertFormatName - name of the format in the --from and --to flags
+func convertFormatName(format string) string {
+	switch format {
+	case "metrics":
+		return "json"
+	case "json":
+		return "json-config"
+	}
+	return format
+}
+
+// DetectFormat - format of a config file by extension and content
+func DetectFormat(file string, content []byte) string {
+	format := formatByExtension(file)
+	if format != "json" {
+		return format
+	}
+
+	// metrics JSON files are objects with sql statements as keys
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(content, &object); err != nil || len(object) == 0 {
+		return format
+	}
+	for key := range object {
+		sel := strings.ToLower(strings.TrimSpace(key))
+		if !strings.HasPrefix(sel, "select") && !strings.HasPrefix(sel, "with") {
+			return format
+		}
+	}
+	return "metrics"
+}
+
+// format of a file by its extension, toml if unknown
+func formatByExtension(file string) string {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		return "yaml"
+	case ".json":
+		return "json"
+	default:
+		return "toml"
+	}
+}
+
+// UnmarshalConfig - read config of the given format
+func UnmarshalConfig(content []byte, format string) (*Config, error) {
+	if format == "metrics" {
+		return metricsToConfig(content)
+	}
+	if !ContainsString(format, []string{"toml", "yaml", "json"}) {
+		return nil, errors.Errorf("UnmarshalConfig(unknown format %s)", format)
+	}
+
+	var config Config
+	v := viper.New()
+	v.SetConfigType(format)
+	if err := v.ReadConfig(bytes.NewReader(content)); err != nil {
+		return nil, errors.Wrap(err, "UnmarshalConfig(ReadConfig)")
+	}
+	if err := v.Unmarshal(&config); err != nil {
+		return nil, errors.Wrap(err, "UnmarshalConfig(Unmarshal)")
+	}
+	return &config, nil
+}
+
+// MarshalConfig - write config in the given format
+func MarshalConfig(config *Config, format string) ([]byte, error) {
+	switch format {
+	case "toml":
+		out, err := toml.Marshal(*config)
+		if err != nil {
+			return nil, errors.Wrap(err, "MarshalConfig(toml)")
+		}
+		return out, nil
+	case "metrics":
+		out, err := configToMetrics(config)
+		if err != nil {
+			return nil, errors.Wrap(err, "MarshalConfig(configToMetrics)")
+		}
+		return out, nil
+	case "yaml", "json":
+		doc, err := configDocument(config)
+		if err != nil {
+			return nil, errors.Wrap(err, "MarshalConfig(configDocument)")
+		}
+		if format == "json" {
+			out, err := json.MarshalIndent(doc, "", "  ")
+			if err != nil {
+				return nil, errors.Wrap(err, "MarshalConfig(json)")
+			}
+			return append(out, '\n'), nil
+		}
+		out, err := yaml.Marshal(doc)
+		if err != nil {
+			return nil, errors.Wrap(err, "MarshalConfig(yaml)")
+		}
+		return out, nil
+	}
+	return nil, errors.Errorf("MarshalConfig(unknown format %s)", format)
+}
+
+// config as generic map with the secret as integer slice like in toml files
+func configDocument(config *Config) (map[string]interface{}, error) {
+	content, err := json.Marshal(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "configDocument(Marshal)")
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(content, &doc); err != nil {
+		return nil, errors.Wrap(err, "configDocument(Unmarshal)")
+	}
+	doc["Secret"] = SecretValues(config.Secret)
+	return doc, nil
+}
+
+// MergeTenants - append tenants that do not exist yet, existing tenants are kept
+func (config *Config) MergeTenants(src *Config) {
+	for _, tenant := range src.Tenants {
+		exists := false
+		for _, t := range config.Tenants {
+			if low(t.Name) == low(tenant.Name) {
+				exists = true
+				break
+			}
+		}
+		if !exists {
+			config.Tenants = append(config.Tenants, tenant)
+		}
+	}
+}
+
+// MergeQueries - replace queries with the same SQL and append new queries
+// and metrics, tenants, secret and settings are kept
+func (config *Config) MergeQueries(src *Config) {
+	for _, query := range src.Queries {
+		replaced := false
+		for qPos := range config.Queries {
+			if strings.TrimSpace(config.Queries[qPos].SQL) == strings.TrimSpace(query.SQL) {
+				config.Queries[qPos] = query
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			config.Queries = append(config.Queries, query)
+		}
+	}
+
+	for _, metric := range src.Metrics {
+		replaced := false
+		for mPos := range config.Metrics {
+			if strings.EqualFold(config.Metrics[mPos].Name, metric.Name) {
+				config.Metrics[mPos] = metric
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			config.Metrics = append(config.Metrics, metric)
+		}
+	}
+}
+
+// metricsToConfig - convert metrics JSON content to config queries in the
+// order of the file
+func metricsToConfig(byteValue []byte) (*Config, error) {
+	dec := json.NewDecoder(bytes.NewReader(byteValue))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil, fmt.Errorf("failed to parse JSON: expected object")
+	}
+
+	// 创建TOML配置结构
+	tomlConfig := Config{
+		Queries: make([]QueryInfo, 0),
+	}
+
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse JSON: %v", err)
+		}
+		sql, _ := tok.(string)
+
+		var queryConfig QueryConfig
+		if err := dec.Decode(&queryConfig); err != nil {
+			return nil, fmt.Errorf("failed to parse JSON of %q: %v", sql, err)
+		}
+
+		query := QueryInfo{
+			SQL:      sql,
+			Metrics:  make([]QueryMetricInfo, 0),
+			Disabled: !queryConfig.Enabled,
+		}
+
+		// 处理版本范围
+		query.VersionFilter = processVersionRange(queryConfig.HanaVersionRange)
+
+		// 转换指标
+		for _, metric := range queryConfig.Metrics {
+			tomlMetric := QueryMetricInfo{
+				Name:        metric.Name,
+				Help:        metric.Description,
+				MetricType:  metric.Type,
+				ValueColumn: metric.Value,
+				Unit:        metric.Unit,
+			}
+
+			if len(metric.Labels) > 0 {
+				tomlMetric.Labels = metric.Labels
+			}
+
+			query.Metrics = append(query.Metrics, tomlMetric)
+		}
+
+		tomlConfig.Queries = append(tomlConfig.Queries, query)
+	}
+
+	return &tomlConfig, nil
+}
+
+// configToMetrics - convert config queries and metrics to metrics JSON, fields
+// without counterpart are reported. Disabled metrics are left out and the
+// metrics of queries with the same SQL are merged into one entry.
+func configToMetrics(config *Config) ([]byte, error) {
+	queries := append([]QueryInfo{}, config.Queries...)
+	for _, m := range config.Metrics {
+		queries = append(queries, QueryInfo{
+			SQL:           m.SQL,
+			TagFilter:     m.TagFilter,
+			SchemaFilter:  m.SchemaFilter,
+			VersionFilter: m.VersionFilter,
+			Disabled:      m.Disabled,
+			Metrics: []QueryMetricInfo{{
+				Name:        m.Name,
+				Help:        m.Help,
+				MetricType:  m.MetricType,
+				ValueColumn: m.ValueColumn,
+				Unit:        m.Unit,
+				Labels:      m.Labels,
+				States:      m.States,
+			}},
+		})
+	}
+
+	// queries with the same SQL share one entry
+	type entry struct {
+		disabled     bool
+		versionRange []string
+		active       []QueryMetricInfo // enabled metrics
+		all          []QueryMetricInfo
+	}
+	var sqls []string
+	entries := make(map[string]*entry)
+	for qPos, query := range queries {
+		versionRange, err := versionRangeOf(query.VersionFilter)
+		if err != nil {
+			log.Printf("Query %d: %v, version filter dropped", qPos, err)
+		}
+		defaultSchema := len(query.SchemaFilter) == 0 || (len(query.SchemaFilter) == 1 && low(query.SchemaFilter[0]) == "sys")
+		if len(query.TagFilter) > 0 || !defaultSchema {
+			log.Printf("Query %d: TagFilter and SchemaFilter can't be converted and are dropped", qPos)
+		}
+
+		sql := strings.TrimSpace(query.SQL)
+		e, ok := entries[sql]
+		if !ok {
+			e = &entry{disabled: query.Disabled, versionRange: versionRange}
+			sqls = append(sqls, sql)
+			entries[sql] = e
+		} else if e.disabled != query.Disabled || strings.Join(e.versionRange, " ") != strings.Join(versionRange, " ") {
+			return nil, errors.Errorf("configToMetrics(query %d: the same SQL with another Disabled or VersionFilter: %s)", qPos, sql)
+		}
+		for _, m := range query.Metrics {
+			e.all = append(e.all, m)
+			if !m.Disabled {
+				e.active = append(e.active, m)
+			}
+		}
+	}
+
+	queryConfigs := make(map[string]QueryConfig)
+	for _, sql := range sqls {
+		e := entries[sql]
+
+		// disabled metrics are left out, an entry without enabled metrics
+		// is written as disabled query
+		metrics := e.active
+		enabled := !e.disabled
+		if len(metrics) == 0 {
+			metrics, enabled = e.all, false
+		}
+		queryConfig := QueryConfig{
+			Enabled:          enabled,
+			HanaVersionRange: e.versionRange,
+			Metrics:          make([]*Metric, 0),
+		}
+		for _, m := range e.all {
+			if m.Disabled && len(e.active) > 0 {
+				log.Printf("Metric %s: disabled, left out", m.Name)
+			}
+		}
+		for _, m := range metrics {
+			if len(m.States) > 0 {
+				log.Printf("Metric %s: States can't be converted and are dropped", m.Name)
+			}
+			queryConfig.Metrics = append(queryConfig.Metrics, &Metric{
+				Name:        m.Name,
+				Description: m.Help,
+				Labels:      m.Labels,
+				Value:       m.ValueColumn,
+				Unit:        m.Unit,
+				Type:        m.MetricType,
+			})
+		}
+		queryConfigs[sql] = queryConfig
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("{")
+	for pos, sql := range sqls {
+		key, err := marshalJSON(sql, "")
+		if err != nil {
+			return nil, errors.Wrap(err, "configToMetrics(marshalJSON)")
+		}
+		value, err := marshalJSON(queryConfigs[sql], "  ")
+		if err != nil {
+			return nil, errors.Wrap(err, "configToMetrics(marshalJSON)")
+		}
+		if pos > 0 {
+			buf.WriteString(",")
+		}
+		buf.WriteString("\n  ")
+		buf.Write(key)
+		buf.WriteString(": ")
+		buf.Write(value)
+	}
+	buf.WriteString("\n}\n")
+	return buf.Bytes(), nil
+}
+
+// indented json without html escaping, sql contains < and >
+func marshalJSON(v interface{}, prefix string) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent(prefix, "  ")
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(buf.Bytes(), "\n"), nil
+}
+
+// versionRangeOf - metrics JSON version range of a version filter
+func versionRangeOf(filter string) ([]string, error) {
+	var minVersion, maxVersion string
+	for _, cond := range strings.Fields(versionOperatorBlanks.ReplaceAllString(filter, "$1")) {
+		switch {
+		case strings.HasPrefix(cond, ">="):
+			minVersion = strings.TrimSpace(cond[2:])
+		case strings.HasPrefix(cond, "<="):
+			maxVersion = strings.TrimSpace(cond[2:])
+		default:
+			return nil, errors.Errorf("version filter %q has no metrics JSON counterpart", filter)
+		}
+	}
+
+	switch {
+	case minVersion == "" && maxVersion == "":
+		return nil, nil
+	case minVersion == "":
+		return nil, errors.Errorf("version filter %q has no minimum version", filter)
+	case maxVersion == "":
+		return []string{minVersion}, nil
+	default:
+		return []string{minVersion, maxVersion}, nil
+	}
+}
@@ -0,0 +1,174 @@
+package cmd_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ulranh/hana_sql_exporter/cmd"
+)
+
+func Test_ConfigFormats(t *testing.T) {
+	assert := assert.New(t)
+
+	config := getTestConfig(2, 2)
+	config.Secret = []byte{10, 200, 3}
+	config.Include = []string{"hana:core"}
+	config.Queries = []cmd.QueryInfo{
+		{
+			SQL:     "select active_status from <SCHEMA>.m_services",
+			Metrics: []cmd.QueryMetricInfo{{Name: "q1", MetricType: "stateset", States: []string{"YES", "NO"}}},
+		},
+	}
+
+	// toml -> yaml -> json -> toml is lossless
+	content, err := cmd.MarshalConfig(config, "toml")
+	assert.Nil(err)
+	from := "toml"
+	for _, to := range []string{"yaml", "json", "toml"} {
+		c, err := cmd.UnmarshalConfig(content, from)
+		assert.Nil(err)
+		content, err = cmd.MarshalConfig(c, to)
+		assert.Nil(err)
+		from = to
+	}
+	res, err := cmd.UnmarshalConfig(content, "toml")
+	assert.Nil(err)
+	assert.Equal(config.Secret, res.Secret)
+	assert.Equal(config.Include, res.Include)
+	assert.Equal(config.Tenants[0].Name, res.Tenants[0].Name)
+	assert.Equal(config.Tenants[0].Schemas, res.Tenants[0].Schemas)
+	assert.Equal(config.Metrics[1].SQL, res.Metrics[1].SQL)
+	assert.Equal(config.Queries[0].Metrics[0].States, res.Queries[0].Metrics[0].States)
+
+	_, err = cmd.MarshalConfig(config, "xml")
+	assert.NotNil(err)
+}
+
+func Test_DetectFormat(t *testing.T) {
+	assert := assert.New(t)
+
+	content, err := ioutil.ReadFile("../test/metrics.json")
+	assert.Nil(err)
+	assert.Equal("metrics", cmd.DetectFormat("metrics.json", content))
+	assert.Equal("json", cmd.DetectFormat("config.json", []byte(`{"Timeout": 5}`)))
+	assert.Equal("yaml", cmd.DetectFormat("config.yml", nil))
+	assert.Equal("toml", cmd.DetectFormat("config.toml", nil))
+}
+
+func Test_ConfigSchema(t *testing.T) {
+	assert := assert.New(t)
+
+	schema, err := cmd.ConfigSchema()
+	assert.Nil(err)
+
+	// the published schema must be regenerated after config changes
+	published, err := ioutil.ReadFile("../examples/schema/hana_sql_exporter.schema.json")
+	assert.Nil(err)
+	assert.Equal(string(published), string(schema), "run: hana_sql_exporter config schema > examples/schema/hana_sql_exporter.schema.json")
+}
+
+// sql statements of a metrics JSON file in file order
+func metricsKeys(t *testing.T, content []byte) []string {
+	dec := json.NewDecoder(bytes.NewReader(content))
+	if _, err := dec.Token(); err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, tok.(string))
+		var skip json.RawMessage
+		if err := dec.Decode(&skip); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return keys
+}
+
+func Test_MetricsRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+
+	content, err := ioutil.ReadFile("../test/metrics.json")
+	assert.Nil(err)
+
+	config, err := cmd.UnmarshalConfig(content, "metrics")
+	assert.Nil(err)
+	out, err := cmd.MarshalConfig(config, "metrics")
+	assert.Nil(err)
+
+	// same order and same content
+	assert.Equal(metricsKeys(t, content), metricsKeys(t, out))
+	var src, dst map[string]cmd.QueryConfig
+	assert.Nil(json.Unmarshal(content, &src))
+	assert.Nil(json.Unmarshal(out, &dst))
+	assert.Equal(src, dst)
+
+	// disabled queries are kept
+	config, err = cmd.UnmarshalConfig([]byte(`{"select 1 from dummy": {"enabled": false, "metrics": [{"name": "m1", "type": "Gauge"}]}}`), "metrics")
+	assert.Nil(err)
+	assert.Equal(1, len(config.Queries))
+	assert.True(config.Queries[0].Disabled)
+	assert.Equal("Gauge", config.Queries[0].Metrics[0].MetricType)
+}
+
+func Test_ConfigToMetrics(t *testing.T) {
+	assert := assert.New(t)
+
+	config := &cmd.Config{
+		Queries: []cmd.QueryInfo{
+			{SQL: "select 1 v from dummy", Metrics: []cmd.QueryMetricInfo{
+				{Name: "m1", MetricType: "gauge", ValueColumn: "v"},
+				{Name: "m2", MetricType: "gauge", ValueColumn: "v", Disabled: true},
+			}},
+			{SQL: "select 2 v from dummy", Metrics: []cmd.QueryMetricInfo{
+				{Name: "m3", MetricType: "gauge", ValueColumn: "v", Disabled: true},
+			}},
+		},
+		Metrics: []cmd.MetricInfo{
+			{Name: "m4", SQL: "select 1 v from dummy", MetricType: "gauge", ValueColumn: "v"},
+		},
+	}
+	out, err := cmd.MarshalConfig(config, "metrics")
+	assert.Nil(err)
+
+	// one entry per SQL, disabled metrics are left out
+	assert.Equal([]string{"select 1 v from dummy", "select 2 v from dummy"}, metricsKeys(t, out))
+	var entries map[string]cmd.QueryConfig
+	assert.Nil(json.Unmarshal(out, &entries))
+	var names []string
+	for _, m := range entries["select 1 v from dummy"].Metrics {
+		names = append(names, m.Name)
+	}
+	assert.Equal([]string{"m1", "m4"}, names)
+	assert.True(entries["select 1 v from dummy"].Enabled)
+	assert.False(entries["select 2 v from dummy"].Enabled)
+
+	// the same SQL in a disabled query can't be merged
+	config.Queries = append(config.Queries, cmd.QueryInfo{SQL: "select 1 v from dummy", Disabled: true, Metrics: []cmd.QueryMetricInfo{{Name: "m5"}}})
+	_, err = cmd.MarshalConfig(config, "metrics")
+	assert.NotNil(err)
+}
+
+func Test_MergeQueries(t *testing.T) {
+	assert := assert.New(t)
+
+	config := getTestConfig(1, 2)
+	config.Secret = []byte{1, 2, 3}
+	config.Queries = []cmd.QueryInfo{{SQL: "select 1 from dummy"}, {SQL: "select 2 from dummy"}}
+
+	src := cmd.Config{
+		Queries: []cmd.QueryInfo{{SQL: "select 2 from dummy", Disabled: true}, {SQL: "select 3 from dummy"}},
+	}
+	config.MergeQueries(&src)
+	assert.Equal(2, len(config.Tenants))
+	assert.Equal([]byte{1, 2, 3}, config.Secret)
+	assert.Equal(3, len(config.Queries))
+	assert.True(config.Queries[1].Disabled)
+	assert.Equal("select 3 from dummy", config.Queries[2].SQL)
+}
@@ -0,0 +1,430 @@
+package cmd
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+type counterStoreKey struct{}
+
+// keyValue - high-water mark of the KeyColumn of an incremental select
+type keyValue struct {
+	Type  string `json:"type"` // time, int, float or string
+	Value string `json:"value"`
+}
+
+// counterState - high-water mark and accumulated counters of an incremental
+// select for one tenant and schema
+type counterState struct {
+	Key    *keyValue                     `json:"key,omitempty"`
+	Totals map[string]map[string]float64 `json:"totals"` // metric name, joined label values
+}
+
+// counterStore - states of the incremental selects, persisted to the state
+// store or the state file after every scrape
+type counterStore struct {
+	mu     sync.Mutex
+	file   string
+	state  *stateStore // used instead of file, if StateDir is configured
+	states map[string]*counterState
+	locks  map[string]*sync.Mutex // one run per state at a time
+	dirty  bool
+}
+
+// newCounterStore - empty store, file is the state file or empty
+func newCounterStore(file string) *counterStore {
+	return &counterStore{
+		file:   file,
+		states: make(map[string]*counterState),
+		locks:  make(map[string]*sync.Mutex),
+	}
+}
+
+// withCounters - context with the counter store of the runtime
+func withCounters(ctx context.Context, store *counterStore) context.Context {
+	return context.WithValue(ctx, counterStoreKey{}, store)
+}
+
+// counters - counter store of ctx, a store without state file if there is none
+func counters(ctx context.Context) *counterStore {
+	if store, ok := ctx.Value(counterStoreKey{}).(*counterStore); ok && store != nil {
+		return store
+	}
+	return newCounterStore("")
+}
+
+// load - read the states of the state store or the state file, a missing
+// file is no error
+func (store *counterStore) load() error {
+	if store == nil {
+		return nil
+	}
+	if store.state != nil {
+		return store.loadState()
+	}
+	if store.file == "" {
+		return nil
+	}
+	content, err := ioutil.ReadFile(store.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "load(ReadFile)")
+	}
+	states := make(map[string]*counterState)
+	if err := json.Unmarshal(content, &states); err != nil {
+		return errors.Wrapf(err, "load(%s)", store.file)
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.states = states
+	return nil
+}
+
+// loadState - read the states of the counters bucket
+func (store *counterStore) loadState() error {
+	states := make(map[string]*counterState)
+	err := store.state.each(bucketCounters, counterVersion, func(key string, data json.RawMessage) error {
+		var state counterState
+		if err := json.Unmarshal(data, &state); err != nil {
+			log.WithField("key", key).WithError(err).Warn("unreadable counter state skipped")
+			return nil
+		}
+		states[key] = &state
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "loadState(each)")
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.states = states
+	return nil
+}
+
+// save - write the states into the state store or the state file, if they
+// changed
+func (store *counterStore) save() error {
+	if store == nil {
+		return nil
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if !store.dirty {
+		return nil
+	}
+	if store.state != nil {
+		values := make(map[string]interface{}, len(store.states))
+		for key, state := range store.states {
+			values[key] = state
+		}
+		if err := store.state.put(bucketCounters, counterVersion, values); err != nil {
+			return errors.Wrap(err, "save(put)")
+		}
+		store.dirty = false
+		return nil
+	}
+	if store.file == "" {
+		return nil
+	}
+	content, err := json.MarshalIndent(store.states, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "save(MarshalIndent)")
+	}
+
+	// replace the file at once, a crash leaves the old states
+	tmp, err := ioutil.TempFile(filepath.Dir(store.file), filepath.Base(store.file)+".*")
+	if err != nil {
+		return errors.Wrap(err, "save(TempFile)")
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "save(Write)")
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "save(Close)")
+	}
+	if err := os.Rename(tmp.Name(), store.file); err != nil {
+		return errors.Wrap(err, "save(Rename)")
+	}
+	store.dirty = false
+	return nil
+}
+
+// lock - lock the state of the key, the returned function unlocks it
+func (store *counterStore) lock(key string) func() {
+	store.mu.Lock()
+	l, ok := store.locks[key]
+	if !ok {
+		l = &sync.Mutex{}
+		store.locks[key] = l
+	}
+	store.mu.Unlock()
+	l.Lock()
+	return l.Unlock
+}
+
+// get - copy of the state of the key
+func (store *counterStore) get(key string) counterState {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	state := counterState{Totals: make(map[string]map[string]float64)}
+	if current, ok := store.states[key]; ok {
+		state.Key = current.Key
+		for metric, totals := range current.Totals {
+			state.Totals[metric] = make(map[string]float64, len(totals))
+			for labels, total := range totals {
+				state.Totals[metric][labels] = total
+			}
+		}
+	}
+	return state
+}
+
+// set - replace the state of the key
+func (store *counterStore) set(key string, state counterState) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.states[key] = &state
+	store.dirty = true
+}
+
+// incremental - true, if the select only reads the rows after the
+// high-water mark of its KeyColumn
+func (query QueryInfo) incremental() bool {
+	return query.KeyColumn != ""
+}
+
+// counterKey - key of the state of the incremental select for the tenant and schema
+func (query QueryInfo) counterKey(tenant *Tenant, schema string) string {
+	id := query.Name
+	if id == "" {
+		names := make([]string, len(query.Metrics))
+		for i, metric := range query.Metrics {
+			names[i] = metric.Name
+		}
+		id = strings.Join(names, ",")
+	}
+	return low(tenant.Name) + "/" + low(schema) + "/" + low(id)
+}
+
+// newKeyValue - high-water mark of a KeyColumn value
+func newKeyValue(v interface{}) (*keyValue, error) {
+	switch value := v.(type) {
+	case time.Time:
+		return &keyValue{"time", value.UTC().Format(time.RFC3339Nano)}, nil
+	case string:
+		return &keyValue{"string", value}, nil
+	case []byte:
+		return &keyValue{"string", string(value)}, nil
+	}
+	f, err := convertToFloat64(v)
+	if err != nil {
+		return nil, errors.Wrap(err, "newKeyValue(convertToFloat64)")
+	}
+	if f == math.Trunc(f) && math.Abs(f) < 1<<53 {
+		return &keyValue{"int", strconv.FormatInt(int64(f), 10)}, nil
+	}
+	return &keyValue{"float", strconv.FormatFloat(f, 'g', -1, 64)}, nil
+}
+
+// arg - the high-water mark as bound parameter
+func (key *keyValue) arg() interface{} {
+	if key == nil {
+		return nil
+	}
+	switch key.Type {
+	case "time":
+		if t, err := time.Parse(time.RFC3339Nano, key.Value); err == nil {
+			return t
+		}
+	case "int":
+		if i, err := strconv.ParseInt(key.Value, 10, 64); err == nil {
+			return i
+		}
+	case "float":
+		if f, err := strconv.ParseFloat(key.Value, 64); err == nil {
+			return f
+		}
+	}
+	return key.Value
+}
+
+// after - true, if the key is after other, keys of another type replace other
+func (key *keyValue) after(other *keyValue) bool {
+	if other == nil || key.Type != other.Type {
+		return true
+	}
+	switch a, b := key.arg(), other.arg(); a.(type) {
+	case time.Time:
+		return a.(time.Time).After(b.(time.Time))
+	case int64:
+		return a.(int64) > b.(int64)
+	case float64:
+		return a.(float64) > b.(float64)
+	}
+	return key.Value > other.Value
+}
+
+// collectIncremental - read the rows after the high-water mark of the
+// KeyColumn and add them to the counters of the tenant and schema. The
+// counters and the high-water mark only change, if all rows were processed.
+func (tenant *Tenant) collectIncremental(ctx context.Context, db *sql.DB, query QueryInfo, schema string) ([]MetricData, error) {
+	if !strings.Contains(query.SQL, ".LastKey") {
+		return nil, errors.New("collectIncremental(the select does not use {{.LastKey}})")
+	}
+	store := counters(ctx)
+	key := query.counterKey(tenant, schema)
+	defer store.lock(key)()
+	state := store.get(key)
+
+	vars := tenant.sqlVars(schema, lastScrape(ctx))
+	vars.LastKey = state.Key.arg()
+	sel, args, err := tenant.statement(query.SQL, vars)
+	if err != nil {
+		return nil, errors.Wrap(err, "collectIncremental(statement)")
+	}
+	TenantLog(query.logFields(tenant)).WithFields(log.Fields{"schema": schema, "sql": sel, "last_key": vars.LastKey}).Debug("incremental query running")
+
+	data, cols, err := runRows(ctx, db, sel, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "collectIncremental(runRows)")
+	}
+	keyPos := columnPos(cols, query.KeyColumn)
+	if keyPos < 0 {
+		return nil, errors.Errorf("collectIncremental(key column %s not selected)", query.KeyColumn)
+	}
+
+	// new high-water mark
+	for _, row := range data {
+		value := *(row[keyPos].(*interface{}))
+		if value == nil {
+			continue
+		}
+		rowKey, err := newKeyValue(value)
+		if err != nil {
+			return nil, errors.Wrap(err, "collectIncremental(newKeyValue)")
+		}
+		if rowKey.after(state.Key) {
+			state.Key = rowKey
+		}
+	}
+
+	var mds []MetricData
+	for _, metric := range query.Metrics {
+		if metric.Disabled {
+			continue
+		}
+		records, err := tenant.addCounts(metric, data, cols, state.Totals, schema)
+		if err != nil {
+			return nil, errors.Wrapf(err, "collectIncremental(%s)", metric.Name)
+		}
+		if len(records) > 0 {
+			mds = append(mds, MetricData{
+				Name:       getMetricName(metric.Name, metric.Unit, metric.MetricType),
+				Help:       metric.Help,
+				MetricType: metric.MetricType,
+				Stats:      records,
+			})
+		}
+	}
+	store.set(key, state)
+	return mds, nil
+}
+
+// addCounts - add the rows to the totals of the metric: the sum of the
+// ValueColumn or the number of rows per label values. All totals are
+// returned as records.
+func (tenant *Tenant) addCounts(metric QueryMetricInfo, data [][]interface{}, cols []string, totals map[string]map[string]float64, schema string) ([]MetricRecord, error) {
+	valuePos := -1
+	if metric.ValueColumn != "" {
+		if valuePos = columnPos(cols, metric.ValueColumn); valuePos < 0 {
+			return nil, errors.Errorf("addCounts(value column %s not selected)", metric.ValueColumn)
+		}
+	}
+	labelPos := make([]int, len(metric.Labels))
+	for i, label := range metric.Labels {
+		if labelPos[i] = columnPos(cols, label); labelPos[i] < 0 {
+			return nil, errors.Errorf("addCounts(label column %s not selected)", label)
+		}
+	}
+
+	metricTotals, ok := totals[metric.Name]
+	if !ok {
+		metricTotals = make(map[string]float64)
+		totals[metric.Name] = metricTotals
+	}
+	for _, row := range data {
+		values := make([]string, len(labelPos))
+		for i, pos := range labelPos {
+			values[i] = low(strings.Join(strings.Split(convertToString(*(row[pos].(*interface{}))), " "), "_"))
+		}
+		count := 1.0
+		if valuePos >= 0 {
+			value := *(row[valuePos].(*interface{}))
+			if value == nil {
+				continue
+			}
+			var err error
+			if count, err = convertToFloat64(value); err != nil {
+				return nil, errors.Wrap(err, "addCounts(convertToFloat64)")
+			}
+		}
+		metricTotals[strings.Join(values, "\x00")] += count
+	}
+
+	joinedValues := make([]string, 0, len(metricTotals))
+	for joined := range metricTotals {
+		joinedValues = append(joinedValues, joined)
+	}
+	sort.Strings(joinedValues)
+
+	var records []MetricRecord
+	for _, joined := range joinedValues {
+		var values []string
+		if len(metric.Labels) > 0 {
+			values = strings.Split(joined, "\x00")
+		}
+		if len(values) != len(metric.Labels) || (len(values) == 0 && joined != "") {
+			// the labels of the metric were changed
+			delete(metricTotals, joined)
+			continue
+		}
+		record := tenant.baseRecord()
+		record.setLabel("schema", low(schema))
+		for i, label := range metric.Labels {
+			record.Labels = append(record.Labels, low(label))
+			record.LabelValues = append(record.LabelValues, values[i])
+		}
+		record.Value = metricTotals[joined]
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// columnPos - position of the column, -1 if it is not selected
+func columnPos(cols []string, name string) int {
+	for i, col := range cols {
+		if strings.EqualFold(col, name) {
+			return i
+		}
+	}
+	return -1
+}
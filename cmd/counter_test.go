@@ -0,0 +1,105 @@
+package cmd_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ulranh/hana_sql_exporter/cmd"
+	"github.com/ulranh/hana_sql_exporter/internal/hdbmock"
+)
+
+// job rows with id, status and runtime
+func jobRules(rows ...[]interface{}) []hdbmock.Rule {
+	return append([]hdbmock.Rule{
+		{SQL: `sapabap1\.tbtco`, Columns: []string{"ID", "STATUS", "RUNTIME"}, Rows: rows},
+	}, metadataRules...)
+}
+
+// values of the records of the metric by the label
+func valuesBy(data []cmd.MetricData, name, label string) map[string]float64 {
+	values := make(map[string]float64)
+	for _, md := range data {
+		if md.Name != name {
+			continue
+		}
+		for _, record := range md.Stats {
+			key := ""
+			for i, l := range record.Labels {
+				if l == label {
+					key = record.LabelValues[i]
+				}
+			}
+			values[key] = record.Value
+		}
+	}
+	return values
+}
+
+func Test_IncrementalCounter(t *testing.T) {
+	assert := assert.New(t)
+
+	drv, err := hdbmock.Register(jobRules(
+		[]interface{}{int64(1), "A", int64(10)},
+		[]interface{}{int64(3), "F", int64(5)},
+		[]interface{}{int64(2), "A", int64(20)},
+	)...)
+	assert.Nil(err)
+
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	config := e2eConfig(t)
+	config.Tenants = config.Tenants[:1]
+	config.StateFile = stateFile
+	sel := "select id, status, runtime from <SCHEMA>.tbtco where status in ('A', 'F'){{if .LastKey}} and id > {{param .LastKey}}{{end}}"
+	config.Queries = []cmd.QueryInfo{
+		{SQL: sel, KeyColumn: "ID", SchemaFilter: []string{"sapabap1"}, Metrics: []cmd.QueryMetricInfo{
+			{Name: "abap_jobs_total", Help: "jobs", MetricType: "counter", Labels: []string{"STATUS"}},
+		}},
+	}
+	config.Metrics = []cmd.MetricInfo{
+		{Name: "abap_job_runtime_seconds_total", Help: "runtime", MetricType: "counter", SQL: sel, KeyColumn: "id", ValueColumn: "runtime", SchemaFilter: []string{"sapabap1"}},
+		{Name: "abap_broken_total", Help: "no LastKey", MetricType: "counter", SQL: "select id, status, runtime from <SCHEMA>.tbtco", KeyColumn: "id", SchemaFilter: []string{"sapabap1"}},
+	}
+
+	rt := cmd.NewRuntime(config)
+	rt.SQLDriver = drv.Name()
+	assert.Nil(rt.Connect())
+
+	// the first run reads all rows
+	data := rt.Scrape()
+	assert.Equal(map[string]float64{"a": 2, "f": 1}, valuesBy(data, "abap_jobs_total", "status"))
+	assert.Equal(map[string]float64{"": 35}, valuesBy(data, "abap_job_runtime_seconds_total", "status"))
+	assert.Empty(valuesBy(data, "abap_broken_total", "status"))
+	_, err = os.Stat(stateFile)
+	assert.Nil(err)
+
+	// the next run only reads the rows after the high-water mark
+	assert.Nil(drv.Replace(jobRules([]interface{}{int64(4), "A", int64(1)})...))
+	data = rt.Scrape()
+	assert.Equal(map[string]float64{"a": 3, "f": 1}, valuesBy(data, "abap_jobs_total", "status"))
+	assert.Equal(map[string]float64{"": 36}, valuesBy(data, "abap_job_runtime_seconds_total", "status"))
+	sels, args := executedArgs(drv, "and id > ?")
+	assert.Len(sels, 2)
+	assert.Equal([]interface{}{int64(3)}, args[len(args)-1])
+	rt.Close()
+
+	// the counters continue after a restart
+	assert.Nil(drv.Replace(jobRules([]interface{}{int64(5), "F", int64(2)})...))
+	rt = cmd.NewRuntime(config)
+	rt.SQLDriver = drv.Name()
+	assert.Nil(rt.Connect())
+	defer rt.Close()
+	data = rt.Scrape()
+	assert.Equal(map[string]float64{"a": 3, "f": 2}, valuesBy(data, "abap_jobs_total", "status"))
+	assert.Equal(map[string]float64{"": 38}, valuesBy(data, "abap_job_runtime_seconds_total", "status"))
+	_, args = executedArgs(drv, "and id > ?")
+	assert.Equal([]interface{}{int64(4)}, args[len(args)-1])
+
+	// a failing select keeps the counters
+	assert.Nil(drv.Replace(append([]hdbmock.Rule{{SQL: `sapabap1\.tbtco`, Err: os.ErrDeadlineExceeded}}, metadataRules...)...))
+	rt.Scrape()
+	assert.Nil(drv.Replace(jobRules()...))
+	data = rt.Scrape()
+	assert.Equal(map[string]float64{"a": 3, "f": 2}, valuesBy(data, "abap_jobs_total", "status"))
+}
@@ -0,0 +1,251 @@
+package cmd
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultDiscoveryInterval = 300
+	defaultDatabaseColumn    = "DATABASE_NAME"
+	scopeSystemDB            = "systemdb"
+)
+
+// tenant databases of a system database with the hosts and sql ports of their
+// indexservers, the master indexserver of scale-out systems first
+const tenantDatabasesSelect = `SELECT d.database_name, s.host, s.sql_port
+FROM sys.m_databases d
+JOIN sys_databases.m_services s ON s.database_name = d.database_name
+WHERE d.active_status = 'YES'
+AND d.database_name <> 'SYSTEMDB'
+AND s.service_name = 'indexserver'
+AND s.sql_port > 0
+ORDER BY d.database_name, CASE WHEN s.coordinator_type = 'MASTER' THEN 0 ELSE 1 END, s.sql_port`
+
+// tenantDatabase - active tenant database of a system database
+type tenantDatabase struct {
+	name string
+	host string
+	port int
+}
+
+// isTemplate - true, if the tenant entry is the template of a system database
+// and has no own connection
+func (config *Config) isTemplate(name string) bool {
+	for _, tenant := range config.Tenants {
+		if tenant.SystemDB && tenant.Template != "" && low(tenant.Template) == low(name) {
+			return config.FindTenant(name).ConnStr == ""
+		}
+	}
+	return false
+}
+
+// tenantDatabases - active tenant databases of the system database, the host
+// and sql port of the first indexserver of every database
+func (system *Tenant) tenantDatabases(ctx context.Context) ([]tenantDatabase, error) {
+	rows, err := system.DB().QueryContext(ctx, tenantDatabasesSelect)
+	if err != nil {
+		return nil, errors.Wrap(err, "tenantDatabases(Query)")
+	}
+	defer rows.Close()
+
+	var dbs []tenantDatabase
+	for rows.Next() {
+		var db tenantDatabase
+		if err := rows.Scan(&db.name, &db.host, &db.port); err != nil {
+			return nil, errors.Wrap(err, "tenantDatabases(Scan)")
+		}
+		if len(dbs) > 0 && dbs[len(dbs)-1].name == db.name {
+			continue
+		}
+		dbs = append(dbs, db)
+	}
+	return dbs, errors.Wrap(rows.Err(), "tenantDatabases(rows.Err)")
+}
+
+// discoveredTenants - tenant entries of the databases of the system database,
+// user, tags, schemas and password come from the template or the system entry.
+// The tenants get the system replication sites of the system entry with their
+// own sql port.
+func (rt *Runtime) discoveredTenants(system *Tenant, dbs []tenantDatabase) ([]*Tenant, error) {
+	template := system.TenantInfo
+	if system.Template != "" {
+		template = rt.Config.FindTenant(system.Template)
+		if template.Name == "" {
+			return nil, errors.Errorf("discoveredTenants(template %s does not exist)", system.Template)
+		}
+	}
+
+	var tenants []*Tenant
+	for _, db := range dbs {
+		if ContainsString(db.name, system.Exclude) {
+			continue
+		}
+		port := ":" + strconv.Itoa(db.port)
+		var hosts []string
+		if len(system.Hosts) > 0 {
+			for _, site := range append([]string{system.ConnStr}, system.Hosts...) {
+				if connHost(site) != low(db.host) {
+					hosts = append(hosts, connHost(site)+port)
+				}
+			}
+		}
+		tenants = append(tenants, &Tenant{
+			TenantInfo: TenantInfo{
+				Name:     low(db.name),
+				Tags:     template.Tags,
+				ConnStr:  low(db.host) + port,
+				Hosts:    hosts,
+				User:     template.User,
+				Schemas:  template.Schemas,
+				Vars:     template.Vars,
+				LogLevel: template.LogLevel,
+			},
+			secret: template.Name,
+		})
+	}
+	return tenants, nil
+}
+
+// connHost - lower case host of the connection string without port
+func connHost(connStr string) string {
+	if i := strings.LastIndex(connStr, ":"); i >= 0 {
+		connStr = connStr[:i]
+	}
+	return low(connStr)
+}
+
+// Discover - read the tenant databases of the system database and add, update
+// and remove the discovered tenants of the system accordingly
+func (rt *Runtime) Discover(ctx context.Context, system *Tenant) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(rt.Config.Timeout)*time.Second)
+	defer cancel()
+	dbs, err := system.tenantDatabases(ctx)
+	if err != nil {
+		return errors.Wrap(err, "Discover(tenantDatabases)")
+	}
+	wanted, err := rt.discoveredTenants(system, dbs)
+	if err != nil {
+		return errors.Wrap(err, "Discover(discoveredTenants)")
+	}
+
+	// the discovered tenants follow their system database
+	return errors.Wrap(rt.reconcile("systemdb:"+system.Name, wanted, system), "Discover(reconcile)")
+}
+
+// discoverEvery - discover the tenants of the system database every
+// DiscoveryInterval seconds until ctx is done
+func (rt *Runtime) discoverEvery(ctx context.Context, system *Tenant) {
+	interval := system.DiscoveryInterval
+	if interval == 0 {
+		interval = defaultDiscoveryInterval
+	}
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := rt.Discover(ctx, system); err != nil {
+			log.WithField("tenant", system.Name).WithError(err).Error("tenant discovery failed")
+		}
+	}
+}
+
+// systemDB - true, if the select runs once per system database
+func (query QueryInfo) systemDB() bool {
+	return low(query.Scope) == scopeSystemDB
+}
+
+// databaseColumn - column with the database name of a systemdb query
+func (query QueryInfo) databaseColumn() string {
+	if query.DatabaseColumn != "" {
+		return query.DatabaseColumn
+	}
+	return defaultDatabaseColumn
+}
+
+// collectSystemDB - run the query once on every system database and assign
+// the records to the tenants of their databases
+func (rt *Runtime) collectSystemDB(ctx context.Context, qPos int, query QueryInfo) []MetricData {
+	tenants := rt.tenantList()
+	var systems []*Tenant
+	for _, tenant := range tenants {
+		if tenant.SystemDB {
+			systems = append(systems, tenant)
+		}
+	}
+
+	// the tag filter applies to the tenants of the rows
+	systemQuery := query
+	systemQuery.TagFilter = nil
+
+	results := make([][]MetricData, len(systems))
+	var wg sync.WaitGroup
+	for sPos := range systems {
+		wg.Add(1)
+		go func(sPos int) {
+			defer wg.Done()
+			data := rt.collect(ctx, "query", qPos, systems[sPos], systemQuery)
+			results[sPos] = assignTenants(systems[sPos], tenants, query.TagFilter, data)
+		}(sPos)
+	}
+	wg.Wait()
+
+	var sData []MetricData
+	for _, data := range results {
+		sData = append(sData, data...)
+	}
+	return sData
+}
+
+// assignTenants - replace the tenant labels of the system database by the
+// labels of the tenant with the database_name of the record. Records of
+// databases without a monitored tenant are left out.
+func assignTenants(system *Tenant, tenants []*Tenant, tagFilter []string, data []MetricData) []MetricData {
+	databases := make(map[string]*Tenant)
+	for _, tenant := range tenants {
+		if strings.EqualFold(tenant.SID, system.SID) && tenant.applies(tagFilter, "") {
+			databases[strings.ToUpper(tenant.DatabaseName)] = tenant
+		}
+	}
+
+	var assigned []MetricData
+	for _, md := range data {
+		var stats []MetricRecord
+		for _, record := range md.Stats {
+			database := ""
+			for i, label := range record.Labels {
+				if label == "database_name" {
+					database = record.LabelValues[i]
+				}
+			}
+			tenant, ok := databases[strings.ToUpper(database)]
+			if !ok {
+				TenantLog(log.Fields{"tenant": system.Name, "database": database, "metric": md.Name}).Debug("no tenant for database, record left out")
+				continue
+			}
+			base := tenant.baseRecord()
+			for i, label := range base.Labels {
+				if label != "schema" {
+					record.setLabel(label, base.LabelValues[i])
+				}
+			}
+			stats = append(stats, record)
+		}
+		if len(stats) > 0 {
+			md.Stats = stats
+			assigned = append(assigned, md)
+		}
+	}
+	return assigned
+}
@@ -0,0 +1,180 @@
+package cmd_test
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ulranh/hana_sql_exporter/cmd"
+	"github.com/ulranh/hana_sql_exporter/internal/hdbmock"
+)
+
+// tenant databases of the system database q00
+func databaseRule(rows ...[]interface{}) hdbmock.Rule {
+	return hdbmock.Rule{SQL: `m_databases`, Columns: []string{"DATABASE_NAME", "HOST", "SQL_PORT"}, Rows: rows}
+}
+
+// names and connection strings of the connected tenants
+func tenantConns(rt *cmd.Runtime) map[string]string {
+	conns := make(map[string]string)
+	for _, tenant := range rt.Tenants {
+		conns[tenant.Name] = tenant.ConnStr
+	}
+	return conns
+}
+
+func Test_Discover(t *testing.T) {
+	assert := assert.New(t)
+
+	drv, err := hdbmock.Register(append([]hdbmock.Rule{
+		databaseRule([]interface{}{"Q01", "q00host", int64(30015)}, []interface{}{"Q01", "q00host", int64(30017)}, []interface{}{"Q02", "q00host", int64(30041)}, []interface{}{"Q03", "q00host", int64(30044)}, []interface{}{"Q04", "q00host", int64(30047)}),
+	}, metadataRules...)...)
+	assert.Nil(err)
+
+	config := &cmd.Config{
+		Tenants: []cmd.TenantInfo{
+			{Name: "q00", ConnStr: "q00host:30013", User: "system", SystemDB: true, Template: "tpl", Exclude: []string{"q03"}},
+			{Name: "tpl", User: "monitor", Tags: []string{"erp"}},
+			{Name: "q04", ConnStr: "q04host:30015", User: "monitor"},
+		},
+		Timeout: 2,
+	}
+	config.Secret, err = config.AddSecret("q00,tpl,q04", []byte("secret"))
+	assert.Nil(err)
+
+	rt := cmd.NewRuntime(config)
+	rt.SQLDriver = drv.Name()
+	assert.Nil(rt.Connect())
+	defer rt.Close()
+
+	// the template is not connected, q03 is excluded and q04 configured
+	assert.Equal([]string{"q00", "q01", "q02", "q04"}, []string{rt.Tenants[0].Name, rt.Tenants[1].Name, rt.Tenants[2].Name, rt.Tenants[3].Name})
+	assert.Equal(map[string]string{"q00": "q00host:30013", "q01": "q00host:30015", "q02": "q00host:30041", "q04": "q04host:30015"}, tenantConns(rt))
+	q01 := rt.FindTenant("q01")
+	assert.Equal("monitor", q01.User)
+	assert.Equal([]string{"erp"}, q01.Tags)
+
+	// q02 was dropped, q01 moved to the indexserver on another host
+	assert.Nil(drv.Replace(append([]hdbmock.Rule{databaseRule([]interface{}{"Q01", "Q00B", int64(30016)})}, metadataRules...)...))
+	assert.Nil(rt.Discover(context.Background(), rt.FindTenant("q00")))
+	assert.Equal(map[string]string{"q00": "q00host:30013", "q01": "q00b:30016", "q04": "q04host:30015"}, tenantConns(rt))
+
+	status := rt.Status()
+	var names []string
+	for _, ts := range status.Tenants {
+		names = append(names, ts.Name)
+	}
+	assert.Equal([]string{"q00", "q01", "q04"}, names)
+
+	// missing template
+	system := rt.FindTenant("q00")
+	system.Template = "unknown"
+	assert.NotNil(rt.Discover(context.Background(), system))
+}
+
+func Test_DiscoverSites(t *testing.T) {
+	assert := assert.New(t)
+
+	drv, err := hdbmock.Register(append([]hdbmock.Rule{
+		databaseRule([]interface{}{"Q01", "q00b", int64(30015)}),
+		{DSN: "q00a:30013|q00b:30015", SQL: `m_system_replication`, Columns: []string{"ROLE"}, Rows: [][]interface{}{{"primary"}}},
+		{SQL: `m_system_replication`, Columns: []string{"ROLE"}, Rows: [][]interface{}{{"secondary"}}},
+	}, metadataRules...)...)
+	assert.Nil(err)
+
+	config := &cmd.Config{
+		Tenants: []cmd.TenantInfo{
+			{Name: "q00", ConnStr: "q00a:30013", Hosts: []string{"q00b:30013", "q00c:30013"}, User: "system", SystemDB: true},
+			{Name: "h00", ConnStr: "h00host:30013", User: "system", SystemDB: true},
+		},
+		Timeout: 2,
+	}
+	config.Secret, err = config.AddSecret("q00,h00", []byte("secret"))
+	assert.Nil(err)
+
+	rt := cmd.NewRuntime(config)
+	rt.SQLDriver = drv.Name()
+	assert.Nil(rt.Connect())
+	defer rt.Close()
+
+	// the tenant of q00 follows the system replication sites of q00, q01 of
+	// h00 collides with it
+	q01 := rt.FindTenant("q01")
+	assert.Equal("q00b:30015", q01.ConnStr)
+	assert.Equal([]string{"q00a:30015", "q00c:30015"}, q01.Hosts)
+	err = rt.Discover(context.Background(), rt.FindTenant("h00"))
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "q01 (systemdb:q00)")
+	assert.Equal("q00b:30015", rt.FindTenant("q01").ConnStr)
+}
+
+func Test_CollectSystemDB(t *testing.T) {
+	assert := assert.New(t)
+
+	overview := func(dsn, db string) hdbmock.Rule {
+		return hdbmock.Rule{DSN: dsn, SQL: `m_system_overview`, Columns: []string{"SID", "INSNR", "DATABASE_NAME", "VERSION"}, Rows: [][]interface{}{{"H00", "00", db, "2.00.059.00"}}}
+	}
+	drv, err := hdbmock.Register(append([]hdbmock.Rule{
+		databaseRule([]interface{}{"Q01", "q00host", int64(30015)}, []interface{}{"Q02", "q00host", int64(30041)}),
+		overview("30013", "SYSTEMDB"),
+		overview("30015", "Q01"),
+		overview("30041", "Q02"),
+		{DSN: "30013", SQL: `m_service_memory`, Columns: []string{"DATABASE_NAME", "USED"}, Rows: [][]interface{}{{"SYSTEMDB", int64(10)}, {"Q01", int64(20)}, {"Q02", int64(30)}, {"Q09", int64(40)}}},
+	}, metadataRules...)...)
+	assert.Nil(err)
+
+	config := &cmd.Config{
+		Tenants: []cmd.TenantInfo{
+			{Name: "q00", ConnStr: "q00host:30013", User: "system", SystemDB: true, Template: "tpl"},
+			{Name: "tpl", User: "monitor", Tags: []string{"erp"}},
+		},
+		Queries: []cmd.QueryInfo{{
+			SQL:     "select database_name, sum(used_memory_size) used from sys_databases.m_service_memory group by database_name",
+			Scope:   "systemdb",
+			Metrics: []cmd.QueryMetricInfo{{Name: "hana_used_memory", MetricType: "gauge", ValueColumn: "used"}},
+		}},
+		Timeout: 2,
+	}
+	config.Secret, err = config.AddSecret("q00,tpl", []byte("secret"))
+	assert.Nil(err)
+
+	rt := cmd.NewRuntime(config)
+	rt.SQLDriver = drv.Name()
+	assert.Nil(rt.Connect())
+	defer rt.Close()
+
+	// tenant and database labels of every record, Q09 is not monitored
+	assigned := func(data []cmd.MetricData) []string {
+		var res []string
+		for _, md := range data {
+			for _, record := range md.Stats {
+				labels := make(map[string]string)
+				for i, label := range record.Labels {
+					labels[label] = record.LabelValues[i]
+				}
+				res = append(res, labels["tenant"]+" "+labels["sid"]+" "+labels["database_name"]+" "+strconv.FormatFloat(record.Value, 'f', -1, 64))
+			}
+		}
+		return res
+	}
+	assert.Equal([]string{"q00 H00 SYSTEMDB 10", "q01 H00 Q01 20", "q02 H00 Q02 30"}, assigned(rt.CollectQueryMetrics(context.Background())))
+
+	// the select runs once on the system database
+	var cnt int
+	for _, sel := range drv.Queries() {
+		if strings.Contains(sel, "m_service_memory") {
+			cnt++
+		}
+	}
+	assert.Equal(1, cnt)
+
+	// the tag filter applies to the tenants of the rows
+	rt.Config.Queries[0].TagFilter = []string{"erp"}
+	assert.Equal([]string{"q01 H00 Q01 20", "q02 H00 Q02 30"}, assigned(rt.CollectQueryMetrics(context.Background())))
+
+	// missing database column
+	rt.Config.Queries[0].DatabaseColumn = "db"
+	assert.Nil(rt.CollectQueryMetrics(context.Background()))
+}
@@ -0,0 +1,289 @@
+package cmd_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/ulranh/hana_sql_exporter/cmd"
+	"github.com/ulranh/hana_sql_exporter/internal/hdbmock"
+)
+
+// selects of prepare and retrieveMetadata
+var metadataRules = []hdbmock.Rule{
+	{DSN: "q03host", SQL: hdbmock.Ping, Err: errors.New("connection refused")},
+	{SQL: `^select usage from sys\.m_database$`, Columns: []string{"USAGE"}, Rows: [][]interface{}{{"TEST"}}},
+	{SQL: `granted_privileges`, Columns: []string{"SCHEMA_NAME"}, Rows: [][]interface{}{{"SAPABAP1"}}},
+	{SQL: `from sys\.tables`, Columns: []string{"SCHEMA_NAME"}, Rows: [][]interface{}{{"SAPABAP1"}}},
+	{DSN: "q02host", SQL: `m_system_overview`, Columns: []string{"SID", "INSNR", "DATABASE_NAME", "VERSION"}, Rows: [][]interface{}{{"Q02", "02", "Q02", "2.00.048.00"}}},
+	{SQL: `m_system_overview`, Columns: []string{"SID", "INSNR", "DATABASE_NAME", "VERSION"}, Rows: [][]interface{}{{"Q01", "00", "Q01", "2.00.059.00"}}},
+}
+
+// e2eConfig - tenants q01 and q02 with passwords, q03 can't be pinged
+func e2eConfig(t *testing.T) *cmd.Config {
+	config := &cmd.Config{
+		Tenants: []cmd.TenantInfo{
+			{Name: "q01", ConnStr: "q01host:30015", User: "monitor"},
+			{Name: "q02", ConnStr: "q02host:30015", User: "monitor"},
+			{Name: "q03", ConnStr: "q03host:30015", User: "monitor"},
+		},
+		Timeout: 2,
+		Ip:      "127.0.0.1",
+	}
+	var err error
+	config.Secret, err = config.AddSecret("q01,q02,q03", []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+// startExporter - serve the config with the driver on a random port until
+// the test ends
+func startExporter(t *testing.T, config *cmd.Config, drv *hdbmock.Driver) string {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Port = strconv.Itoa(lis.Addr().(*net.TCPAddr).Port)
+	lis.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	rt := cmd.NewRuntime(config)
+	rt.SQLDriver = drv.Name()
+	go func() { done <- rt.Serve(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	url := "http://127.0.0.1:" + config.Port
+	for i := 0; i < 100; i++ {
+		resp, err := http.Get(url + "/health/live")
+		if err == nil {
+			resp.Body.Close()
+			return url
+		}
+		select {
+		case err := <-done:
+			t.Fatalf("exporter stopped: %v", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	t.Fatal("exporter did not start")
+	return ""
+}
+
+// httpGet - status code and body of the url
+func httpGet(t *testing.T, url string) (int, string) {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+// sample - value of the first sample of the metric with all labels
+func sample(exposition, name string, labels map[string]string) (float64, bool) {
+	scanner := bufio.NewScanner(strings.NewReader(exposition))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, name+"{") {
+			continue
+		}
+		match := true
+		for label, value := range labels {
+			if !strings.Contains(line, label+`="`+value+`"`) {
+				match = false
+			}
+		}
+		if !match {
+			continue
+		}
+		value, err := strconv.ParseFloat(line[strings.LastIndex(line, " ")+1:], 64)
+		return value, err == nil
+	}
+	return 0, false
+}
+
+func Test_E2EMetrics(t *testing.T) {
+	assert := assert.New(t)
+
+	backup := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	drv, err := hdbmock.Register(append([]hdbmock.Rule{
+		{DSN: "q02host", SQL: `from sys\.m_connections`, Columns: []string{"CONNECTIONS"}, Types: []string{"NVARCHAR"}, Rows: [][]interface{}{{"7"}}},
+		{SQL: `from sys\.m_connections`, Columns: []string{"CONNECTIONS"}, Types: []string{"BIGINT"}, Rows: [][]interface{}{{int64(12)}}},
+		{SQL: `from sapabap1\.m_tables`, Columns: []string{"TABLE_NAME", "SIZE"}, Types: []string{"NVARCHAR", "DECIMAL"}, Rows: [][]interface{}{
+			{"BALDAT", big.NewRat(3, 2)},
+			{"CDPOS", []byte("2048")},
+			{"EMPTY", nil},
+		}},
+		{SQL: `from sys\.m_backup_catalog`, Columns: []string{"LAST_BACKUP"}, Types: []string{"TIMESTAMP"}, Rows: [][]interface{}{{backup}}},
+		{SQL: `from sys\.m_broken`, Err: errors.New("SQL error 259: invalid table name")},
+		{SQL: `from sys\.m_host_resource_utilization`, Columns: []string{"HOST", "CPU", "USED_MEMORY"}, Types: []string{"VARCHAR", "DOUBLE", "BIGINT"}, Rows: [][]interface{}{
+			{"hana01", 12.5, int64(1 << 30)},
+		}},
+		{SQL: `select value from sys\.m_inifile_contents`, Columns: []string{"VALUE", "SECTION"}, Rows: [][]interface{}{{"on", "persistence"}}},
+	}, metadataRules...)...)
+	assert.Nil(err)
+
+	config := e2eConfig(t)
+	config.Metrics = []cmd.MetricInfo{
+		{Name: "hana_connections", Help: "connections", MetricType: "gauge", SQL: "select count(*) connections from <SCHEMA>.m_connections"},
+		{Name: "hana_table_size", Help: "table size", MetricType: "gauge", Unit: "bytes", SQL: "select table_name, size from <SCHEMA>.m_tables", SchemaFilter: []string{"sapabap1"}, ValueColumn: "size", Labels: []string{"table_name"}},
+		{Name: "hana_last_backup", Help: "last backup", MetricType: "gauge", SQL: "select max(sys_end_time) last_backup from <SCHEMA>.m_backup_catalog", TagFilter: []string{}},
+		{Name: "hana_broken", Help: "broken", MetricType: "gauge", SQL: "select count(*) from <SCHEMA>.m_broken"},
+		{Name: "hana_log_mode", Help: "log mode", MetricType: "stateset", States: []string{"on", "off"}, SQL: "select value from sys.m_inifile_contents where key = 'log_mode'", SchemaFilter: []string{"sys"}},
+	}
+	config.Queries = []cmd.QueryInfo{
+		{SQL: "select host, cpu, used_memory from <SCHEMA>.m_host_resource_utilization", Metrics: []cmd.QueryMetricInfo{
+			{Name: "hana_host_cpu", Help: "cpu", MetricType: "gauge", ValueColumn: "cpu", Labels: []string{"host"}},
+			{Name: "hana_host_used_memory", Help: "memory", MetricType: "gauge", Unit: "bytes", ValueColumn: "used_memory", Labels: []string{"host"}},
+		}},
+	}
+	url := startExporter(t, config, drv)
+
+	code, body := httpGet(t, url+"/metrics")
+	assert.Equal(http.StatusOK, code)
+
+	// int64, string
+	v, ok := sample(body, "hana_connections", map[string]string{"tenant": "q01", "usage": "test", "schema": "sys", "sid": "Q01", "insnr": "00"})
+	assert.True(ok)
+	assert.Equal(12.0, v)
+	v, ok = sample(body, "hana_connections", map[string]string{"tenant": "q02", "sid": "Q02"})
+	assert.True(ok)
+	assert.Equal(7.0, v)
+
+	// *big.Rat, []byte, nil
+	v, ok = sample(body, "hana_table_size_bytes", map[string]string{"tenant": "q01", "schema": "sapabap1", "table_name": "baldat"})
+	assert.True(ok)
+	assert.Equal(1.5, v)
+	v, ok = sample(body, "hana_table_size_bytes", map[string]string{"table_name": "cdpos"})
+	assert.True(ok)
+	assert.Equal(2048.0, v)
+	v, ok = sample(body, "hana_table_size_bytes", map[string]string{"table_name": "empty"})
+	assert.True(ok)
+	assert.Equal(0.0, v)
+
+	// time.Time
+	v, ok = sample(body, "hana_last_backup", map[string]string{"tenant": "q01"})
+	assert.True(ok)
+	assert.Equal(float64(backup.Unix()), v)
+
+	// stateset
+	v, ok = sample(body, "hana_log_mode", map[string]string{"tenant": "q01", "hana_log_mode": "on"})
+	assert.True(ok)
+	assert.Equal(1.0, v)
+	v, ok = sample(body, "hana_log_mode", map[string]string{"tenant": "q01", "hana_log_mode": "off"})
+	assert.True(ok)
+	assert.Equal(0.0, v)
+
+	// query with two metrics, float64 and int64
+	v, ok = sample(body, "hana_host_cpu", map[string]string{"tenant": "q02", "host": "hana01"})
+	assert.True(ok)
+	assert.Equal(12.5, v)
+	v, ok = sample(body, "hana_host_used_memory_bytes", map[string]string{"tenant": "q01", "host": "hana01"})
+	assert.True(ok)
+	assert.Equal(float64(1<<30), v)
+
+	// failing select and not connected tenant
+	assert.False(strings.Contains(body, "hana_broken"))
+	assert.False(strings.Contains(body, `tenant="q03"`))
+
+	code, body = httpGet(t, url+"/api/v1/status")
+	assert.Equal(http.StatusOK, code)
+	var status cmd.Status
+	assert.Nil(json.Unmarshal([]byte(body), &status))
+	assert.Equal(3, len(status.Tenants))
+	for _, ts := range status.Tenants {
+		assert.Equal(ts.Name != "q03", ts.Connected, ts.Name)
+	}
+	for _, ms := range status.Metrics {
+		if ms.Name != "hana_broken" {
+			continue
+		}
+		assert.Equal(2, len(ms.Tenants))
+		for _, run := range ms.Tenants {
+			assert.True(strings.Contains(run.LastError, "invalid table name"))
+		}
+	}
+}
+
+func Test_E2ETimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	drv, err := hdbmock.Register(append([]hdbmock.Rule{
+		{SQL: `from sys\.m_connections`, Columns: []string{"CONNECTIONS"}, Rows: [][]interface{}{{int64(12)}}},
+		{SQL: `from sys\.m_slow`, Columns: []string{"CNT"}, Rows: [][]interface{}{{int64(1)}}, Delay: 5 * time.Second},
+	}, metadataRules...)...)
+	assert.Nil(err)
+
+	config := e2eConfig(t)
+	config.Timeout = 1
+	config.ReadyMaxScrapeAge = 60
+	config.Metrics = []cmd.MetricInfo{
+		{Name: "hana_connections", Help: "connections", MetricType: "gauge", SQL: "select count(*) connections from <SCHEMA>.m_connections"},
+		{Name: "hana_slow", Help: "slow", MetricType: "gauge", SQL: "select count(*) cnt from <SCHEMA>.m_slow"},
+	}
+	url := startExporter(t, config, drv)
+
+	// the whole scrape is dropped, if it does not finish within the timeout
+	start := time.Now()
+	code, body := httpGet(t, url+"/metrics")
+	assert.Equal(http.StatusOK, code)
+	assert.True(time.Since(start) < 3*time.Second)
+	assert.False(strings.Contains(body, "hana_connections"))
+	assert.False(strings.Contains(body, "hana_slow"))
+
+	code, body = httpGet(t, url+"/health/ready")
+	assert.Equal(http.StatusOK, code, body)
+	assert.True(strings.Contains(body, "last scrape failed: scrape timeout"))
+}
+
+func Test_E2EQueryExport(t *testing.T) {
+	assert := assert.New(t)
+
+	drv, err := hdbmock.Register(append([]hdbmock.Rule{
+		{SQL: `from sys\.m_tables`, Columns: []string{"TABLE_NAME", "RECORD_COUNT", "LAST_UPDATE"}, Types: []string{"NVARCHAR", "BIGINT", "TIMESTAMP"}, Rows: [][]interface{}{
+			{"BALDAT", int64(1200), time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)},
+		}},
+	}, metadataRules...)...)
+	assert.Nil(err)
+
+	config := e2eConfig(t)
+	config.DisableMetricsHandler = true
+	config.Queries = []cmd.QueryInfo{
+		{Name: "largest_tables", Export: true, SQL: "select table_name, record_count, last_update from <SCHEMA>.m_tables"},
+	}
+	url := startExporter(t, config, drv)
+
+	code, body := httpGet(t, url+"/api/v1/query/largest_tables?tenant=q01")
+	assert.Equal(http.StatusOK, code)
+	var table cmd.Table
+	assert.Nil(json.Unmarshal([]byte(body), &table))
+	assert.Equal([]cmd.Column{{Name: "TABLE_NAME", Type: "NVARCHAR"}, {Name: "RECORD_COUNT", Type: "BIGINT"}, {Name: "LAST_UPDATE", Type: "TIMESTAMP"}}, table.Columns)
+	assert.Equal([]interface{}{"BALDAT", 1200.0, "2024-05-01T10:00:00Z"}, table.Rows[0])
+
+	code, body = httpGet(t, url+"/api/v1/query/largest_tables?tenant=q01&format=csv")
+	assert.Equal(http.StatusOK, code)
+	assert.Equal("TABLE_NAME,RECORD_COUNT,LAST_UPDATE\nBALDAT,1200,2024-05-01T10:00:00Z\n", body)
+
+	code, _ = httpGet(t, url+"/api/v1/query/largest_tables?tenant=q03")
+	assert.Equal(http.StatusNotFound, code)
+
+	_, body = httpGet(t, url+"/metrics")
+	assert.False(strings.Contains(body, "# HELP"))
+}
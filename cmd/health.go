@@ -0,0 +1,161 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Readiness - result of the readiness checks of /health/ready
+type Readiness struct {
+	Ready  bool          `json:"ready"`
+	Checks []HealthCheck `json:"checks"`
+}
+
+// HealthCheck - result of one readiness check
+type HealthCheck struct {
+	Name    string `json:"name"`
+	Ok      bool   `json:"ok"`
+	Message string `json:"message"`
+}
+
+// checkTenants - ping all connected tenants in the background, so the tenant
+// health follows the database state of the latest scrape. A ping that is
+// still running is not started again.
+func (rt *Runtime) checkTenants() {
+	rt.mu.Lock()
+	if rt.pinging || rt.closed {
+		rt.mu.Unlock()
+		return
+	}
+	rt.pinging = true
+	rt.mu.Unlock()
+
+	go func() {
+		rt.pingTenants()
+		rt.mu.Lock()
+		rt.pinging = false
+		rt.mu.Unlock()
+	}()
+}
+
+// pingTenants - ping the tenants in parallel, each with the scrape timeout
+func (rt *Runtime) pingTenants() {
+	var wg sync.WaitGroup
+	for _, tenant := range rt.tenantList() {
+		if tenant.sites != nil {
+			// replication tenants are checked by CheckReplication
+			continue
+		}
+		wg.Add(1)
+		go func(tenant *Tenant) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), time.Duration(rt.Config.Timeout)*time.Second)
+			defer cancel()
+			err := tenant.DB().PingContext(ctx)
+			if err != nil {
+				TenantLog(log.Fields{"tenant": tenant.Name}).WithError(err).Warn("tenant ping failed")
+			}
+			rt.status.recordPing(tenant.Name, err)
+		}(tenant)
+	}
+	wg.Wait()
+}
+
+// LiveHandler - the process is up and serves http requests
+func LiveHandler(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, http.StatusOK, map[string]string{"status": "live"})
+}
+
+// ReadyHandler - 200, if all readiness checks are ok, otherwise 503
+func (rt *Runtime) ReadyHandler(w http.ResponseWriter, r *http.Request) {
+	readiness := rt.Readiness()
+	code := http.StatusOK
+	if !readiness.Ready {
+		code = http.StatusServiceUnavailable
+	}
+	writeHealth(w, code, readiness)
+}
+
+// Readiness - check the connected tenants and the age of the last successful
+// scrape. Before the first successful scrape the start time of the exporter
+// is used, so a freshly started exporter has ReadyMaxScrapeAge seconds to
+// get scraped.
+func (rt *Runtime) Readiness() Readiness {
+	config := rt.Config
+	s := rt.status
+	if s == nil {
+		s = newStatusStore()
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var checks []HealthCheck
+
+	connected := 0
+	for _, ts := range s.tenants {
+		if ts.Connected {
+			connected++
+		}
+	}
+	minTenants := uint(defaultReadyMinTenants)
+	if config.ReadyMinTenants != nil {
+		minTenants = *config.ReadyMinTenants
+	}
+	checks = append(checks, HealthCheck{
+		Name:    "tenants",
+		Ok:      uint(connected) >= minTenants,
+		Message: fmt.Sprintf("%d of %d tenants connected, %d required", connected, len(s.tenants), minTenants),
+	})
+
+	for _, name := range config.ReadyTenants {
+		check := HealthCheck{Name: "tenant " + low(name), Message: "unknown tenant"}
+		if ts, ok := s.tenants[low(name)]; ok {
+			check.Ok = ts.Connected
+			check.Message = "connected"
+			if !ts.Connected {
+				check.Message = ts.Error
+			}
+		}
+		checks = append(checks, check)
+	}
+
+	if config.ReadyMaxScrapeAge > 0 {
+		maxAge := time.Duration(config.ReadyMaxScrapeAge) * time.Second
+		last := s.lastScrapeOk
+		check := HealthCheck{Name: "scrape"}
+		if last.IsZero() {
+			last = s.started
+			check.Message = "no successful scrape yet"
+		} else {
+			check.Message = fmt.Sprintf("last successful scrape %s ago", time.Since(last).Round(time.Second))
+		}
+		check.Ok = time.Since(last) <= maxAge
+		if s.lastScrapeErr != nil {
+			check.Message += ", last scrape failed: " + s.lastScrapeErr.Error()
+		}
+		checks = append(checks, check)
+	}
+
+	readiness := Readiness{Ready: true, Checks: checks}
+	for _, check := range checks {
+		if !check.Ok {
+			readiness.Ready = false
+		}
+	}
+	return readiness
+}
+
+// write health response as json
+func writeHealth(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.WithError(err).Error("writeHealth(Encode)")
+	}
+}
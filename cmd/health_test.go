@@ -0,0 +1,112 @@
+package cmd_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ulranh/hana_sql_exporter/cmd"
+	"github.com/ulranh/hana_sql_exporter/internal/hdbmock"
+)
+
+func Test_HealthHandlers(t *testing.T) {
+	assert := assert.New(t)
+
+	rec := httptest.NewRecorder()
+	cmd.LiveHandler(rec, httptest.NewRequest("GET", "/health/live", nil))
+	assert.Equal(200, rec.Code)
+
+	// no tenant connected
+	config := getTestConfig(1, 2)
+	config.ReadyTenants = []string{"Q01"}
+	config.ReadyMaxScrapeAge = 60
+
+	rec = httptest.NewRecorder()
+	cmd.NewRuntime(config).ReadyHandler(rec, httptest.NewRequest("GET", "/health/ready", nil))
+	assert.Equal(503, rec.Code)
+	assert.Equal("application/json", rec.Header().Get("Content-Type"))
+
+	var readiness cmd.Readiness
+	assert.Nil(json.Unmarshal(rec.Body.Bytes(), &readiness))
+	assert.False(readiness.Ready)
+	assert.Equal([]cmd.HealthCheck{
+		{Name: "tenants", Ok: false, Message: "0 of 0 tenants connected, 1 required"},
+		{Name: "tenant q01", Ok: false, Message: "unknown tenant"},
+		{Name: "scrape", Ok: true, Message: "no successful scrape yet"},
+	}, readiness.Checks)
+}
+
+func Test_ReadyMinTenants(t *testing.T) {
+	assert := assert.New(t)
+
+	// 0 switches the tenant count check off
+	config := getTestConfig(1, 2)
+	assert.Nil(config.SetValue([]string{"ReadyMinTenants"}, "0"))
+	config.ApplyDefaults()
+	assert.Equal(uint(0), *config.ReadyMinTenants)
+
+	rec := httptest.NewRecorder()
+	cmd.NewRuntime(config).ReadyHandler(rec, httptest.NewRequest("GET", "/health/ready", nil))
+	assert.Equal(200, rec.Code)
+
+	// unset is 1
+	config = getTestConfig(1, 2)
+	config.ApplyDefaults()
+	assert.Equal(uint(1), *config.ReadyMinTenants)
+}
+
+func Test_ReadyTenantHealth(t *testing.T) {
+	assert := assert.New(t)
+
+	drv, err := hdbmock.Register(metadataRules...)
+	assert.Nil(err)
+
+	config := e2eConfig(t)
+	config.ReadyTenants = []string{"q02", "q03"}
+	rt := cmd.NewRuntime(config)
+	rt.SQLDriver = drv.Name()
+	assert.Nil(rt.Connect())
+	defer rt.Close()
+
+	tenantCheck := func(name string) cmd.HealthCheck {
+		for _, check := range rt.Readiness().Checks {
+			if check.Name == "tenant "+name {
+				return check
+			}
+		}
+		return cmd.HealthCheck{}
+	}
+	assert.True(tenantCheck("q02").Ok)
+	assert.False(tenantCheck("q03").Ok)
+
+	// q02 goes down after the start: the ping of the next scrape shows it
+	assert.Nil(drv.Replace(append([]hdbmock.Rule{
+		{DSN: "q02host", SQL: hdbmock.Ping, Err: errors.New("connection refused")},
+	}, metadataRules[1:]...)...))
+	assert.Eventually(func() bool {
+		rt.Scrape()
+		return !tenantCheck("q02").Ok
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Contains(tenantCheck("q02").Message, "connection refused")
+	assert.Equal(2, len(rt.Tenants))
+
+	// q03 failed at the start and is connected by the retry
+	assert.Nil(drv.Replace(metadataRules[1:]...))
+	connected := rt.RetryTenants(context.Background())
+	assert.Equal(1, len(connected))
+	assert.Equal("q03", connected[0].Name)
+	assert.Equal(3, len(rt.Tenants))
+	assert.True(tenantCheck("q03").Ok)
+	assert.Nil(rt.RetryTenants(context.Background()))
+
+	// q02 is back
+	assert.Eventually(func() bool {
+		rt.Scrape()
+		return tenantCheck("q02").Ok
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.True(rt.Readiness().Ready)
+}
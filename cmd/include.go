@@ -0,0 +1,292 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pelletier/go-toml"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// configSource - config content of one file
+type configSource struct {
+	file      string
+	config    Config
+	positions map[string][]toml.Position
+}
+
+// definition - first occurrence of a tenant or metric name
+type definition struct {
+	src *configSource
+	key string
+	pos int
+}
+
+// ApplyIncludes - merge the tenants, metrics and queries of all included
+// config files into the config. Later files take precedence over earlier
+// files for single values, the main config file takes precedence over all
+// included files. Tenant names must be unique, metric names must not be
+// defined in more than one file.
+func (config *Config) ApplyIncludes(mainFile string) error {
+	var includes []string
+	for _, include := range config.Include {
+		if !isPackReference(include) {
+			includes = append(includes, include)
+		}
+	}
+
+	files, err := resolveIncludes(mainFile, includes)
+	if err != nil {
+		return errors.Wrap(err, "ApplyIncludes(resolveIncludes)")
+	}
+
+	var sources []*configSource
+	for _, file := range files {
+		src, err := readConfigSource(file)
+		if err != nil {
+			return errors.Wrap(err, "ApplyIncludes(readConfigSource)")
+		}
+		if len(src.config.Secret) > 0 {
+			return errors.Errorf("%s: Secret is only allowed in the main config file", file)
+		}
+		for _, include := range src.config.Include {
+			if !isPackReference(include) {
+				return errors.Errorf("%s: nested file include %q is not supported", file, include)
+			}
+		}
+		sources = append(sources, src)
+	}
+
+	main := &configSource{
+		file:      mainFile,
+		config:    *config,
+		positions: tomlPositions(mainFile),
+	}
+
+	return config.mergeSources(main, sources)
+}
+
+// merge main config and included configs, main entries come first
+func (config *Config) mergeSources(main *configSource, sources []*configSource) error {
+	merged := main.config
+	merged.Tenants = nil
+	merged.Metrics = nil
+	merged.Queries = nil
+	merged.Include = nil
+	merged.EnableMetrics = nil
+	merged.DisableMetrics = nil
+	merged.RemoteWrite = nil
+	merged.OTLP = nil
+	merged.FileSD = nil
+	merged.HTTPSD = nil
+
+	tenants := make(map[string]definition)
+	metrics := make(map[string]definition)
+
+	for _, src := range append([]*configSource{main}, sources...) {
+		for i, tenant := range src.config.Tenants {
+			if first, ok := tenants[low(tenant.Name)]; ok {
+				return errors.Errorf("duplicate tenant %q in %s, first defined in %s", tenant.Name, src.location("tenants", i), first.src.location(first.key, first.pos))
+			}
+			tenants[low(tenant.Name)] = definition{src, "tenants", i}
+			merged.Tenants = append(merged.Tenants, tenant)
+		}
+
+		for i, metric := range src.config.Metrics {
+			if first, ok := metrics[low(metric.Name)]; ok && first.src != src {
+				return errors.Errorf("duplicate metric %q in %s, first defined in %s", metric.Name, src.location("metrics", i), first.src.location(first.key, first.pos))
+			}
+			if _, ok := metrics[low(metric.Name)]; !ok {
+				metrics[low(metric.Name)] = definition{src, "metrics", i}
+			}
+			merged.Metrics = append(merged.Metrics, metric)
+		}
+
+		for i, query := range src.config.Queries {
+			for _, metric := range query.Metrics {
+				if first, ok := metrics[low(metric.Name)]; ok && first.src != src {
+					return errors.Errorf("duplicate metric %q in %s, first defined in %s", metric.Name, src.location("queries", i), first.src.location(first.key, first.pos))
+				}
+				if _, ok := metrics[low(metric.Name)]; !ok {
+					metrics[low(metric.Name)] = definition{src, "queries", i}
+				}
+			}
+			merged.Queries = append(merged.Queries, query)
+		}
+
+		merged.Include = append(merged.Include, src.config.Include...)
+		merged.RemoteWrite = append(merged.RemoteWrite, src.config.RemoteWrite...)
+		merged.OTLP = append(merged.OTLP, src.config.OTLP...)
+		merged.FileSD = append(merged.FileSD, src.config.FileSD...)
+		merged.HTTPSD = append(merged.HTTPSD, src.config.HTTPSD...)
+		merged.EnableMetrics = append(merged.EnableMetrics, src.config.EnableMetrics...)
+		merged.DisableMetrics = append(merged.DisableMetrics, src.config.DisableMetrics...)
+	}
+
+	// single values: main file > later included files > earlier included files
+	for i := len(sources) - 1; i >= 0; i-- {
+		c := sources[i].config
+		if merged.Timeout == 0 {
+			merged.Timeout = c.Timeout
+		}
+		if merged.Ip == "" {
+			merged.Ip = c.Ip
+		}
+		if merged.Port == "" {
+			merged.Port = c.Port
+		}
+		if merged.LogLevel == "" {
+			merged.LogLevel = c.LogLevel
+		}
+		if merged.LogFile == "" {
+			merged.LogFile = c.LogFile
+		}
+		if merged.LogFormat == "" {
+			merged.LogFormat = c.LogFormat
+		}
+		if merged.LogMaxSize == nil {
+			merged.LogMaxSize = c.LogMaxSize
+		}
+		if merged.LogRotateInterval == 0 {
+			merged.LogRotateInterval = c.LogRotateInterval
+		}
+		if merged.LogMaxBackups == nil {
+			merged.LogMaxBackups = c.LogMaxBackups
+		}
+		if merged.LogMaxAge == 0 {
+			merged.LogMaxAge = c.LogMaxAge
+		}
+		if merged.ReadyMinTenants == nil {
+			merged.ReadyMinTenants = c.ReadyMinTenants
+		}
+		if merged.ReadyTenants == nil {
+			merged.ReadyTenants = c.ReadyTenants
+		}
+		if merged.ReadyMaxScrapeAge == 0 {
+			merged.ReadyMaxScrapeAge = c.ReadyMaxScrapeAge
+		}
+		if merged.RemoteWriteInterval == 0 {
+			merged.RemoteWriteInterval = c.RemoteWriteInterval
+		}
+		if merged.OTLPInterval == 0 {
+			merged.OTLPInterval = c.OTLPInterval
+		}
+		merged.DisableMetricsHandler = merged.DisableMetricsHandler || c.DisableMetricsHandler
+		if merged.StateFile == "" {
+			merged.StateFile = c.StateFile
+		}
+		if merged.StateDir == "" {
+			merged.StateDir = c.StateDir
+		}
+	}
+
+	*config = merged
+	return nil
+}
+
+// location - file and position of the n-th entry of a config slice
+func (src *configSource) location(key string, n int) string {
+	entry := fmt.Sprintf("%s[%d]", strings.ToUpper(key[:1])+key[1:], n)
+	if positions, ok := src.positions[key]; ok && n < len(positions) && !positions[n].Invalid() {
+		return fmt.Sprintf("%s:%d (%s)", src.file, positions[n].Line, entry)
+	}
+	return fmt.Sprintf("%s (%s)", src.file, entry)
+}
+
+// resolve include patterns relative to the directory of the main config file
+func resolveIncludes(mainFile string, includes []string) ([]string, error) {
+	var files []string
+	seen := make(map[string]bool)
+	if mainFile != "" {
+		if abs, err := filepath.Abs(mainFile); err == nil {
+			seen[abs] = true
+		}
+	}
+
+	for _, include := range includes {
+		pattern := include
+		if !filepath.IsAbs(pattern) && mainFile != "" {
+			pattern = filepath.Join(filepath.Dir(mainFile), pattern)
+		}
+
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, errors.Wrapf(err, "include %q", include)
+		}
+		if len(matches) == 0 {
+			if !strings.ContainsAny(include, "*?[") {
+				return nil, errors.Errorf("include %q: neither a metric pack nor an existing file", include)
+			}
+			log.WithField("include", include).Warn("include pattern does not match any file")
+			continue
+		}
+		sort.Strings(matches)
+
+		for _, match := range matches {
+			if info, err := os.Stat(match); err != nil || info.IsDir() {
+				continue
+			}
+			abs, err := filepath.Abs(match)
+			if err != nil {
+				return nil, errors.Wrapf(err, "include %q", include)
+			}
+			if seen[abs] {
+				continue
+			}
+			seen[abs] = true
+			files = append(files, match)
+		}
+	}
+	return files, nil
+}
+
+// read and unmarshal one included config file
+func readConfigSource(file string) (*configSource, error) {
+	v := viper.New()
+	v.SetConfigFile(file)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, errors.Wrapf(err, "%s", file)
+	}
+
+	src := configSource{
+		file:      file,
+		positions: tomlPositions(file),
+	}
+	if err := v.Unmarshal(&src.config); err != nil {
+		return nil, errors.Wrapf(err, "%s", file)
+	}
+	return &src, nil
+}
+
+// line positions of the tenants, metrics and queries tables of a toml file
+func tomlPositions(file string) map[string][]toml.Position {
+	positions := make(map[string][]toml.Position)
+	if !strings.EqualFold(filepath.Ext(file), ".toml") {
+		return positions
+	}
+
+	tree, err := toml.LoadFile(file)
+	if err != nil {
+		return positions
+	}
+	for _, key := range tree.Keys() {
+		tables, ok := tree.Get(key).([]*toml.Tree)
+		if !ok {
+			continue
+		}
+		for _, table := range tables {
+			positions[low(key)] = append(positions[low(key)], table.Position())
+		}
+	}
+	return positions
+}
+
+// isPackReference - true, if include entry looks like "hana:core"
+func isPackReference(include string) bool {
+	return strings.Contains(include, ":") && !strings.ContainsAny(include, `/\*?[.`)
+}
@@ -0,0 +1,80 @@
+package cmd_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ulranh/hana_sql_exporter/cmd"
+)
+
+func writeTestFile(t *testing.T, file, content string) {
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_ApplyIncludes(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	mainFile := filepath.Join(dir, "main.toml")
+	writeTestFile(t, filepath.Join(dir, "conf.d", "a.toml"), `
+Timeout = 7
+Port = "1111"
+
+[[Tenants]]
+  Name = "q02"
+
+[[Metrics]]
+  Name = "m_a"
+  SQL = "select 1 from dummy"
+`)
+	writeTestFile(t, filepath.Join(dir, "conf.d", "b.toml"), `
+Port = "2222"
+
+[[Queries]]
+  SQL = "select 1 from dummy"
+
+  [[Queries.Metrics]]
+    Name = "m_b"
+`)
+
+	config := cmd.Config{
+		Include: []string{"hana:locks", "conf.d/*.toml"},
+		Tenants: []cmd.TenantInfo{{Name: "q01"}},
+		Port:    "9888",
+	}
+	assert.Nil(config.ApplyIncludes(mainFile))
+	assert.Equal(2, len(config.Tenants))
+	assert.Equal("q01", config.Tenants[0].Name)
+	assert.Equal("q02", config.Tenants[1].Name)
+	assert.Equal(1, len(config.Metrics))
+	assert.Equal(1, len(config.Queries))
+	assert.Equal(uint(7), config.Timeout)
+	assert.Equal("9888", config.Port)
+	assert.Equal([]string{"hana:locks", "conf.d/*.toml"}, config.Include)
+
+	// later included files win over earlier ones
+	config = cmd.Config{Include: []string{"conf.d/*.toml"}}
+	assert.Nil(config.ApplyIncludes(mainFile))
+	assert.Equal("2222", config.Port)
+
+	// duplicate tenant across files
+	writeTestFile(t, filepath.Join(dir, "conf.d", "c.toml"), `
+[[Tenants]]
+  Name = "Q02"
+`)
+	config = cmd.Config{Include: []string{"conf.d/*.toml"}}
+	err := config.ApplyIncludes(mainFile)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), filepath.Join(dir, "conf.d", "c.toml")+":2")
+
+	// missing file
+	config = cmd.Config{Include: []string{"missing.toml"}}
+	assert.NotNil(config.ApplyIncludes(mainFile))
+}
@@ -0,0 +1,388 @@
+package cmd
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultLogFormat = "logfmt"
+	backupTimeFormat = "20060102-150405.000" // suffix of rotated log files
+)
+
+// levels - log levels of the exporter and of the tenants with their own LogLevel
+var levels = &logLevels{level: log.InfoLevel, tenants: make(map[string]log.Level), loggers: make(map[string]*log.Logger)}
+
+func init() {
+	log.SetFormatter(newLogFormatter(defaultLogFormat))
+}
+
+// SetLogging - log level, tenant log levels, format and output of the config.
+// The returned closer closes the log file, it is nil without LogFile.
+func SetLogging(config *Config) (io.Closer, error) {
+	SetLogLevel(config.LogLevel)
+	for _, tenant := range config.Tenants {
+		setTenantLogLevel(tenant.Name, tenant.LogLevel)
+	}
+	if err := SetLogFormat(config.LogFormat); err != nil {
+		return nil, errors.Wrap(err, "SetLogging(SetLogFormat)")
+	}
+	if config.LogFile == "" {
+		return nil, nil
+	}
+	f, err := openLogFile(config.LogFile, config.logRotation())
+	if err != nil {
+		return nil, errors.Wrap(err, "SetLogging(openLogFile)")
+	}
+	log.SetOutput(f)
+	levels.apply()
+	return f, nil
+}
+
+// logRotation - rotation limits of the log file, the defaults for unset
+// LogMaxSize and LogMaxBackups
+func (config *Config) logRotation() logRotation {
+	maxSize, maxBackups := uint(defaultLogMaxSize), uint(defaultLogMaxBackups)
+	if config.LogMaxSize != nil {
+		maxSize = *config.LogMaxSize
+	}
+	if config.LogMaxBackups != nil {
+		maxBackups = *config.LogMaxBackups
+	}
+	return logRotation{
+		maxSize:    int64(maxSize) * 1024 * 1024,
+		interval:   time.Duration(config.LogRotateInterval) * time.Second,
+		maxBackups: int(maxBackups),
+		maxAge:     time.Duration(config.LogMaxAge) * 24 * time.Hour,
+	}
+}
+
+// SetLogFormat - logfmt or json, logfmt if empty
+func SetLogFormat(format string) error {
+	if format == "" {
+		format = defaultLogFormat
+	}
+	if format != "logfmt" && format != "json" {
+		return errors.Errorf("SetLogFormat(unknown log format %s)", format)
+	}
+	log.SetFormatter(newLogFormatter(format))
+	levels.apply()
+	return nil
+}
+
+// newLogFormatter - formatter of the format that drops the entries below the
+// level of their tenant
+func newLogFormatter(format string) log.Formatter {
+	if format == "json" {
+		return levelFormatter{&log.JSONFormatter{TimestampFormat: time.RFC3339Nano}}
+	}
+	return levelFormatter{&log.TextFormatter{
+		DisableColors:    true,
+		FullTimestamp:    true,
+		TimestampFormat:  time.RFC3339,
+		QuoteEmptyFields: true,
+	}}
+}
+
+// parseLogLevel - logrus level of error, warn, info or debug
+func parseLogLevel(level string) (log.Level, bool) {
+	switch level {
+	case "error":
+		return log.ErrorLevel, true
+	case "warn":
+		return log.WarnLevel, true
+	case "info":
+		return log.InfoLevel, true
+	case "debug":
+		return log.DebugLevel, true
+	}
+	return log.InfoLevel, false
+}
+
+// SetLogLevel - minimum level of the log entries without own tenant level
+func SetLogLevel(level string) {
+	l, ok := parseLogLevel(level)
+	if !ok {
+		log.WithField("level", level).Warn("unknown log level, using info")
+	}
+	levels.mu.Lock()
+	levels.level = l
+	levels.mu.Unlock()
+	levels.apply()
+}
+
+// setTenantLogLevel - minimum level of the log entries of the tenant, the
+// level of the exporter if empty
+func setTenantLogLevel(name, level string) {
+	levels.mu.Lock()
+	if level == "" {
+		delete(levels.tenants, low(name))
+	} else if l, ok := parseLogLevel(level); ok {
+		levels.tenants[low(name)] = l
+	} else {
+		log.WithFields(log.Fields{"tenant": name, "level": level}).Warn("unknown tenant log level ignored")
+	}
+	levels.mu.Unlock()
+	levels.apply()
+}
+
+// logLevels - minimum log level of the exporter and of single tenants
+type logLevels struct {
+	mu      sync.RWMutex
+	level   log.Level
+	tenants map[string]log.Level
+	loggers map[string]*log.Logger // loggers of the tenants that log more than the exporter
+}
+
+// apply - set the level of the exporter and create a logger for every tenant
+// with a more verbose level, the formatter drops the entries of the tenants
+// with a less verbose level
+func (l *logLevels) apply() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	log.SetLevel(l.level)
+	std := log.StandardLogger()
+	l.loggers = make(map[string]*log.Logger)
+	for name, level := range l.tenants {
+		if level <= l.level {
+			continue
+		}
+		l.loggers[name] = &log.Logger{
+			Out:          std.Out,
+			Hooks:        std.Hooks,
+			Formatter:    std.Formatter,
+			ReportCaller: std.ReportCaller,
+			Level:        level,
+			ExitFunc:     std.ExitFunc,
+		}
+	}
+}
+
+// TenantLog - entry with the fields, the logger of the tenant field if the
+// tenant logs more than the exporter. Debug, info and warn entries of a tenant
+// use it, so only the tenants with their own level build them.
+func TenantLog(fields log.Fields) *log.Entry {
+	if name, ok := fields["tenant"].(string); ok {
+		levels.mu.RLock()
+		logger := levels.loggers[low(name)]
+		levels.mu.RUnlock()
+		if logger != nil {
+			return logger.WithFields(fields)
+		}
+	}
+	return log.WithFields(fields)
+}
+
+// enabled - the entry reaches the level of its tenant or of the exporter
+func (l *logLevels) enabled(entry *log.Entry) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	level := l.level
+	if name, ok := entry.Data["tenant"].(string); ok {
+		if tenantLevel, ok := l.tenants[low(name)]; ok {
+			level = tenantLevel
+		}
+	}
+	return entry.Level <= level
+}
+
+// levelFormatter - formatter that writes nothing for entries below the level
+// of their tenant
+type levelFormatter struct {
+	log.Formatter
+}
+
+// Format - formatted entry, empty if it is filtered
+func (f levelFormatter) Format(entry *log.Entry) ([]byte, error) {
+	if !levels.enabled(entry) {
+		return nil, nil
+	}
+	return f.Formatter.Format(entry)
+}
+
+// logFields - fields of the log entries of a query run for the tenant
+func (query QueryInfo) logFields(tenant *Tenant) log.Fields {
+	name := query.Name
+	if name == "" {
+		names := make([]string, len(query.Metrics))
+		for i, metric := range query.Metrics {
+			names[i] = metric.Name
+		}
+		name = strings.Join(names, ",")
+	}
+	return log.Fields{
+		"tenant":     tenant.Name,
+		"metric":     name,
+		"query_hash": queryHash(query.SQL),
+	}
+}
+
+// queryHash - short hash of the normalized select, identifies a select in the
+// log without its text
+func queryHash(sel string) string {
+	h := fnv.New32a()
+	h.Write([]byte(normalizeSQL(sel)))
+	return fmt.Sprintf("%08x", h.Sum32())
+}
+
+// logRotation - limits of the log file and its rotated copies, 0 is unlimited
+type logRotation struct {
+	maxSize    int64         // bytes of the log file
+	interval   time.Duration // time between two rotations
+	maxBackups int           // number of rotated files
+	maxAge     time.Duration // age of rotated files
+}
+
+// logFile - log file that is rotated by size and time, rotated files get the
+// rotation time as suffix
+type logFile struct {
+	mu       sync.Mutex
+	path     string
+	rotation logRotation
+	file     *os.File
+	size     int64
+	period   time.Time // start of the rotation interval of the file
+}
+
+// openLogFile - open the log file for appending
+func openLogFile(path string, rotation logRotation) (*logFile, error) {
+	f := &logFile{path: path, rotation: rotation}
+	if err := f.open(); err != nil {
+		return nil, errors.Wrap(err, "openLogFile(open)")
+	}
+	return f, nil
+}
+
+// open - open or create the file, an existing file keeps the rotation interval
+// of its last write
+func (f *logFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return errors.Wrap(err, "open(OpenFile)")
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return errors.Wrap(err, "open(Stat)")
+	}
+	f.file = file
+	f.size = info.Size()
+	f.period = f.periodOf(info.ModTime())
+	if f.size == 0 {
+		f.period = f.periodOf(time.Now())
+	}
+	return nil
+}
+
+// periodOf - start of the rotation interval of t
+func (f *logFile) periodOf(t time.Time) time.Time {
+	if f.rotation.interval <= 0 {
+		return time.Time{}
+	}
+	return t.Truncate(f.rotation.interval)
+}
+
+// Write - write p, the file is rotated before if it is too big or old
+func (f *logFile) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return 0, errors.New("Write(log file closed)")
+	}
+
+	now := time.Now()
+	tooBig := f.rotation.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.rotation.maxSize
+	tooOld := f.rotation.interval > 0 && f.size > 0 && !f.periodOf(now).Equal(f.period)
+	if tooBig || tooOld {
+		if err := f.rotate(now); err != nil {
+			// keep logging into the current file
+			fmt.Fprintf(os.Stderr, "log rotation failed: %v\n", err)
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate - rename the file, open a new one and remove the rotated files
+// beyond the retention
+func (f *logFile) rotate(now time.Time) error {
+	if err := f.file.Close(); err != nil {
+		return errors.Wrap(err, "rotate(Close)")
+	}
+	backup := f.path + "." + now.Format(backupTimeFormat)
+	if err := os.Rename(f.path, backup); err != nil {
+		if err := f.open(); err != nil {
+			f.file = nil
+			return errors.Wrap(err, "rotate(open)")
+		}
+		return errors.Wrap(err, "rotate(Rename)")
+	}
+	if err := f.open(); err != nil {
+		f.file = nil
+		return errors.Wrap(err, "rotate(open)")
+	}
+	f.period = f.periodOf(now)
+	return errors.Wrap(f.prune(now), "rotate(prune)")
+}
+
+// prune - remove the oldest rotated files beyond maxBackups and the files
+// older than maxAge
+func (f *logFile) prune(now time.Time) error {
+	if f.rotation.maxBackups <= 0 && f.rotation.maxAge <= 0 {
+		return nil
+	}
+	matches, err := filepath.Glob(f.path + ".*")
+	if err != nil {
+		return errors.Wrap(err, "prune(Glob)")
+	}
+	type backup struct {
+		path    string
+		rotated time.Time
+	}
+	var backups []backup
+	for _, path := range matches {
+		rotated, err := time.ParseInLocation(backupTimeFormat, strings.TrimPrefix(path, f.path+"."), time.Local)
+		if err != nil {
+			// no rotated log file
+			continue
+		}
+		backups = append(backups, backup{path, rotated})
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].rotated.After(backups[j].rotated) })
+
+	for i, b := range backups {
+		if (f.rotation.maxBackups > 0 && i >= f.rotation.maxBackups) || (f.rotation.maxAge > 0 && now.Sub(b.rotated) > f.rotation.maxAge) {
+			if err := os.Remove(b.path); err != nil {
+				return errors.Wrap(err, "prune(Remove)")
+			}
+		}
+	}
+	return nil
+}
+
+// Close - close the file
+func (f *logFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return errors.Wrap(err, "Close(Close)")
+}
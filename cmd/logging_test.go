@@ -0,0 +1,161 @@
+package cmd_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/ulranh/hana_sql_exporter/cmd"
+)
+
+// setLogging - logging of the config, reset to the defaults when the test ends
+func setLogging(t *testing.T, config *cmd.Config) io.Closer {
+	f, err := cmd.SetLogging(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		reset := &cmd.Config{LogLevel: "info"}
+		for _, tenant := range config.Tenants {
+			reset.Tenants = append(reset.Tenants, cmd.TenantInfo{Name: tenant.Name})
+		}
+		cmd.SetLogging(reset)
+		log.SetOutput(os.Stderr)
+		if f != nil {
+			f.Close()
+		}
+	})
+	return f
+}
+
+// logLimit - pointer to the rotation limit
+func logLimit(n uint) *uint {
+	return &n
+}
+
+// jsonEntries - json log entries of the file
+func jsonEntries(t *testing.T, file string) []map[string]interface{} {
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var entries []map[string]interface{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		entry := make(map[string]interface{})
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func Test_LogFormat(t *testing.T) {
+	assert := assert.New(t)
+
+	file := filepath.Join(t.TempDir(), "exporter.log")
+	setLogging(t, &cmd.Config{
+		LogFile:   file,
+		LogLevel:  "error",
+		LogFormat: "json",
+		Tenants:   []cmd.TenantInfo{{Name: "q01", LogLevel: "debug"}, {Name: "q02"}},
+	})
+
+	// tenants with their own level log below the level of the exporter, the
+	// level of the exporter stays unchanged
+	cmd.TenantLog(log.Fields{"tenant": "Q01"}).Debug("query running")
+	cmd.TenantLog(log.Fields{"tenant": "q02"}).Debug("query running")
+	log.WithField("tenant", "q01").Info("tenant connected")
+	log.Info("scrape finished")
+	log.WithField("tenant", "q02").Error("query failed")
+	assert.False(log.IsLevelEnabled(log.DebugLevel))
+
+	entries := jsonEntries(t, file)
+	assert.Len(entries, 2)
+	assert.Equal("query running", entries[0]["msg"])
+	assert.Equal("Q01", entries[0]["tenant"])
+	assert.Equal("debug", entries[0]["level"])
+	assert.Equal("query failed", entries[1]["msg"])
+	_, err := time.Parse(time.RFC3339Nano, entries[1]["time"].(string))
+	assert.Nil(err)
+
+	assert.NotNil(cmd.SetLogFormat("text"))
+	assert.Nil(cmd.SetLogFormat("logfmt"))
+	log.WithField("tenant", "q02").Error("query failed")
+	content, err := os.ReadFile(file)
+	assert.Nil(err)
+	assert.Contains(string(content), `level=error msg="query failed" tenant=q02`)
+}
+
+func Test_LogRotation(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "exporter.log")
+	setLogging(t, &cmd.Config{
+		LogFile:       file,
+		LogLevel:      "info",
+		LogMaxSize:    logLimit(1),
+		LogMaxBackups: logLimit(2),
+	})
+
+	// rotated by size, only the newest backups are kept
+	line := strings.Repeat("x", 1000)
+	for i := 0; i < 3000; i++ {
+		log.WithField("line", line).Info("filler")
+	}
+	backups, err := filepath.Glob(file + ".*")
+	assert.Nil(err)
+	assert.Len(backups, 2)
+	for _, backup := range append(backups, file) {
+		info, err := os.Stat(backup)
+		assert.Nil(err)
+		assert.True(info.Size() <= 1024*1024, backup)
+	}
+
+	// rotated by time
+	timeFile := filepath.Join(dir, "time.log")
+	setLogging(t, &cmd.Config{
+		LogFile:           timeFile,
+		LogLevel:          "info",
+		LogRotateInterval: 1,
+	})
+	log.Info("first")
+	time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second + 10*time.Millisecond)))
+	log.Info("second")
+	backups, err = filepath.Glob(timeFile + ".*")
+	assert.Nil(err)
+	assert.Len(backups, 1)
+	content, err := os.ReadFile(timeFile)
+	assert.Nil(err)
+	assert.Contains(string(content), "second")
+	assert.NotContains(string(content), "first")
+}
+
+func Test_LogRotationDefaults(t *testing.T) {
+	assert := assert.New(t)
+
+	// the log file is rotated at 100 MB and 7 rotated files are kept
+	config := &cmd.Config{}
+	config.ApplyDefaults()
+	assert.Equal(uint(100), *config.LogMaxSize)
+	assert.Equal(uint(7), *config.LogMaxBackups)
+
+	// 0 switches the limits off
+	config = &cmd.Config{}
+	assert.Nil(config.SetValue([]string{"LogMaxSize"}, "0"))
+	assert.Nil(config.SetValue([]string{"LogMaxBackups"}, "0"))
+	config.ApplyDefaults()
+	assert.Equal(uint(0), *config.LogMaxSize)
+	assert.Equal(uint(0), *config.LogMaxBackups)
+}
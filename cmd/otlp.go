@@ -0,0 +1,254 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	colmetricpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricpb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/proto"
+)
+
+// default values of the OTLP settings
+const (
+	defaultOTLPInterval = 60
+	defaultOTLPTimeout  = 10
+)
+
+// OTLPInfo - OpenTelemetry collector endpoint
+type OTLPInfo struct {
+	Endpoint string // http(s)://host:4318 for http/protobuf, host:4317 for grpc
+	Protocol string // http/protobuf (default) or grpc
+	Insecure bool   // grpc without TLS
+	Timeout  uint   // export timeout in seconds
+}
+
+// labels of a metric record that become resource attributes
+var otlpResourceLabels = []string{"tenant", "usage", "sid", "insnr", "database_name"}
+
+// OTLPExporter - sends metrics to one OTLP endpoint
+type OTLPExporter struct {
+	info   OTLPInfo
+	client *http.Client
+	conn   *grpc.ClientConn
+	grpc   colmetricpb.MetricsServiceClient
+}
+
+// NewOTLPExporter - exporter for http/protobuf or grpc
+func NewOTLPExporter(info OTLPInfo) (*OTLPExporter, error) {
+	if info.Endpoint == "" {
+		return nil, errors.New("NewOTLPExporter(Endpoint is missing)")
+	}
+	if info.Timeout == 0 {
+		info.Timeout = defaultOTLPTimeout
+	}
+	e := OTLPExporter{info: info}
+
+	switch low(info.Protocol) {
+	case "", "http/protobuf", "http":
+		e.info.Protocol = "http/protobuf"
+		if !strings.HasSuffix(e.info.Endpoint, "/v1/metrics") {
+			e.info.Endpoint = strings.TrimSuffix(e.info.Endpoint, "/") + "/v1/metrics"
+		}
+		e.client = &http.Client{Timeout: time.Duration(info.Timeout) * time.Second}
+	case "grpc":
+		creds := credentials.NewTLS(&tls.Config{})
+		if info.Insecure {
+			creds = insecure.NewCredentials()
+		}
+		conn, err := grpc.NewClient(info.Endpoint, grpc.WithTransportCredentials(creds))
+		if err != nil {
+			return nil, errors.Wrap(err, "NewOTLPExporter(NewClient)")
+		}
+		e.conn = conn
+		e.grpc = colmetricpb.NewMetricsServiceClient(conn)
+	default:
+		return nil, errors.Errorf("NewOTLPExporter(unknown protocol %s)", info.Protocol)
+	}
+	return &e, nil
+}
+
+// Close - close the grpc connection
+func (e *OTLPExporter) Close() error {
+	if e.conn != nil {
+		return e.conn.Close()
+	}
+	return nil
+}
+
+// Export - send one export request
+func (e *OTLPExporter) Export(ctx context.Context, req *colmetricpb.ExportMetricsServiceRequest) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(e.info.Timeout)*time.Second)
+	defer cancel()
+
+	if e.grpc != nil {
+		_, err := e.grpc.Export(ctx, req)
+		return errors.Wrap(err, "Export(grpc)")
+	}
+
+	body, err := proto.Marshal(req)
+	if err != nil {
+		return errors.Wrap(err, "Export(Marshal)")
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, e.info.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "Export(NewRequest)")
+	}
+	httpReq.Header.Set("Content-Type", "application/x-protobuf")
+
+	resp, err := e.client.Do(httpReq)
+	if err != nil {
+		return errors.Wrap(err, "Export(Do)")
+	}
+	defer resp.Body.Close()
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	if resp.StatusCode/100 != 2 {
+		return errors.Errorf("Export(status %s: %s)", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// PushOTLP - collect the metrics every OTLPInterval seconds and export them
+// to all OTLP endpoints until ctx is done
+func (rt *Runtime) PushOTLP(ctx context.Context) error {
+	var exporters []*OTLPExporter
+	for _, info := range rt.Config.OTLP {
+		e, err := NewOTLPExporter(info)
+		if err != nil {
+			return errors.Wrapf(err, "PushOTLP(%s)", info.Endpoint)
+		}
+		defer e.Close()
+		exporters = append(exporters, e)
+	}
+
+	start := time.Now()
+	rt.collectEvery(ctx, rt.Config.OTLPInterval, defaultOTLPInterval, func(data []MetricData, ts time.Time) {
+		if len(data) == 0 {
+			return
+		}
+		req := rt.OTLPRequest(data, start, ts)
+		for _, e := range exporters {
+			if err := e.Export(ctx, req); err != nil {
+				log.WithField("endpoint", e.info.Endpoint).WithError(err).Error("otlp export failed")
+			}
+		}
+	})
+	return nil
+}
+
+// OTLPRequest - metric data as OTLP request with one resource per tenant.
+// Counters become cumulative sums starting at start, all other types gauges.
+func (rt *Runtime) OTLPRequest(data []MetricData, start, ts time.Time) *colmetricpb.ExportMetricsServiceRequest {
+	req := colmetricpb.ExportMetricsServiceRequest{}
+
+	byTenant := SplitByTenant(data)
+	var names []string
+	for name := range byTenant {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		scope := metricpb.ScopeMetrics{
+			Scope: &commonpb.InstrumentationScope{Name: "hana_sql_exporter"},
+		}
+		for _, md := range byTenant[name] {
+			scope.Metrics = append(scope.Metrics, otlpMetric(md, start, ts))
+		}
+		req.ResourceMetrics = append(req.ResourceMetrics, &metricpb.ResourceMetrics{
+			Resource:     rt.otlpResource(name, byTenant[name]),
+			ScopeMetrics: []*metricpb.ScopeMetrics{&scope},
+		})
+	}
+	return &req
+}
+
+// resource attributes of a tenant
+func (rt *Runtime) otlpResource(name string, data []MetricData) *resourcepb.Resource {
+	attrs := map[string]string{
+		"service.name": "hana_sql_exporter",
+		"sap.tenant":   name,
+	}
+
+	// metadata labels of the first record, the version from the tenant info
+	if len(data) > 0 && len(data[0].Stats) > 0 {
+		record := data[0].Stats[0]
+		keys := map[string]string{"usage": "sap.tenant.usage", "sid": "sap.sid", "insnr": "sap.instance_number", "database_name": "db.name"}
+		for i, label := range record.Labels {
+			if key, ok := keys[label]; ok && i < len(record.LabelValues) {
+				attrs[key] = record.LabelValues[i]
+			}
+		}
+	}
+	for _, tenant := range rt.tenantList() {
+		if low(tenant.Name) == name && tenant.Version != "" {
+			attrs["sap.hana.version"] = tenant.Version
+		}
+	}
+	return &resourcepb.Resource{Attributes: otlpAttributes(attrs)}
+}
+
+// OTel metric of one metric data
+func otlpMetric(md MetricData, start, ts time.Time) *metricpb.Metric {
+	var points []*metricpb.NumberDataPoint
+	for _, record := range md.Stats {
+		attrs := make(map[string]string)
+		for i, label := range record.Labels {
+			if !ContainsString(label, otlpResourceLabels) && i < len(record.LabelValues) {
+				attrs[label] = record.LabelValues[i]
+			}
+		}
+		points = append(points, &metricpb.NumberDataPoint{
+			Attributes:        otlpAttributes(attrs),
+			StartTimeUnixNano: uint64(start.UnixNano()),
+			TimeUnixNano:      uint64(ts.UnixNano()),
+			Value:             &metricpb.NumberDataPoint_AsDouble{AsDouble: record.Value},
+		})
+	}
+
+	metric := metricpb.Metric{Name: md.Name, Description: md.Help}
+	if low(md.MetricType) == "counter" {
+		metric.Data = &metricpb.Metric_Sum{Sum: &metricpb.Sum{
+			DataPoints:             points,
+			AggregationTemporality: metricpb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+			IsMonotonic:            true,
+		}}
+	} else {
+		metric.Data = &metricpb.Metric_Gauge{Gauge: &metricpb.Gauge{DataPoints: points}}
+	}
+	return &metric
+}
+
+// string attributes sorted by key, empty values are dropped
+func otlpAttributes(attrs map[string]string) []*commonpb.KeyValue {
+	var keys []string
+	for key, value := range attrs {
+		if value != "" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var kvs []*commonpb.KeyValue
+	for _, key := range keys {
+		kvs = append(kvs, &commonpb.KeyValue{
+			Key:   key,
+			Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: attrs[key]}},
+		})
+	}
+	return kvs
+}
@@ -0,0 +1,139 @@
+package cmd_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ulranh/hana_sql_exporter/cmd"
+	colmetricpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+)
+
+var otlpData = []cmd.MetricData{
+	{
+		Name:       "hana_connections",
+		Help:       "connections",
+		MetricType: "gauge",
+		Stats: []cmd.MetricRecord{
+			{Value: 3, Labels: []string{"tenant", "usage", "schema", "sid", "insnr", "database_name", "host"}, LabelValues: []string{"q01", "test", "sys", "Q01", "00", "Q01", "h1"}},
+		},
+	},
+	{
+		Name:       "hana_statements_total",
+		MetricType: "counter",
+		Stats: []cmd.MetricRecord{
+			{Value: 42, Labels: []string{"tenant", "usage"}, LabelValues: []string{"q01", "test"}},
+		},
+	},
+}
+
+// attributes as map
+func otlpAttrs(kvs []*commonpb.KeyValue) map[string]string {
+	attrs := make(map[string]string)
+	for _, kv := range kvs {
+		attrs[kv.Key] = kv.Value.GetStringValue()
+	}
+	return attrs
+}
+
+func Test_OTLPRequest(t *testing.T) {
+	assert := assert.New(t)
+
+	rt := cmd.Runtime{Tenants: []*cmd.Tenant{{TenantInfo: cmd.TenantInfo{Name: "q01"}, Version: "2.00.059.00"}}}
+	start := time.Now().Add(-time.Minute)
+	req := rt.OTLPRequest(otlpData, start, time.Now())
+
+	assert.Equal(1, len(req.ResourceMetrics))
+	assert.Equal(map[string]string{
+		"service.name":        "hana_sql_exporter",
+		"sap.tenant":          "q01",
+		"sap.tenant.usage":    "test",
+		"sap.sid":             "Q01",
+		"sap.instance_number": "00",
+		"db.name":             "Q01",
+		"sap.hana.version":    "2.00.059.00",
+	}, otlpAttrs(req.ResourceMetrics[0].Resource.Attributes))
+
+	metrics := req.ResourceMetrics[0].ScopeMetrics[0].Metrics
+	gauge := metrics[0].GetGauge()
+	assert.NotNil(gauge)
+	assert.Equal(3.0, gauge.DataPoints[0].GetAsDouble())
+	assert.Equal(map[string]string{"schema": "sys", "host": "h1"}, otlpAttrs(gauge.DataPoints[0].Attributes))
+
+	sum := metrics[1].GetSum()
+	assert.NotNil(sum)
+	assert.True(sum.IsMonotonic)
+	assert.Equal(uint64(start.UnixNano()), sum.DataPoints[0].StartTimeUnixNano)
+}
+
+func Test_OTLPExportHTTP(t *testing.T) {
+	assert := assert.New(t)
+
+	received := make(chan *colmetricpb.ExportMetricsServiceRequest, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/metrics" || r.Header.Get("Content-Type") != "application/x-protobuf" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		var req colmetricpb.ExportMetricsServiceRequest
+		if err := proto.Unmarshal(body, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		received <- &req
+	}))
+	defer server.Close()
+
+	e, err := cmd.NewOTLPExporter(cmd.OTLPInfo{Endpoint: server.URL})
+	assert.Nil(err)
+	defer e.Close()
+
+	rt := cmd.Runtime{}
+	assert.Nil(e.Export(context.Background(), rt.OTLPRequest(otlpData, time.Now(), time.Now())))
+	req := <-received
+	assert.Equal("hana_connections", req.ResourceMetrics[0].ScopeMetrics[0].Metrics[0].Name)
+}
+
+// otlpReceiver - grpc metrics service stand-in
+type otlpReceiver struct {
+	colmetricpb.UnimplementedMetricsServiceServer
+	received chan *colmetricpb.ExportMetricsServiceRequest
+}
+
+func (o *otlpReceiver) Export(ctx context.Context, req *colmetricpb.ExportMetricsServiceRequest) (*colmetricpb.ExportMetricsServiceResponse, error) {
+	o.received <- req
+	return &colmetricpb.ExportMetricsServiceResponse{}, nil
+}
+
+func Test_OTLPExportGRPC(t *testing.T) {
+	assert := assert.New(t)
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(err)
+	receiver := &otlpReceiver{received: make(chan *colmetricpb.ExportMetricsServiceRequest, 1)}
+	server := grpc.NewServer()
+	colmetricpb.RegisterMetricsServiceServer(server, receiver)
+	go server.Serve(lis)
+	defer server.Stop()
+
+	e, err := cmd.NewOTLPExporter(cmd.OTLPInfo{Endpoint: lis.Addr().String(), Protocol: "grpc", Insecure: true})
+	assert.Nil(err)
+	defer e.Close()
+
+	rt := cmd.Runtime{}
+	assert.Nil(e.Export(context.Background(), rt.OTLPRequest(otlpData, time.Now(), time.Now())))
+	req := <-receiver.received
+	assert.Equal("hana_statements_total", req.ResourceMetrics[0].ScopeMetrics[0].Metrics[1].Name)
+
+	_, err = cmd.NewOTLPExporter(cmd.OTLPInfo{Endpoint: "x", Protocol: "thrift"})
+	assert.NotNil(err)
+}
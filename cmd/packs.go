@@ -0,0 +1,226 @@
+package cmd
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// metric packs compiled into the binary
+//
+//go:embed packs/*.toml
+var packFiles embed.FS
+
+// MetricPack - predefined set of metrics and queries
+type MetricPack struct {
+	Name        string
+	Version     int
+	Description string
+	Metrics     []MetricInfo
+	Queries     []QueryInfo
+}
+
+// packsCmd represents the packs command
+var packsCmd = &cobra.Command{
+	Use:   "packs",
+	Short: "List the built-in metric packs",
+	Long: `With the command packs you can list the metric packs shipped with the binary. A pack can be enabled in the config file with the Include slice. For example:
+	hana_sql_exporter packs
+	hana_sql_exporter packs --verbose`,
+	Run: func(cmd *cobra.Command, args []string) {
+		verbose, err := cmd.Flags().GetBool("verbose")
+		if err != nil {
+			exit("Problem with verbose flag: ", err)
+		}
+
+		packs, err := GetMetricPacks()
+		if err != nil {
+			exit("Can't read metric packs: ", err)
+		}
+		for _, pack := range packs {
+			fmt.Printf("%-20s v%d  %s\n", pack.Name, pack.Version, pack.Description)
+			if verbose {
+				for _, name := range pack.MetricNames() {
+					fmt.Printf("    %s\n", name)
+				}
+			}
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(packsCmd)
+
+	packsCmd.Flags().BoolP("verbose", "v", false, "list the metric names of every pack")
+}
+
+// GetMetricPacks - all built-in metric packs sorted by name
+func GetMetricPacks() ([]MetricPack, error) {
+	files, err := packFiles.ReadDir("packs")
+	if err != nil {
+		return nil, errors.Wrap(err, "GetMetricPacks(ReadDir)")
+	}
+
+	var packs []MetricPack
+	for _, file := range files {
+		pack, err := readMetricPack(path.Join("packs", file.Name()))
+		if err != nil {
+			return nil, errors.Wrap(err, "GetMetricPacks(readMetricPack)")
+		}
+		packs = append(packs, pack)
+	}
+	sort.Slice(packs, func(i, j int) bool { return packs[i].Name < packs[j].Name })
+	return packs, nil
+}
+
+// GetMetricPack - built-in metric pack with the given name, e.g. "hana:core"
+func GetMetricPack(name string) (MetricPack, error) {
+	packs, err := GetMetricPacks()
+	if err != nil {
+		return MetricPack{}, errors.Wrap(err, "GetMetricPack(GetMetricPacks)")
+	}
+	for _, pack := range packs {
+		if strings.EqualFold(pack.Name, strings.TrimSpace(name)) {
+			return pack, nil
+		}
+	}
+	return MetricPack{}, errors.Errorf("GetMetricPack(unknown metric pack %q)", name)
+}
+
+// MetricNames - names of all metrics defined in the pack
+func (pack *MetricPack) MetricNames() []string {
+	var names []string
+	for _, metric := range pack.Metrics {
+		names = append(names, metric.Name)
+	}
+	for _, query := range pack.Queries {
+		for _, metric := range query.Metrics {
+			names = append(names, metric.Name)
+		}
+	}
+	return names
+}
+
+// read one embedded pack file
+func readMetricPack(file string) (MetricPack, error) {
+	var pack MetricPack
+
+	content, err := packFiles.ReadFile(file)
+	if err != nil {
+		return pack, errors.Wrap(err, "readMetricPack(ReadFile)")
+	}
+
+	v := viper.New()
+	v.SetConfigType("toml")
+	if err := v.ReadConfig(bytes.NewReader(content)); err != nil {
+		return pack, errors.Wrapf(err, "readMetricPack(ReadConfig %s)", file)
+	}
+	if err := v.Unmarshal(&pack); err != nil {
+		return pack, errors.Wrapf(err, "readMetricPack(Unmarshal %s)", file)
+	}
+	return pack, nil
+}
+
+// ApplyMetricPacks - add the metrics of the included packs to the config.
+// Metrics defined in the config file override pack metrics with the same
+// name, of several packs with the same metric the first one wins and a pack
+// is only applied once. EnableMetrics and DisableMetrics switch single
+// metrics on or off.
+func (config *Config) ApplyMetricPacks() error {
+	defined := make(map[string]bool)
+	for _, metric := range config.Metrics {
+		defined[low(metric.Name)] = true
+	}
+	for _, query := range config.Queries {
+		for _, metric := range query.Metrics {
+			defined[low(metric.Name)] = true
+		}
+	}
+
+	applied := make(map[string]bool)
+	for _, include := range config.Include {
+		if !isPackReference(include) {
+			continue
+		}
+		pack, err := GetMetricPack(include)
+		if err != nil {
+			return errors.Wrap(err, "ApplyMetricPacks(GetMetricPack)")
+		}
+		if applied[low(pack.Name)] {
+			log.WithField("pack", pack.Name).Warn("metric pack included twice, applied once")
+			continue
+		}
+		applied[low(pack.Name)] = true
+
+		for _, metric := range pack.Metrics {
+			if defined[low(metric.Name)] {
+				log.WithFields(log.Fields{
+					"pack":   pack.Name,
+					"metric": metric.Name,
+				}).Debug("pack metric already defined")
+				continue
+			}
+			defined[low(metric.Name)] = true
+			config.Metrics = append(config.Metrics, metric)
+		}
+
+		for _, query := range pack.Queries {
+			var metrics []QueryMetricInfo
+			for _, metric := range query.Metrics {
+				if defined[low(metric.Name)] {
+					log.WithFields(log.Fields{
+						"pack":   pack.Name,
+						"metric": metric.Name,
+					}).Debug("pack metric already defined")
+					continue
+				}
+				defined[low(metric.Name)] = true
+				metrics = append(metrics, metric)
+			}
+			if len(metrics) == 0 {
+				continue
+			}
+			query.Metrics = metrics
+			config.Queries = append(config.Queries, query)
+		}
+	}
+
+	config.switchMetrics(config.EnableMetrics, false)
+	config.switchMetrics(config.DisableMetrics, true)
+	return nil
+}
+
+// set the Disabled flag of all metrics with the given names
+func (config *Config) switchMetrics(names []string, disabled bool) {
+	for _, name := range names {
+		found := false
+		for mPos := range config.Metrics {
+			if strings.EqualFold(config.Metrics[mPos].Name, name) {
+				config.Metrics[mPos].Disabled = disabled
+				found = true
+			}
+		}
+		for qPos := range config.Queries {
+			for mPos := range config.Queries[qPos].Metrics {
+				if strings.EqualFold(config.Queries[qPos].Metrics[mPos].Name, name) {
+					config.Queries[qPos].Metrics[mPos].Disabled = disabled
+					if !disabled {
+						config.Queries[qPos].Disabled = false
+					}
+					found = true
+				}
+			}
+		}
+		if !found {
+			log.WithField("metric", name).Warn("metric to enable or disable does not exist")
+		}
+	}
+}
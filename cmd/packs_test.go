@@ -0,0 +1,146 @@
+package cmd_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ulranh/hana_sql_exporter/cmd"
+)
+
+func Test_GetMetricPacks(t *testing.T) {
+	assert := assert.New(t)
+
+	packs, err := cmd.GetMetricPacks()
+	assert.Nil(err)
+	assert.NotEmpty(packs)
+
+	names := make(map[string]bool)
+	for _, pack := range packs {
+		assert.NotEmpty(pack.Name)
+		assert.True(pack.Version > 0, pack.Name)
+		for _, query := range pack.Queries {
+			assert.NotEmpty(query.SQL, pack.Name)
+			assert.NotEmpty(query.VersionFilter, pack.Name)
+			for _, metric := range query.Metrics {
+				assert.False(names[metric.Name], "duplicate metric "+metric.Name)
+				names[metric.Name] = true
+				assert.NotEmpty(metric.Help, metric.Name)
+				assert.Contains([]string{"gauge", "counter", "info", "stateset"}, metric.MetricType, metric.Name)
+				if metric.MetricType == "stateset" {
+					assert.NotEmpty(metric.States, metric.Name)
+				}
+			}
+		}
+	}
+}
+
+func Test_MetricPackVersions(t *testing.T) {
+	assert := assert.New(t)
+
+	packs, err := cmd.GetMetricPacks()
+	assert.Nil(err)
+
+	// the version filters of the packs accept current HANA 2 and HANA 1 SPS12
+	// versions
+	config := &cmd.Config{}
+	for _, pack := range packs {
+		for _, query := range pack.Queries {
+			for _, version := range []string{"2.00.059", "1.00.122"} {
+				assert.True(config.CheckVersionRequirement(version, query.VersionFilter), pack.Name+": "+query.VersionFilter+" "+version)
+			}
+		}
+	}
+	assert.False(config.CheckVersionRequirement("1.00.110", ">= 1.00.120"))
+}
+
+func Test_MetricPackInfoColumns(t *testing.T) {
+	assert := assert.New(t)
+
+	packs, err := cmd.GetMetricPacks()
+	assert.Nil(err)
+
+	// all columns of info metrics become labels, the default labels would be
+	// dropped
+	defaults := []string{"tenant", "usage", "schema", "sid", "insnr", "database_name"}
+	for _, pack := range packs {
+		for _, query := range pack.Queries {
+			for _, metric := range query.Metrics {
+				if metric.MetricType != "info" {
+					continue
+				}
+				sel := strings.ToLower(query.SQL)
+				columns := sel[strings.Index(sel, "select")+6 : strings.Index(sel, " from ")]
+				for _, column := range strings.Split(columns, ",") {
+					fields := strings.Fields(column)
+					assert.NotContains(defaults, fields[len(fields)-1], metric.Name)
+				}
+			}
+		}
+	}
+}
+
+func Test_ApplyMetricPacks(t *testing.T) {
+	assert := assert.New(t)
+
+	// unknown pack
+	config := getTestConfig(1, 1)
+	config.Include = []string{"hana:unknown"}
+	assert.NotNil(config.ApplyMetricPacks())
+
+	config = getTestConfig(1, 1)
+	config.Include = []string{"hana:locks"}
+	config.Queries = []cmd.QueryInfo{
+		{
+			SQL:     "select count(*) from <SCHEMA>.m_table_locks where lock_mode = 'EXCLUSIVE'",
+			Metrics: []cmd.QueryMetricInfo{{Name: "hana_table_locks", MetricType: "gauge"}},
+		},
+	}
+	config.DisableMetrics = []string{"hana_record_locks"}
+	assert.Nil(config.ApplyMetricPacks())
+
+	// the config file definition of hana_table_locks overrides the pack
+	var names []string
+	disabled := make(map[string]bool)
+	for _, query := range config.Queries {
+		for _, metric := range query.Metrics {
+			names = append(names, metric.Name)
+			disabled[metric.Name] = metric.Disabled
+		}
+	}
+	assert.Equal([]string{"hana_table_locks", "hana_blocked_transactions", "hana_record_locks"}, names)
+	assert.Equal("select count(*) from <SCHEMA>.m_table_locks where lock_mode = 'EXCLUSIVE'", config.Queries[0].SQL)
+	assert.True(disabled["hana_record_locks"])
+	assert.False(disabled["hana_blocked_transactions"])
+
+	// a pack included twice is applied once
+	config = getTestConfig(1, 1)
+	config.Include = []string{"hana:locks", " HANA:locks"}
+	config.Metrics, config.Queries = nil, nil
+	assert.Nil(config.ApplyMetricPacks())
+	pack, err := cmd.GetMetricPack("hana:locks")
+	assert.Nil(err)
+	assert.Equal(len(pack.Queries), len(config.Queries))
+	assert.Equal(len(pack.Metrics), len(config.Metrics))
+
+	// all packs together define every metric once
+	packs, err := cmd.GetMetricPacks()
+	assert.Nil(err)
+	config = getTestConfig(1, 1)
+	config.Metrics, config.Queries, config.Include = nil, nil, nil
+	for _, pack := range packs {
+		config.Include = append(config.Include, pack.Name)
+	}
+	assert.Nil(config.ApplyMetricPacks())
+	seen := make(map[string]bool)
+	for _, metric := range config.Metrics {
+		assert.False(seen[metric.Name], metric.Name)
+		seen[metric.Name] = true
+	}
+	for _, query := range config.Queries {
+		for _, metric := range query.Metrics {
+			assert.False(seen[metric.Name], metric.Name)
+			seen[metric.Name] = true
+		}
+	}
+}
@@ -15,6 +15,7 @@
 package cmd
 
 import (
+	"context"
 	crypt "crypto/rand"
 	"fmt"
 	"io"
@@ -84,7 +85,8 @@ func (config *Config) SetPw(cmd *cobra.Command) error {
 		return errors.Wrap(err, "setPw(newSecret)")
 	}
 
-	viper.Set("secret", config.Secret)
+	// integer array for the same representation in toml, yaml and json
+	viper.Set("secret", SecretValues(config.Secret))
 	err = viper.WriteConfig()
 	if err != nil {
 		return errors.Wrap(err, "setPw(WriteConfig)")
@@ -95,8 +97,12 @@ func (config *Config) SetPw(cmd *cobra.Command) error {
 	if err != nil {
 		return errors.Wrap(err, "prepare(getSecretMap)")
 	}
-	for i := range config.Tenants {
-		db := config.getConnection(i, secretMap)
+	rt := NewRuntime(config)
+	for _, info := range config.Tenants {
+		if config.isTemplate(info.Name) {
+			continue
+		}
+		db := rt.getConnection(context.Background(), &Tenant{TenantInfo: info}, info.ConnStr, secretMap)
 		if db == nil {
 			continue
 		}
@@ -131,11 +137,20 @@ func (config *Config) AddSecret(tenants string, pw []byte) ([]byte, error) {
 		return nil, errors.Wrap(err, "AddSecret(PwEncrypt)")
 	}
 
+	// tenants of the discovery sources, read once if a tenant is not in the
+	// configfile
+	var inventory map[string]bool
 	for _, tenant := range strings.Split(tenants, ",") {
 
 		// check, if cmd line tenant exists in configfile
 		tInfo := config.FindTenant(low(tenant))
-		if "" == tInfo.Name {
+		if "" == tInfo.Name && inventory == nil {
+			inventory, err = config.inventoryTenants(context.Background())
+			if err != nil {
+				return nil, errors.Wrap(err, "AddSecret(inventoryTenants)")
+			}
+		}
+		if "" == tInfo.Name && !inventory[low(tenant)] {
 			log.WithFields(log.Fields{
 				"tenant": low(tenant),
 			}).Error("missing tenant")
@@ -155,6 +170,15 @@ func (config *Config) AddSecret(tenants string, pw []byte) ([]byte, error) {
 	return newSecret, nil
 }
 
+// SecretValues - secret bytes as integer slice
+func SecretValues(secret []byte) []int {
+	values := make([]int, len(secret))
+	for i, b := range secret {
+		values[i] = int(b)
+	}
+	return values
+}
+
 // FindTenant - check if cmpTenant already exists in configfile
 func (config *Config) FindTenant(cmpTenant string) TenantInfo {
 	for _, tenant := range config.Tenants {
@@ -0,0 +1,247 @@
+package cmd
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// queryCmd represents the query command
+var queryCmd = &cobra.Command{
+	Use:   "query <name>",
+	Short: "Print the result of an exported query",
+	Long: `With the command query you can print the rows of a query as json or csv. Only queries with a Name and Export = true can be selected. For example:
+	hana_sql_exporter query cancelled_jobs --tenant q01
+	hana_sql_exporter query largest_tables --tenant q01 --format csv > largest_tables.csv`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		tenant, _ := cmd.Flags().GetString("tenant")
+		format, _ := cmd.Flags().GetString("format")
+
+		config, err := getConfig()
+		if err != nil {
+			exit("Can't handle config file: ", err)
+		}
+		err = config.ApplyFlags(cmd.Flags())
+		if err != nil {
+			exit("Problem with flags: ", err)
+		}
+		config.ApplyDefaults()
+
+		f, err := SetLogging(config)
+		if err != nil {
+			exit("Can't set up logging: ", err)
+		}
+		if f != nil {
+			defer f.Close()
+		}
+
+		// connect only the requested tenant, unless it is discovered by a
+		// system database
+		tInfo := config.FindTenant(tenant)
+		if tInfo.Name != "" && !tInfo.SystemDB {
+			config.Tenants = []TenantInfo{tInfo}
+		}
+		rt := NewRuntime(config)
+		err = rt.Connect()
+		if err != nil || rt.FindTenant(tenant) == nil {
+			exit("Can't connect tenant: ", errors.Errorf("tenant %s is not available, see log file", tenant))
+		}
+		defer rt.Close()
+
+		table, err := rt.QueryTable(context.Background(), args[0], tenant)
+		if err != nil {
+			exit("Can't run query: ", err)
+		}
+		if err = table.Write(os.Stdout, format); err != nil {
+			exit("Can't write result: ", err)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(queryCmd)
+
+	queryCmd.Flags().String("tenant", "", "tenant the query runs on")
+	queryCmd.Flags().String("format", "json", "output format: json or csv")
+	queryCmd.Flags().UintP("timeout", "t", defaultTimeout, "query timeout in seconds.")
+	queryCmd.Flags().StringP("log-file", "l", defaultLogFile, "logfile, the logfile location")
+	queryCmd.Flags().String("log-level", defaultLogLevel, "logfile, the log level")
+	queryCmd.Flags().String("log-format", defaultLogFormat, "format of the log entries, logfmt or json")
+	queryCmd.MarkFlagRequired("tenant")
+}
+
+// errQueryNotFound - no exported query with this name
+var errQueryNotFound = errors.New("query not found")
+
+// errTenantNotFound - no connected tenant with this name
+var errTenantNotFound = errors.New("tenant not found")
+
+// Table - rows of a query with column names and database types
+type Table struct {
+	Query   string          `json:"query"`
+	Tenant  string          `json:"tenant"`
+	Columns []Column        `json:"columns"`
+	Rows    [][]interface{} `json:"rows"`
+}
+
+// Column - name and database type of a result column
+type Column struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// QueryTable - run the exported query with the name on the tenant
+func (rt *Runtime) QueryTable(ctx context.Context, name, tenantName string) (*Table, error) {
+	qPos := -1
+	for i, query := range rt.Config.Queries {
+		if query.Export && query.Name != "" && strings.EqualFold(query.Name, name) {
+			qPos = i
+			break
+		}
+	}
+	if qPos < 0 {
+		return nil, errors.Wrapf(errQueryNotFound, "QueryTable(%s)", name)
+	}
+
+	tenant := rt.FindTenant(tenantName)
+	if tenant == nil || tenant.DB() == nil {
+		return nil, errors.Wrapf(errTenantNotFound, "QueryTable(%s)", tenantName)
+	}
+
+	sel, args := tenant.selection(rt.Config.Queries[qPos], rt.status.lastSuccess("query", qPos, tenant.Name))
+	if sel == "" {
+		return nil, errors.Errorf("QueryTable(query %s does not apply to tenant %s)", name, tenantName)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(rt.Config.Timeout)*time.Second)
+	defer cancel()
+	rows, err := tenant.DB().QueryContext(ctx, sel, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "QueryTable(QueryContext)")
+	}
+	defer rows.Close()
+
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, errors.Wrap(err, "QueryTable(ColumnTypes)")
+	}
+	data, cols, err := RowsConvert(rows)
+	if err != nil {
+		return nil, errors.Wrap(err, "QueryTable(RowsConvert)")
+	}
+
+	table := Table{
+		Query:  rt.Config.Queries[qPos].Name,
+		Tenant: low(tenant.Name),
+		Rows:   make([][]interface{}, 0, len(data)),
+	}
+	for i, col := range cols {
+		table.Columns = append(table.Columns, Column{Name: col, Type: types[i].DatabaseTypeName()})
+	}
+	for _, values := range data {
+		row := make([]interface{}, len(values))
+		for i := range values {
+			row[i] = tableValue(*(values[i].(*interface{})))
+		}
+		table.Rows = append(table.Rows, row)
+	}
+	return &table, nil
+}
+
+// tableValue - value that can be written as json and csv
+func tableValue(v interface{}) interface{} {
+	switch value := v.(type) {
+	case time.Time:
+		return value.Format(time.RFC3339)
+	case []uint8:
+		return string(value)
+	case *big.Rat:
+		f, _ := value.Float64()
+		return f
+	default:
+		return value
+	}
+}
+
+// Write - table as json or csv with a header line
+func (table *Table) Write(w io.Writer, format string) error {
+	switch low(format) {
+	case "", "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return errors.Wrap(enc.Encode(table), "Write(json)")
+	case "csv":
+		cw := csv.NewWriter(w)
+		header := make([]string, len(table.Columns))
+		for i, col := range table.Columns {
+			header[i] = col.Name
+		}
+		if err := cw.Write(header); err != nil {
+			return errors.Wrap(err, "Write(csv)")
+		}
+		for _, row := range table.Rows {
+			record := make([]string, len(row))
+			for i, v := range row {
+				if v != nil {
+					record[i] = fmt.Sprint(v)
+				}
+			}
+			if err := cw.Write(record); err != nil {
+				return errors.Wrap(err, "Write(csv)")
+			}
+		}
+		cw.Flush()
+		return errors.Wrap(cw.Error(), "Write(csv)")
+	}
+	return errors.Errorf("Write(unknown format %s)", format)
+}
+
+// QueryHandler - /api/v1/query/<name>?tenant=<tenant>&format=json|csv
+func (rt *Runtime) QueryHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/query/"), "/")
+	tenant := r.URL.Query().Get("tenant")
+	format := low(r.URL.Query().Get("format"))
+
+	if name == "" || tenant == "" {
+		http.Error(w, "query name and tenant are required", http.StatusBadRequest)
+		return
+	}
+	if format != "" && format != "json" && format != "csv" {
+		http.Error(w, "format must be json or csv", http.StatusBadRequest)
+		return
+	}
+
+	table, err := rt.QueryTable(r.Context(), name, tenant)
+	if err != nil {
+		log.WithFields(log.Fields{"query": name, "tenant": tenant}).WithError(err).Error("query export failed")
+		switch errors.Cause(err) {
+		case errQueryNotFound, errTenantNotFound:
+			http.Error(w, errors.Cause(err).Error(), http.StatusNotFound)
+		default:
+			http.Error(w, "query failed, see log file", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", table.Query+"_"+table.Tenant+".csv"))
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	if err := table.Write(w, format); err != nil {
+		log.WithError(err).Error("QueryHandler(Write)")
+	}
+}
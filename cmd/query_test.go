@@ -0,0 +1,70 @@
+package cmd_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ulranh/hana_sql_exporter/cmd"
+)
+
+var queryTable = cmd.Table{
+	Query:  "largest_tables",
+	Tenant: "q01",
+	Columns: []cmd.Column{
+		{Name: "table_name", Type: "NVARCHAR"},
+		{Name: "record_count", Type: "BIGINT"},
+	},
+	Rows: [][]interface{}{
+		{"BALDAT", int64(1200)},
+		{"CDPOS, old", nil},
+	},
+}
+
+func Test_TableWrite(t *testing.T) {
+	assert := assert.New(t)
+
+	var buf bytes.Buffer
+	assert.Nil(queryTable.Write(&buf, "csv"))
+	assert.Equal("table_name,record_count\nBALDAT,1200\n\"CDPOS, old\",\n", buf.String())
+
+	buf.Reset()
+	assert.Nil(queryTable.Write(&buf, "json"))
+	var table cmd.Table
+	assert.Nil(json.Unmarshal(buf.Bytes(), &table))
+	assert.Equal(queryTable.Columns, table.Columns)
+	assert.Equal(1200.0, table.Rows[0][1])
+
+	assert.NotNil(queryTable.Write(&buf, "xml"))
+}
+
+func Test_QueryHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	rt := cmd.NewRuntime(&cmd.Config{
+		Queries: []cmd.QueryInfo{
+			{Name: "largest_tables", SQL: "select * from m_tables", Export: true},
+			{Name: "users", SQL: "select * from users"},
+		},
+	})
+	rt.Tenants = []*cmd.Tenant{{TenantInfo: cmd.TenantInfo{Name: "q01"}}}
+
+	for _, tc := range []struct {
+		url  string
+		code int
+	}{
+		{"/api/v1/query/largest_tables", http.StatusBadRequest},
+		{"/api/v1/query/?tenant=q01", http.StatusBadRequest},
+		{"/api/v1/query/largest_tables?tenant=q01&format=xml", http.StatusBadRequest},
+		{"/api/v1/query/users?tenant=q01", http.StatusNotFound},
+		{"/api/v1/query/unknown?tenant=q01", http.StatusNotFound},
+		{"/api/v1/query/largest_tables?tenant=q01", http.StatusNotFound}, // not connected
+	} {
+		w := httptest.NewRecorder()
+		rt.QueryHandler(w, httptest.NewRequest(http.MethodGet, tc.url, nil))
+		assert.Equal(tc.code, w.Code, tc.url)
+	}
+}
@@ -0,0 +1,444 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// default values of the remote write settings
+const (
+	defaultRemoteWriteInterval   = 60
+	defaultRemoteWriteTimeout    = 10
+	defaultRemoteWriteQueueSize  = 100
+	defaultRemoteWriteMaxRetries = 5
+	defaultRemoteWriteMaxBuffer  = 1000
+	defaultRemoteWriteMinBackoff = 500
+	defaultRemoteWriteMaxBackoff = 30000
+)
+
+// RemoteWriteInfo - Prometheus remote write endpoint
+type RemoteWriteInfo struct {
+	URL          string
+	Timeout      uint   // http timeout in seconds
+	QueueSize    uint   // write requests kept in memory
+	MaxRetries   uint   // retries of a failed write request
+	MinBackoffMs uint   // wait time before the first retry in milliseconds
+	MaxBackoffMs uint   // maximum wait time between two retries in milliseconds
+	BufferDir    string // directory for write requests that could not be sent
+	MaxBuffer    uint   // maximum number of buffered write requests
+}
+
+// RemoteWriter - queue and sender for one remote write endpoint
+type RemoteWriter struct {
+	info   RemoteWriteInfo
+	client *http.Client
+	queue  chan []byte
+
+	// the disk buffer holds requests older than the queue, as long as it is
+	// not empty new requests are buffered too to keep the samples in order
+	mu       sync.Mutex
+	buffered int
+	seq      int
+}
+
+// NewRemoteWriter - remote writer with defaults for unset values
+func NewRemoteWriter(info RemoteWriteInfo) (*RemoteWriter, error) {
+	if info.URL == "" {
+		return nil, errors.New("NewRemoteWriter(URL is missing)")
+	}
+	if info.Timeout == 0 {
+		info.Timeout = defaultRemoteWriteTimeout
+	}
+	if info.QueueSize == 0 {
+		info.QueueSize = defaultRemoteWriteQueueSize
+	}
+	if info.MaxRetries == 0 {
+		info.MaxRetries = defaultRemoteWriteMaxRetries
+	}
+	if info.MinBackoffMs == 0 {
+		info.MinBackoffMs = defaultRemoteWriteMinBackoff
+	}
+	if info.MaxBackoffMs == 0 {
+		info.MaxBackoffMs = defaultRemoteWriteMaxBackoff
+	}
+	if info.MaxBuffer == 0 {
+		info.MaxBuffer = defaultRemoteWriteMaxBuffer
+	}
+
+	w := RemoteWriter{
+		info:   info,
+		client: &http.Client{Timeout: time.Duration(info.Timeout) * time.Second},
+		queue:  make(chan []byte, info.QueueSize),
+	}
+
+	if info.BufferDir != "" {
+		if err := os.MkdirAll(info.BufferDir, 0755); err != nil {
+			return nil, errors.Wrap(err, "NewRemoteWriter(MkdirAll)")
+		}
+		files, err := w.bufferFiles()
+		if err != nil {
+			return nil, errors.Wrap(err, "NewRemoteWriter(bufferFiles)")
+		}
+		w.buffered = len(files)
+	}
+	return &w, nil
+}
+
+// Enqueue - encode metric data as write request and queue it for sending
+func (w *RemoteWriter) Enqueue(data []MetricData, ts time.Time) {
+	if len(data) == 0 {
+		return
+	}
+	payload := EncodeWriteRequest(data, ts)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.buffered > 0 {
+		w.bufferPayload(payload)
+		return
+	}
+	select {
+	case w.queue <- payload:
+	default:
+		if w.info.BufferDir != "" {
+			w.bufferPayload(payload)
+			return
+		}
+		log.WithField("url", w.info.URL).Warn("remote write queue full, write request dropped")
+	}
+}
+
+// Run - send queued and buffered write requests until ctx is done
+func (w *RemoteWriter) Run(ctx context.Context) {
+	for {
+		if w.hasBuffered() {
+			if !w.sendBuffered(ctx) {
+				return
+			}
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case payload := <-w.queue:
+			if err := w.send(ctx, payload); err != nil {
+				log.WithField("url", w.info.URL).WithError(err).Error("remote write failed")
+				if w.info.BufferDir == "" {
+					// the queue keeps filling up until the request is sent
+					if !w.resend(ctx, payload) {
+						return
+					}
+					continue
+				}
+				w.mu.Lock()
+				w.bufferPayload(payload)
+				w.drainQueue()
+				w.mu.Unlock()
+			}
+		}
+	}
+}
+
+// resend - send the write request again every MaxBackoffMs until it is sent,
+// false if ctx is done
+func (w *RemoteWriter) resend(ctx context.Context, payload []byte) bool {
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(w.maxBackoff()):
+		}
+		err := w.send(ctx, payload)
+		if ctx.Err() != nil {
+			return false
+		}
+		if err == nil {
+			return true
+		}
+		log.WithField("url", w.info.URL).WithError(err).Error("remote write failed")
+	}
+}
+
+// sendBuffered - send the oldest buffered write request, false if ctx is done
+func (w *RemoteWriter) sendBuffered(ctx context.Context) bool {
+	files, err := w.bufferFiles()
+	if err != nil || len(files) == 0 {
+		w.mu.Lock()
+		w.buffered = len(files)
+		w.mu.Unlock()
+		return true
+	}
+
+	payload, err := ioutil.ReadFile(files[0])
+	if err == nil {
+		err = w.send(ctx, payload)
+	} else {
+		log.WithField("file", files[0]).WithError(err).Error("remote write buffer not readable, file removed")
+		err = nil
+	}
+	if err != nil {
+		log.WithField("url", w.info.URL).WithError(err).Error("remote write of buffered request failed")
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(w.maxBackoff()):
+			return true
+		}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	os.Remove(files[0])
+	w.buffered--
+	return ctx.Err() == nil
+}
+
+// send - post one write request with retries and exponential backoff
+func (w *RemoteWriter) send(ctx context.Context, payload []byte) error {
+	var err error
+	for try := uint(0); try <= w.info.MaxRetries; try++ {
+		if try > 0 {
+			backoff := time.Duration(math.Pow(2, float64(try-1))*float64(w.info.MinBackoffMs)) * time.Millisecond
+			if backoff > w.maxBackoff() {
+				backoff = w.maxBackoff()
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(backoff):
+			}
+		}
+
+		var retry bool
+		retry, err = w.post(ctx, payload)
+		if err == nil {
+			return nil
+		}
+		if !retry {
+			// the endpoint will never accept the request
+			log.WithField("url", w.info.URL).WithError(err).Error("remote write request rejected and dropped")
+			return nil
+		}
+		log.WithField("url", w.info.URL).WithField("try", try+1).WithError(err).Warn("remote write failed, retrying")
+	}
+	return err
+}
+
+// post - one http request, retry is true for errors that may be temporary
+func (w *RemoteWriter) post(ctx context.Context, payload []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.info.URL, bytes.NewReader(payload))
+	if err != nil {
+		return false, errors.Wrap(err, "post(NewRequest)")
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "hana_sql_exporter")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, errors.Wrap(err, "post(Do)")
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+
+	if resp.StatusCode/100 == 2 {
+		return false, nil
+	}
+	err = errors.Errorf("post(status %s: %s)", resp.Status, strings.TrimSpace(string(body)))
+	return resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests, err
+}
+
+// maxBackoff - maximum wait time between two retries
+func (w *RemoteWriter) maxBackoff() time.Duration {
+	return time.Duration(w.info.MaxBackoffMs) * time.Millisecond
+}
+
+// hasBuffered - true, if the disk buffer holds write requests
+func (w *RemoteWriter) hasBuffered() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buffered > 0
+}
+
+// drainQueue - move all queued requests to the disk buffer, mu must be locked
+func (w *RemoteWriter) drainQueue() {
+	for {
+		select {
+		case payload := <-w.queue:
+			w.bufferPayload(payload)
+		default:
+			return
+		}
+	}
+}
+
+// bufferPayload - write request to the disk buffer, the oldest requests are
+// removed if MaxBuffer is exceeded, mu must be locked
+func (w *RemoteWriter) bufferPayload(payload []byte) {
+	if w.info.BufferDir == "" {
+		log.WithField("url", w.info.URL).Warn("remote write request dropped, no BufferDir configured")
+		return
+	}
+
+	w.seq++
+	name := fmt.Sprintf("%020d-%06d.snappy", time.Now().UnixNano(), w.seq%1000000)
+	tmp := filepath.Join(w.info.BufferDir, "."+name+".tmp")
+	if err := ioutil.WriteFile(tmp, payload, 0644); err != nil {
+		log.WithField("dir", w.info.BufferDir).WithError(err).Error("remote write buffer not writable, request dropped")
+		return
+	}
+	if err := os.Rename(tmp, filepath.Join(w.info.BufferDir, name)); err != nil {
+		os.Remove(tmp)
+		log.WithField("dir", w.info.BufferDir).WithError(err).Error("remote write buffer not writable, request dropped")
+		return
+	}
+	w.buffered++
+
+	files, err := w.bufferFiles()
+	if err != nil {
+		return
+	}
+	for len(files) > int(w.info.MaxBuffer) {
+		log.WithField("file", files[0]).Warn("remote write buffer full, oldest request dropped")
+		os.Remove(files[0])
+		files = files[1:]
+	}
+	w.buffered = len(files)
+}
+
+// bufferFiles - buffered write requests, oldest first
+func (w *RemoteWriter) bufferFiles() ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(w.info.BufferDir, "*.snappy"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// PushRemoteWrite - collect the metrics every RemoteWriteInterval seconds and
+// queue them for all remote write endpoints until ctx is done
+func (rt *Runtime) PushRemoteWrite(ctx context.Context) error {
+	var writers []*RemoteWriter
+	for _, info := range rt.Config.RemoteWrite {
+		w, err := NewRemoteWriter(info)
+		if err != nil {
+			return errors.Wrapf(err, "RemoteWrite(%s)", info.URL)
+		}
+		writers = append(writers, w)
+		go w.Run(ctx)
+	}
+
+	rt.collectEvery(ctx, rt.Config.RemoteWriteInterval, defaultRemoteWriteInterval, func(data []MetricData, ts time.Time) {
+		for _, w := range writers {
+			w.Enqueue(data, ts)
+		}
+	})
+	return nil
+}
+
+// collectEvery - collect the metrics immediately and then every interval
+// seconds (default if 0) and hand them to push until ctx is done. The push
+// exporters share their scrapes, a scrape younger than half the interval is
+// handed out again.
+func (rt *Runtime) collectEvery(ctx context.Context, interval, defaultInterval uint, push func(data []MetricData, ts time.Time)) {
+	if interval == 0 {
+		interval = defaultInterval
+	}
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		push(rt.sharedScrape(time.Duration(interval) * time.Second / 2))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// EncodeWriteRequest - snappy compressed protobuf prometheus.WriteRequest
+// with one sample per metric record
+func EncodeWriteRequest(data []MetricData, ts time.Time) []byte {
+	var req []byte
+	for _, md := range data {
+		for _, record := range md.Stats {
+			req = protowire.AppendTag(req, 1, protowire.BytesType)
+			req = protowire.AppendBytes(req, encodeTimeSeries(md.Name, record, ts))
+		}
+	}
+	return snappy.Encode(nil, req)
+}
+
+// prometheus.TimeSeries with labels sorted by name
+func encodeTimeSeries(name string, record MetricRecord, ts time.Time) []byte {
+	labels := [][2]string{{"__name__", name}}
+	for i := range record.Labels {
+		if i < len(record.LabelValues) && record.LabelValues[i] != "" {
+			labels = append(labels, [2]string{record.Labels[i], record.LabelValues[i]})
+		}
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i][0] < labels[j][0] })
+
+	var series []byte
+	for _, l := range labels {
+		var label []byte
+		label = protowire.AppendTag(label, 1, protowire.BytesType)
+		label = protowire.AppendString(label, l[0])
+		label = protowire.AppendTag(label, 2, protowire.BytesType)
+		label = protowire.AppendString(label, l[1])
+
+		series = protowire.AppendTag(series, 1, protowire.BytesType)
+		series = protowire.AppendBytes(series, label)
+	}
+
+	var sample []byte
+	sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+	sample = protowire.AppendFixed64(sample, math.Float64bits(record.Value))
+	sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+	sample = protowire.AppendVarint(sample, uint64(ts.UnixNano()/int64(time.Millisecond)))
+
+	series = protowire.AppendTag(series, 2, protowire.BytesType)
+	series = protowire.AppendBytes(series, sample)
+	return series
+}
+
+// pushScrape - last scrape of the push exporters
+type pushScrape struct {
+	mu   sync.Mutex
+	data []MetricData
+	ts   time.Time
+}
+
+// sharedScrape - the last scrape of the push exporters with its time, if it
+// is younger than maxAge, a new scrape otherwise. Concurrent callers wait for
+// the same scrape.
+func (rt *Runtime) sharedScrape(maxAge time.Duration) ([]MetricData, time.Time) {
+	rt.push.mu.Lock()
+	defer rt.push.mu.Unlock()
+	if rt.push.ts.IsZero() || time.Since(rt.push.ts) >= maxAge {
+		rt.push.ts = time.Now()
+		rt.push.data = rt.Scrape()
+	}
+	return rt.push.data, rt.push.ts
+}
@@ -0,0 +1,249 @@
+package cmd_test
+
+import (
+	"context"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/stretchr/testify/assert"
+	"github.com/ulranh/hana_sql_exporter/cmd"
+	"github.com/ulranh/hana_sql_exporter/internal/hdbmock"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// remoteWriteReceiver - remote write stand-in, the first failures requests fail
+type remoteWriteReceiver struct {
+	mu       sync.Mutex
+	failures int
+	samples  []string
+}
+
+func (rw *remoteWriteReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.failures > 0 {
+		rw.failures--
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if r.Header.Get("Content-Encoding") != "snappy" || r.Header.Get("Content-Type") != "application/x-protobuf" {
+		http.Error(w, "wrong headers", http.StatusBadRequest)
+		return
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	req, err := snappy.Decode(nil, body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rw.samples = append(rw.samples, decodeWriteRequest(req)...)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (rw *remoteWriteReceiver) received() []string {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	return append([]string{}, rw.samples...)
+}
+
+// samples of a WriteRequest as "name{label=value,...} value"
+func decodeWriteRequest(b []byte) []string {
+	var samples []string
+	for _, series := range protoFields(b, 1) {
+		var name string
+		var labels []string
+		for _, label := range protoFields(series, 1) {
+			key, value := string(protoFields(label, 1)[0]), string(protoFields(label, 2)[0])
+			if key == "__name__" {
+				name = value
+				continue
+			}
+			labels = append(labels, key+"="+value)
+		}
+		for _, sample := range protoFields(series, 2) {
+			_, _, l := protowire.ConsumeTag(sample)
+			v, _ := protowire.ConsumeFixed64(sample[l:])
+			samples = append(samples, name+"{"+strings.Join(labels, ",")+"} "+strconv.FormatFloat(math.Float64frombits(v), 'f', -1, 64))
+		}
+	}
+	return samples
+}
+
+// length delimited protobuf fields with the given number
+func protoFields(b []byte, num protowire.Number) [][]byte {
+	var res [][]byte
+	for len(b) > 0 {
+		n, typ, l := protowire.ConsumeTag(b)
+		b = b[l:]
+		if typ == protowire.BytesType && n == num {
+			v, _ := protowire.ConsumeBytes(b)
+			res = append(res, v)
+		}
+		b = b[protowire.ConsumeFieldValue(n, typ, b):]
+	}
+	return res
+}
+
+var remoteWriteData = []cmd.MetricData{
+	{
+		Name:       "hana_connections",
+		MetricType: "gauge",
+		Stats: []cmd.MetricRecord{
+			{Value: 3, Labels: []string{"tenant", "usage", "host"}, LabelValues: []string{"q01", "", "h1"}},
+			{Value: 1.5, Labels: []string{"tenant", "usage", "host"}, LabelValues: []string{"q01", "", "h2"}},
+		},
+	},
+}
+
+func Test_EncodeWriteRequest(t *testing.T) {
+	assert := assert.New(t)
+
+	req, err := snappy.Decode(nil, cmd.EncodeWriteRequest(remoteWriteData, time.Now()))
+	assert.Nil(err)
+	// labels sorted by name, empty labels dropped
+	assert.Equal([]string{
+		"hana_connections{host=h1,tenant=q01} 3",
+		"hana_connections{host=h2,tenant=q01} 1.5",
+	}, decodeWriteRequest(req))
+}
+
+func Test_RemoteWriterRetry(t *testing.T) {
+	assert := assert.New(t)
+
+	receiver := &remoteWriteReceiver{failures: 2}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	w, err := cmd.NewRemoteWriter(cmd.RemoteWriteInfo{URL: server.URL, MinBackoffMs: 10, MaxBackoffMs: 20})
+	assert.Nil(err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.Run(ctx)
+
+	w.Enqueue(remoteWriteData, time.Now())
+	assert.Eventually(func() bool { return len(receiver.received()) == 2 }, 2*time.Second, 10*time.Millisecond)
+}
+
+func Test_RemoteWriterBuffer(t *testing.T) {
+	assert := assert.New(t)
+
+	receiver := &remoteWriteReceiver{failures: 1000}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	dir := t.TempDir()
+	info := cmd.RemoteWriteInfo{URL: server.URL, MaxRetries: 1, MinBackoffMs: 1, MaxBackoffMs: 20, BufferDir: dir, MaxBuffer: 2}
+	w, err := cmd.NewRemoteWriter(info)
+	assert.Nil(err)
+	ctx, cancel := context.WithCancel(context.Background())
+	go w.Run(ctx)
+
+	// outage: requests are buffered, only the newest MaxBuffer are kept
+	for i := 0; i < 3; i++ {
+		w.Enqueue(remoteWriteData, time.Now())
+	}
+	assert.Eventually(func() bool {
+		files, _ := filepath.Glob(filepath.Join(dir, "*.snappy"))
+		return len(files) == 2
+	}, 2*time.Second, 10*time.Millisecond)
+	cancel()
+
+	// restart after the outage: the buffer is sent
+	receiver.mu.Lock()
+	receiver.failures = 0
+	receiver.mu.Unlock()
+
+	w, err = cmd.NewRemoteWriter(info)
+	assert.Nil(err)
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	go w.Run(ctx)
+
+	assert.Eventually(func() bool { return len(receiver.received()) == 4 }, 2*time.Second, 10*time.Millisecond)
+	assert.Eventually(func() bool {
+		files, _ := filepath.Glob(filepath.Join(dir, "*.snappy"))
+		return len(files) == 0
+	}, 2*time.Second, 10*time.Millisecond)
+}
+
+func Test_RemoteWriterOutage(t *testing.T) {
+	assert := assert.New(t)
+
+	receiver := &remoteWriteReceiver{failures: 1000}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	// without BufferDir the queued requests survive the outage, requests
+	// beyond QueueSize are dropped
+	w, err := cmd.NewRemoteWriter(cmd.RemoteWriteInfo{URL: server.URL, QueueSize: 2, MaxRetries: 1, MinBackoffMs: 1, MaxBackoffMs: 20})
+	assert.Nil(err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.Run(ctx)
+
+	w.Enqueue(remoteWriteData, time.Now())
+	time.Sleep(50 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		w.Enqueue(remoteWriteData, time.Now())
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	receiver.mu.Lock()
+	receiver.failures = 0
+	receiver.mu.Unlock()
+
+	assert.Eventually(func() bool { return len(receiver.received()) == 6 }, 2*time.Second, 10*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(6, len(receiver.received()))
+}
+
+func Test_SharedPushScrape(t *testing.T) {
+	assert := assert.New(t)
+
+	drv, err := hdbmock.Register(append([]hdbmock.Rule{
+		{SQL: `m_service_memory`, Columns: []string{"SERVICE_NAME", "USED"}, Rows: [][]interface{}{{"indexserver", int64(10)}}},
+	}, metadataRules...)...)
+	assert.Nil(err)
+
+	receiver := &remoteWriteReceiver{}
+	rwServer := httptest.NewServer(receiver)
+	defer rwServer.Close()
+	var exports int32
+	otlpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&exports, 1)
+	}))
+	defer otlpServer.Close()
+
+	config := e2eConfig(t)
+	config.Tenants = config.Tenants[:1]
+	config.Metrics = []cmd.MetricInfo{
+		{Name: "hana_service_used", Help: "used", MetricType: "gauge", SQL: "select service_name, used from <SCHEMA>.m_service_memory", ValueColumn: "used", Labels: []string{"service_name"}, SchemaFilter: []string{"sys"}},
+	}
+	config.RemoteWrite = []cmd.RemoteWriteInfo{{URL: rwServer.URL}}
+	config.OTLP = []cmd.OTLPInfo{{Endpoint: otlpServer.URL}}
+
+	rt := cmd.NewRuntime(config)
+	rt.SQLDriver = drv.Name()
+	assert.Nil(rt.Connect())
+	defer rt.Close()
+
+	// remote write and OTLP push the same scrape
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go rt.PushRemoteWrite(ctx)
+	go rt.PushOTLP(ctx)
+	assert.Eventually(func() bool {
+		return len(receiver.received()) > 0 && atomic.LoadInt32(&exports) > 0
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(1, executed(drv, "m_service_memory"))
+}
@@ -0,0 +1,277 @@
+package cmd
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/ulranh/hana_sql_exporter/internal"
+)
+
+const (
+	roleSecondary         = "secondary"
+	replicationRoleMetric = "hana_sql_exporter_replication_role"
+	reconnectInterval     = 60 * time.Second // wait time after a reconnect without primary site
+)
+
+// system replication role of the connected site: the hosts of
+// M_SYSTEM_REPLICATION are the primary hosts, the secondary hosts are the
+// replicating ones
+const replicationRoleSelect = `SELECT CASE
+WHEN EXISTS (SELECT 1 FROM sys.m_system_replication r, sys.m_database d WHERE r.host = d.host) THEN 'primary'
+WHEN EXISTS (SELECT 1 FROM sys.m_system_replication r, sys.m_database d WHERE r.secondary_host = d.host) THEN 'secondary'
+ELSE 'none'
+END role FROM dummy`
+
+// sites - connections to the system replication sites of a tenant, they
+// change after a takeover
+type sites struct {
+	mu            sync.RWMutex
+	primary       *sql.DB
+	primaryHost   string
+	primaryRole   string
+	secondary     *sql.DB
+	secondaryHost string
+	retry         time.Time // no reconnect before, set if no primary site was found
+	checking      bool      // a check of the sites is running
+	closed        bool
+}
+
+// close - close the connections of all sites
+func (s *sites) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.primary != nil {
+		s.primary.Close()
+	}
+	if s.secondary != nil {
+		s.secondary.Close()
+	}
+	s.primary, s.secondary = nil, nil
+	s.closed = true
+}
+
+// hosts - connection strings of all sites of the tenant
+func (tenant *Tenant) hosts() []string {
+	return append([]string{tenant.ConnStr}, tenant.Hosts...)
+}
+
+// secondarySite - the tenant with the connection to the secondary site, nil
+// if there is none
+func (tenant *Tenant) secondarySite() *Tenant {
+	if tenant.sites == nil {
+		return nil
+	}
+	tenant.sites.mu.RLock()
+	defer tenant.sites.mu.RUnlock()
+	if tenant.sites.secondary == nil {
+		return nil
+	}
+	site := *tenant
+	site.sites = nil
+	site.conn = tenant.sites.secondary
+	return &site
+}
+
+// secondarySites - the tenants with a connection to a secondary site
+func secondarySites(tenants []*Tenant) []*Tenant {
+	var sites []*Tenant
+	for _, tenant := range tenants {
+		if site := tenant.secondarySite(); site != nil {
+			sites = append(sites, site)
+		}
+	}
+	return sites
+}
+
+// secondary - true, if the select runs on the secondary site
+func (query QueryInfo) secondary() bool {
+	return low(query.Site) == roleSecondary
+}
+
+// replicationRole - system replication role of the connected site
+func replicationRole(ctx context.Context, db *sql.DB) (string, error) {
+	var role string
+	if err := db.QueryRowContext(ctx, replicationRoleSelect).Scan(&role); err != nil {
+		return "", errors.Wrap(err, "replicationRole(Scan)")
+	}
+	return low(role), nil
+}
+
+// connectedSite - connection and replication role of one host
+type connectedSite struct {
+	db   *sql.DB
+	role string
+}
+
+// connectSites - connect all hosts of the tenant at the same time, each with
+// the timeout of the config. The first site in the order of the hosts that is
+// not a secondary becomes the primary, so a hanging host doesn't delay the
+// others. A secondary site is only kept, if there are secondary queries.
+func (rt *Runtime) connectSites(ctx context.Context, tenant *Tenant, secretMap internal.Secret) *sites {
+	hosts := tenant.hosts()
+	connected := make([]connectedSite, len(hosts))
+	var wg sync.WaitGroup
+	for i, host := range hosts {
+		wg.Add(1)
+		go func(i int, host string) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, time.Duration(rt.Config.Timeout)*time.Second)
+			defer cancel()
+
+			logFields := log.Fields{"tenant": tenant.Name, "host": host}
+			db := rt.getConnection(ctx, tenant, host, secretMap)
+			if db == nil {
+				return
+			}
+			role, err := replicationRole(ctx, db)
+			if err != nil {
+				log.WithFields(logFields).WithError(err).Error("can't read system replication role")
+				db.Close()
+				return
+			}
+			TenantLog(logFields).WithField("role", role).Debug("system replication site connected")
+			connected[i] = connectedSite{db: db, role: role}
+		}(i, host)
+	}
+	wg.Wait()
+
+	s := &sites{}
+	for i, site := range connected {
+		switch {
+		case site.db == nil:
+		case site.role != roleSecondary && s.primary == nil:
+			s.primary, s.primaryHost, s.primaryRole = site.db, hosts[i], site.role
+		case site.role == roleSecondary && s.secondary == nil && rt.Config.secondaryQueries():
+			s.secondary, s.secondaryHost = site.db, hosts[i]
+		default:
+			site.db.Close()
+		}
+	}
+	return s
+}
+
+// secondaryQueries - true, if a query runs on the secondary site
+func (config *Config) secondaryQueries() bool {
+	for _, query := range config.Queries {
+		if query.secondary() && !query.Disabled {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckReplication - start a check of the sites of all tenants with Hosts
+// and return the replication role metric of the connected sites. The checks
+// run in the background, so a hanging site doesn't delay the scrape, the
+// roles after a takeover are reported by the next scrape.
+func (rt *Runtime) CheckReplication(ctx context.Context) MetricData {
+	md := MetricData{
+		Name:       replicationRoleMetric,
+		Help:       "System replication role of the connected sites of the tenant",
+		MetricType: "gauge",
+	}
+
+	for _, tenant := range rt.tenantList() {
+		if tenant.sites == nil {
+			continue
+		}
+		s := tenant.sites
+		s.mu.Lock()
+		if !s.checking && !s.closed {
+			s.checking = true
+			go rt.checkSites(tenant)
+		}
+		if s.primary != nil {
+			md.Stats = append(md.Stats, tenant.roleRecord(s.primaryHost, s.primaryRole))
+		}
+		if s.secondary != nil {
+			md.Stats = append(md.Stats, tenant.roleRecord(s.secondaryHost, roleSecondary))
+		}
+		s.mu.Unlock()
+	}
+	return md
+}
+
+// checkSites - check the role of the primary site of the tenant and
+// reconnect the tenant, if the site became a secondary or is not reachable.
+// After a reconnect without primary site the next one is tried after
+// reconnectInterval.
+func (rt *Runtime) checkSites(tenant *Tenant) {
+	s := tenant.sites
+	defer func() {
+		s.mu.Lock()
+		s.checking = false
+		s.mu.Unlock()
+	}()
+	s.mu.RLock()
+	primary, primaryHost, retry := s.primary, s.primaryHost, s.retry
+	s.mu.RUnlock()
+
+	var role string
+	if primary != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(rt.Config.Timeout)*time.Second)
+		var err error
+		role, err = replicationRole(ctx, primary)
+		cancel()
+		if err != nil {
+			TenantLog(log.Fields{"tenant": tenant.Name, "host": primaryHost}).WithError(err).Warn("primary site not available")
+		}
+	}
+	if (role != "" && role != roleSecondary) || time.Now().Before(retry) {
+		return
+	}
+
+	TenantLog(log.Fields{"tenant": tenant.Name, "host": primaryHost, "role": role}).Warn("takeover detected, reconnecting tenant")
+	secretMap, err := rt.Config.GetSecretMap()
+	if err != nil {
+		log.WithField("tenant", tenant.Name).WithError(err).Error("can't reconnect tenant")
+		return
+	}
+	rt.switchSites(tenant, rt.connectSites(context.Background(), tenant, secretMap))
+}
+
+// switchSites - use the newly connected sites and close the old connections
+func (rt *Runtime) switchSites(tenant *Tenant, connected *sites) {
+	s := tenant.sites
+	s.mu.Lock()
+	if s.closed {
+		// the tenant was removed while it was reconnected
+		s.mu.Unlock()
+		connected.close()
+		return
+	}
+	oldPrimary, oldSecondary := s.primary, s.secondary
+	s.primary, s.primaryHost, s.primaryRole = connected.primary, connected.primaryHost, connected.primaryRole
+	s.secondary, s.secondaryHost = connected.secondary, connected.secondaryHost
+	s.retry = time.Time{}
+	if connected.primary == nil {
+		s.retry = time.Now().Add(reconnectInterval)
+	}
+	s.mu.Unlock()
+
+	if oldPrimary != nil {
+		oldPrimary.Close()
+	}
+	if oldSecondary != nil {
+		oldSecondary.Close()
+	}
+	if connected.primary == nil {
+		rt.status.recordTenant(tenant, errors.New("no primary site available"))
+		return
+	}
+	TenantLog(log.Fields{"tenant": tenant.Name, "host": connected.primaryHost}).Info("tenant reconnected to the primary site")
+	rt.status.recordTenant(tenant, nil)
+}
+
+// roleRecord - replication role record of one site of the tenant
+func (tenant *Tenant) roleRecord(host, role string) MetricRecord {
+	return MetricRecord{
+		Value:       1,
+		Labels:      []string{"tenant", "host", "role"},
+		LabelValues: []string{low(tenant.Name), host, role},
+	}
+}
@@ -0,0 +1,141 @@
+package cmd_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ulranh/hana_sql_exporter/cmd"
+	"github.com/ulranh/hana_sql_exporter/internal/hdbmock"
+)
+
+// system replication roles of the hosts q01a and q01b
+func roleRules(roleA, roleB string) []hdbmock.Rule {
+	return []hdbmock.Rule{
+		{DSN: "q01a", SQL: `m_system_replication`, Columns: []string{"ROLE"}, Rows: [][]interface{}{{roleA}}},
+		{DSN: "q01b", SQL: `m_system_replication`, Columns: []string{"ROLE"}, Rows: [][]interface{}{{roleB}}},
+		{DSN: "q01a", SQL: `m_replica_state`, Columns: []string{"STATE"}, Rows: [][]interface{}{{int64(1)}}},
+		{DSN: "q01b", SQL: `m_replica_state`, Columns: []string{"STATE"}, Rows: [][]interface{}{{int64(2)}}},
+	}
+}
+
+// label values of the records of the metric by host, the value for the
+// query metric
+func siteValues(data []cmd.MetricData, name string) map[string]interface{} {
+	values := make(map[string]interface{})
+	for _, md := range data {
+		if md.Name != name {
+			continue
+		}
+		for _, record := range md.Stats {
+			host := ""
+			role := ""
+			for i, label := range record.Labels {
+				switch label {
+				case "host":
+					host = record.LabelValues[i]
+				case "role":
+					role = record.LabelValues[i]
+				}
+			}
+			if role != "" {
+				values[host] = role
+			} else {
+				values[name] = record.Value
+			}
+		}
+	}
+	return values
+}
+
+func Test_Replication(t *testing.T) {
+	assert := assert.New(t)
+
+	drv, err := hdbmock.Register(append(roleRules("primary", "secondary"), metadataRules...)...)
+	assert.Nil(err)
+
+	config := &cmd.Config{
+		Tenants: []cmd.TenantInfo{
+			{Name: "q01", ConnStr: "q01a:30015", Hosts: []string{"q01b:30015"}, User: "monitor"},
+		},
+		Queries: []cmd.QueryInfo{
+			{SQL: "select state from sys.m_replica_state", Site: "secondary", SchemaFilter: []string{"sys"}, Metrics: []cmd.QueryMetricInfo{
+				{Name: "hana_replica_state", Help: "replica state", MetricType: "gauge", ValueColumn: "state"},
+			}},
+		},
+		Timeout: 2,
+	}
+	config.Secret, err = config.AddSecret("q01", []byte("secret"))
+	assert.Nil(err)
+
+	rt := cmd.NewRuntime(config)
+	rt.SQLDriver = drv.Name()
+	assert.Nil(rt.Connect())
+	defer rt.Close()
+
+	// the secondary query runs on q01b
+	data := rt.Scrape()
+	assert.Equal(map[string]interface{}{"q01a:30015": "primary", "q01b:30015": "secondary"}, siteValues(data, "hana_sql_exporter_replication_role"))
+	assert.Equal(map[string]interface{}{"hana_replica_state": float64(2)}, siteValues(data, "hana_replica_state"))
+
+	// takeover: q01b is the new primary, the sites are reconnected in the
+	// background
+	assert.Nil(drv.Replace(append(roleRules("secondary", "primary"), metadataRules...)...))
+	assert.Eventually(func() bool {
+		data = rt.Scrape()
+		return siteValues(data, "hana_sql_exporter_replication_role")["q01b:30015"] == "primary"
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(map[string]interface{}{"q01a:30015": "secondary", "q01b:30015": "primary"}, siteValues(data, "hana_sql_exporter_replication_role"))
+	assert.Equal(map[string]interface{}{"hana_replica_state": float64(1)}, siteValues(data, "hana_replica_state"))
+}
+
+func Test_ReplicationUnreachable(t *testing.T) {
+	assert := assert.New(t)
+
+	drv, err := hdbmock.Register(append(roleRules("primary", "secondary"), metadataRules...)...)
+	assert.Nil(err)
+
+	config := &cmd.Config{
+		Tenants: []cmd.TenantInfo{
+			{Name: "q01", ConnStr: "q01a:30015", Hosts: []string{"q01b:30015"}, User: "monitor"},
+		},
+		Timeout: 1,
+	}
+	config.Secret, err = config.AddSecret("q01", []byte("secret"))
+	assert.Nil(err)
+
+	rt := cmd.NewRuntime(config)
+	rt.SQLDriver = drv.Name()
+	assert.Nil(rt.Connect())
+	defer rt.Close()
+
+	// q01a hangs and q01b took over: the scrapes don't wait for q01a and the
+	// tenant is reconnected to q01b
+	assert.Nil(drv.Replace(append([]hdbmock.Rule{
+		{DSN: "q01a", SQL: `m_system_replication|` + hdbmock.Ping, Delay: time.Minute},
+	}, append(roleRules("secondary", "primary"), metadataRules...)...)...))
+	start := time.Now()
+	rt.Scrape()
+	assert.True(time.Since(start) < 500*time.Millisecond)
+	assert.Eventually(func() bool {
+		return siteValues(rt.Scrape(), "hana_sql_exporter_replication_role")["q01b:30015"] == "primary"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// both sites are down: the next reconnect waits
+	assert.Nil(drv.Replace(append([]hdbmock.Rule{
+		{SQL: `m_system_replication|` + hdbmock.Ping, Err: errors.New("connection refused")},
+	}, metadataRules...)...))
+	assert.Eventually(func() bool {
+		rt.Scrape()
+		status := rt.Status()
+		return len(status.Tenants) == 1 && status.Tenants[0].Error == "no primary site available"
+	}, 5*time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	selects := executed(drv, "m_system_replication")
+	for i := 0; i < 3; i++ {
+		rt.Scrape()
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(selects, executed(drv, "m_system_replication"))
+}
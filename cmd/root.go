@@ -15,37 +15,31 @@
 package cmd
 
 import (
-	"database/sql"
 	"fmt"
 	"os"
 	"strings"
-	"time"
 
-	// _ "github.com/SAP/go-hdb/driver"
-	goHdbDriver "github.com/SAP/go-hdb/driver"
 	homedir "github.com/mitchellh/go-homedir"
 	"github.com/pkg/errors"
-	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
-	"github.com/ulranh/hana_sql_exporter/internal"
 )
 
 // TenantInfo - tennant data
 type TenantInfo struct {
-	Name           string
-	Tags           []string
-	ConnStr        string
-	User           string
-	Usage          string
-	Schemas        []string
-	conn           *sql.DB
-	SID            string
-	InstanceNumber string
-	DatabaseName   string
-	Version        string
-	Config         *Config
-	Index 			int
+	Name              string
+	Tags              []string
+	ConnStr           string
+	Hosts             []string // connection strings of further system replication sites
+	User              string
+	Usage             string
+	Schemas           []string
+	SystemDB          bool              // system database, its tenant databases are discovered
+	Template          string            // tenant entry with user, tags, schemas and password of the discovered tenants
+	Exclude           []string          // tenant databases that are not discovered
+	DiscoveryInterval uint              // seconds between two discoveries
+	Vars              map[string]string // values of the {{.Vars.<name>}} template variables of the selects
+	LogLevel          string            // log level of the entries of the tenant, LogLevel of the config if empty
 }
 
 // MetricInfo - metric data
@@ -60,7 +54,9 @@ type MetricInfo struct {
 	VersionFilter string
 	ValueColumn   string
 	Unit          string
-	Disabled      bool // 新增Disabled字段
+	States        []string // allowed states of a stateset metric
+	Disabled      bool     // 新增Disabled字段
+	KeyColumn     string   // increasing column of incremental counters, the select reads the rows after {{.LastKey}}
 }
 
 // QueryMetricInfo - 每个SQL查询中的单个指标定义
@@ -71,32 +67,58 @@ type QueryMetricInfo struct {
 	ValueColumn string
 	Unit        string
 	Labels      []string
+	States      []string // allowed states of a stateset metric
 	Disabled    bool
 }
 
 // QueryInfo - 查询定义，一个SQL对应多个指标
 type QueryInfo struct {
-	SQL           string
-	TagFilter     []string
-	SchemaFilter  []string
-	Metrics       []QueryMetricInfo
-	VersionFilter string
-	Disabled      bool // 新增Disabled字段
+	SQL            string
+	TagFilter      []string
+	SchemaFilter   []string
+	Metrics        []QueryMetricInfo
+	VersionFilter  string
+	Disabled       bool   // 新增Disabled字段
+	Name           string // name for /api/v1/query and the query command
+	Export         bool   // rows can be read with /api/v1/query and the query command
+	Scope          string // tenant (default) or systemdb: the select runs once per system database
+	DatabaseColumn string // column with the database name of the rows of systemdb queries
+	Site           string // primary (default) or secondary: the system replication site the select runs on
+	KeyColumn      string // increasing column of incremental counters, the select reads the rows after {{.LastKey}}
 }
 
-// Config struct with config file infos
+// Config struct with config file infos. It is not changed while collecting,
+// connections and collection state are kept in a Runtime.
 type Config struct {
-	Secret        []byte
-	Tenants       []TenantInfo
-	Metrics       []MetricInfo // 原有的单指标配置
-	Queries       []QueryInfo  // 新增的多指标查询配置
-	DataFunc      func(mPos, tPos int) []MetricRecord `mapstructure:"-"`
-	QueryDataFunc func(qPos, tPos int) []MetricData  `mapstructure:"-"`// 新增的多指标数据获取函数
-	Timeout       uint
-	Ip			  string
-	Port          string
-	LogLevel      string
-	LogFile       string
+	Secret                []byte
+	Tenants               []TenantInfo
+	Metrics               []MetricInfo // 原有的单指标配置
+	Queries               []QueryInfo  // 新增的多指标查询配置
+	Include               []string     // built-in metric packs, e.g. "hana:core", and config files, e.g. "conf.d/*.toml"
+	EnableMetrics         []string     // metric names to enable
+	DisableMetrics        []string     // metric names to disable
+	Timeout               uint
+	Ip                    string
+	Port                  string
+	LogLevel              string
+	LogFile               string
+	LogFormat             string            // logfmt or json
+	LogMaxSize            *uint             // megabytes of the log file before it is rotated, 100 if unset, 0: no limit
+	LogRotateInterval     uint              // seconds between two rotations of the log file, 0: not rotated by time
+	LogMaxBackups         *uint             // number of rotated log files that are kept, 7 if unset, 0: all
+	LogMaxAge             uint              // days rotated log files are kept, 0: no limit
+	ReadyMinTenants       *uint             // minimum number of connected tenants for /health/ready, 1 if unset, 0: not checked
+	ReadyTenants          []string          // tenants that must be connected for /health/ready
+	ReadyMaxScrapeAge     uint              // maximum age in seconds of the last successful scrape, 0: not checked
+	RemoteWrite           []RemoteWriteInfo // Prometheus remote write endpoints
+	RemoteWriteInterval   uint              // seconds between two remote write collections
+	OTLP                  []OTLPInfo        // OpenTelemetry collector endpoints
+	OTLPInterval          uint              // seconds between two OTLP collections
+	DisableMetricsHandler bool              // don't serve /metrics, e.g. if only OTLP is used
+	FileSD                []FileSDInfo      // tenant inventories in file_sd format
+	HTTPSD                []HTTPSDInfo      // tenant inventories polled from http endpoints
+	StateFile             string            // json file with the high-water marks and counters of incremental selects
+	StateDir              string            // directory of the state store, used instead of StateFile
 	// versionCache  map[int]string // 用于缓存每个tenant的版本信息
 	// versionMutex  sync.RWMutex   // 用于保护版本缓存的并发访问
 }
@@ -124,7 +146,8 @@ func Execute() {
 func init() {
 	cobra.OnInitialize(initConfig)
 
-	RootCmd.PersistentFlags().StringVarP(&cfgFile, "config", "c", "", "config file (default is $HOME/.hana_sql_exporter.toml)")
+	RootCmd.PersistentFlags().StringVarP(&cfgFile, "config", "c", "", "config file in toml, yaml or json format (default is $HOME/.hana_sql_exporter.toml)")
+	RootCmd.PersistentFlags().StringArrayVar(&setValues, "set", nil, "override a config value, e.g. --set timeout=5 --set tenants.q01.connstr=host:30041")
 
 }
 
@@ -140,27 +163,53 @@ func initConfig() {
 			exit("Homedir can't be found: ", err)
 		}
 
-		// Search config in home directory with name ".hana_sql_exporter" (without extension).
+		// Search config in home directory with name ".hana_sql_exporter" and
+		// one of the extensions toml, yaml, yml or json.
 		viper.AddConfigPath(home)
-		viper.SetConfigType("toml")
-		viper.SetConfigName(".hana_sql_exporter.toml")
+		viper.SetConfigName(".hana_sql_exporter")
 	}
 
-	// viper.AutomaticEnv() // read in environment variables that match
+	// environment variables (HANA_SQL_EXPORTER_*) are applied in getConfig
+}
+
+// read and unmarshal configfile into Config struct and apply includes,
+// overrides and metric packs
+func getConfig() (*Config, error) {
+	config, err := getFileConfig()
+	if err != nil {
+		return nil, errors.Wrap(err, "getConfig(getFileConfig)")
+	}
+
+	if err := config.ApplyIncludeOverride(os.Environ(), setValues); err != nil {
+		return nil, errors.Wrap(err, "getConfig(ApplyIncludeOverride)")
+	}
+
+	if err := config.ApplyIncludes(viper.ConfigFileUsed()); err != nil {
+		return nil, errors.Wrap(err, "getConfig(ApplyIncludes)")
+	}
+
+	if err := config.ApplyOverrides(os.Environ(), setValues); err != nil {
+		return nil, errors.Wrap(err, "getConfig(ApplyOverrides)")
+	}
+
+	if err := config.ApplyMetricPacks(); err != nil {
+		return nil, errors.Wrap(err, "getConfig(ApplyMetricPacks)")
+	}
 
+	return config, nil
 }
 
 // read and unmarshal configfile into Config struct
-func getConfig() (*Config, error) {
+func getFileConfig() (*Config, error) {
 	var config Config
 
 	// If a config file is found, read it in.
 	if err := viper.ReadInConfig(); err != nil {
-		return nil, errors.Wrap(err, "getConfig(ReadInConfig)")
+		return nil, errors.Wrap(err, "getFileConfig(ReadInConfig)")
 	}
 
 	if err := viper.Unmarshal(&config); err != nil {
-		return nil, errors.Wrap(err, "getConfig(Unmarshal)")
+		return nil, errors.Wrap(err, "getFileConfig(Unmarshal)")
 	}
 
 	return &config, nil
@@ -172,54 +221,6 @@ func exit(msg string, err error) {
 	os.Exit(1)
 }
 
-// prepare, establish, check and return connection to hana db
-func (config *Config) getConnection(tId int, secretMap internal.Secret) *sql.DB {
-
-	pw, err := GetPassword(secretMap, config.Tenants[tId].Name)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"tenant": config.Tenants[tId].Name,
-		}).Error("Cannot find password for tenant.")
-		return nil
-	}
-	db := config.dbConnect(tId, pw)
-	if db == nil {
-		log.WithFields(log.Fields{
-			"tenant": config.Tenants[tId].Name,
-		}).Error("Can't get connection.")
-		return nil
-	}
-	// defer db.Close()
-
-	if err := db.Ping(); err != nil {
-		log.WithFields(log.Fields{
-			"tenant": config.Tenants[tId].Name,
-		}).Error("Cannot ping tenant:" + err.Error())
-		return nil
-	}
-	return db
-}
-
-// connect to hana db
-func (config *Config) dbConnect(tId int, pw string) *sql.DB {
-
-	connector, err := goHdbDriver.NewDSNConnector("hdb://" + config.Tenants[tId].User + ":" + pw + "@" + config.Tenants[tId].ConnStr)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"tenant": config.Tenants[tId].Name,
-		}).Error(err.Error())
-		return nil
-	}
-	connector.SetTimeout(time.Duration(config.Timeout) * time.Second)
-
-	db := sql.OpenDB(connector)
-	db.SetMaxOpenConns(25)
-	db.SetMaxIdleConns(25)
-	db.SetConnMaxLifetime(5 * time.Minute)
-
-	return db
-}
-
 func low(str string) string {
 	return strings.TrimSpace(strings.ToLower(str))
 }
@@ -1,6 +1,10 @@
 package cmd_test
 
-import "github.com/ulranh/hana_sql_exporter/cmd"
+import (
+	"context"
+
+	"github.com/ulranh/hana_sql_exporter/cmd"
+)
 
 func getTestConfig(mCnt, tCnt int) *cmd.Config {
 	mi := []cmd.MetricInfo{
@@ -52,3 +56,39 @@ func getTestConfig(mCnt, tCnt int) *cmd.Config {
 	}
 	return &config
 }
+
+// getTestRuntime - runtime with the tenants of getTestConfig as connected
+// tenants and the testCollector
+func getTestRuntime(mCnt, tCnt int) *cmd.Runtime {
+	config := getTestConfig(mCnt, tCnt)
+	rt := cmd.NewRuntime(config)
+	rt.Collector = testCollector{}
+	for _, info := range config.Tenants {
+		rt.Tenants = append(rt.Tenants, &cmd.Tenant{TenantInfo: info})
+	}
+	return rt
+}
+
+// testCollector - one record with the value 999 per metric and tenant, no
+// records if empty is set
+type testCollector struct {
+	empty bool
+}
+
+func (c testCollector) Collect(ctx context.Context, tenant *cmd.Tenant, query cmd.QueryInfo) ([]cmd.MetricData, error) {
+	if c.empty {
+		return nil, nil
+	}
+	var data []cmd.MetricData
+	for _, metric := range query.Metrics {
+		data = append(data, cmd.MetricData{
+			Name:       metric.Name,
+			Help:       metric.Help,
+			MetricType: metric.MetricType,
+			Stats: []cmd.MetricRecord{
+				{Value: 999, Labels: []string{"l_" + metric.Name}, LabelValues: []string{"lv_" + tenant.Name}},
+			},
+		})
+	}
+	return data, nil
+}
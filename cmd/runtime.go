@@ -0,0 +1,409 @@
+package cmd
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	goHdbDriver "github.com/SAP/go-hdb/driver"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/ulranh/hana_sql_exporter/internal"
+)
+
+// Collector - collects the metrics of one query for one tenant
+type Collector interface {
+	Collect(ctx context.Context, tenant *Tenant, query QueryInfo) ([]MetricData, error)
+}
+
+// Tenant - connected tenant: a copy of its TenantInfo with the granted
+// schemas, the database metadata and the connection
+type Tenant struct {
+	TenantInfo
+	SID            string
+	InstanceNumber string
+	DatabaseName   string
+	Version        string
+	conn           *sql.DB
+	sites          *sites     // system replication sites, if Hosts are configured
+	abapSchemas    []string   // schemas with ABAP tables, the @abap schema filter
+	secret         string     // name of the password entry, Name if empty
+	source         string     // discovery source of the tenant, empty for configured tenants
+	origin         TenantInfo // tenant as delivered by the source, before it was connected
+}
+
+// DB - database connection of the tenant, the primary site with system
+// replication
+func (tenant *Tenant) DB() *sql.DB {
+	if tenant.sites != nil {
+		tenant.sites.mu.RLock()
+		defer tenant.sites.mu.RUnlock()
+		return tenant.sites.primary
+	}
+	return tenant.conn
+}
+
+// close - close the connections of the tenant
+func (tenant *Tenant) close() {
+	if tenant.conn != nil {
+		tenant.conn.Close()
+	}
+	if tenant.sites != nil {
+		tenant.sites.close()
+	}
+}
+
+// secretName - name of the password entry of the tenant
+func (tenant *Tenant) secretName() string {
+	if tenant.secret != "" {
+		return tenant.secret
+	}
+	return tenant.Name
+}
+
+// Runtime - connected tenants and collection state of a Config. The Config
+// itself is only read, so one Config can be shared by several runtimes.
+type Runtime struct {
+	Config    *Config
+	Tenants   []*Tenant // connected tenants
+	Collector Collector // SQLCollector, if not set
+	SQLDriver string    // database/sql driver used instead of go-hdb, e.g. by tests
+	status    *statusStore
+	counters  *counterStore // states of the incremental selects
+	state     *stateStore   // store of StateDir, nil without StateDir
+	push      pushScrape    // scrape shared by remote write and OTLP
+	pending   []TenantInfo  // configured tenants not connected yet, see RetryTenants
+
+	mu      sync.RWMutex // protects Tenants while tenants are discovered
+	closed  bool
+	pinging bool // checkTenants is running
+}
+
+// NewRuntime - runtime for the config, the tenants are connected by Connect
+func NewRuntime(config *Config) *Runtime {
+	return &Runtime{
+		Config:    config,
+		Collector: SQLCollector{},
+		status:    newStatusStore(),
+		counters:  newCounterStore(config.StateFile),
+	}
+}
+
+// collector - the configured collector or the SQLCollector
+func (rt *Runtime) collector() Collector {
+	if rt.Collector == nil {
+		return SQLCollector{}
+	}
+	return rt.Collector
+}
+
+// Close - save the counters of the incremental selects, close the state store
+// and all tenant connections
+func (rt *Runtime) Close() {
+	if err := rt.counters.save(); err != nil {
+		log.WithError(err).Error("can't save state")
+	}
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if err := rt.state.close(); err != nil {
+		log.WithError(err).Error("can't close state store")
+	}
+	rt.state = nil
+	if rt.counters != nil {
+		rt.counters.state = nil
+	}
+	rt.closed = true
+	for _, tenant := range rt.Tenants {
+		tenant.close()
+	}
+}
+
+// tenantList - snapshot of the connected tenants
+func (rt *Runtime) tenantList() []*Tenant {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	return append([]*Tenant(nil), rt.Tenants...)
+}
+
+// FindTenant - connected tenant with the name or nil
+func (rt *Runtime) FindTenant(name string) *Tenant {
+	for _, tenant := range rt.tenantList() {
+		if low(tenant.Name) == low(name) {
+			return tenant
+		}
+	}
+	return nil
+}
+
+// reconcile - replace the tenants of the discovery source by the wanted
+// tenants: unchanged tenants are kept, new and changed ones are connected and
+// the remaining ones closed. The tenants of the source follow the tenant after
+// or are appended, if after is nil. Configured tenants and tenants of other
+// sources take precedence, tenants with the name of a tenant of another source
+// are skipped and returned as error. The tenants of the source are saved in
+// the state store for restoreDiscovered.
+func (rt *Runtime) reconcile(source string, wanted []*Tenant, after *Tenant) error {
+	secretMap, err := rt.Config.GetSecretMap()
+	if err != nil {
+		return errors.Wrap(err, "reconcile(GetSecretMap)")
+	}
+
+	current := make(map[string]*Tenant)
+	for _, tenant := range rt.tenantList() {
+		if tenant.source == source {
+			current[low(tenant.Name)] = tenant
+		}
+	}
+
+	var found, obsolete, accepted []*Tenant
+	var conflicts []string
+	seen := make(map[string]bool)
+	for _, tenant := range wanted {
+		name := low(tenant.Name)
+		logFields := log.Fields{"tenant": tenant.Name, "source": source}
+		if seen[name] || rt.Config.FindTenant(name).Name != "" {
+			TenantLog(logFields).Debug("tenant is already defined, not discovered")
+			continue
+		}
+		if other := rt.FindTenant(name); other != nil && other.source != source {
+			TenantLog(logFields).WithField("other_source", other.source).Error("tenant already discovered by another source")
+			conflicts = append(conflicts, name+" ("+other.source+")")
+			continue
+		}
+		seen[name] = true
+		tenant.source = source
+		tenant.origin = tenant.TenantInfo
+		accepted = append(accepted, tenant)
+
+		if old, ok := current[name]; ok {
+			delete(current, name)
+			if reflect.DeepEqual(old.origin, tenant.origin) && old.secret == tenant.secret {
+				found = append(found, old)
+				continue
+			}
+			obsolete = append(obsolete, old)
+		}
+		TenantLog(logFields).Info("tenant discovered")
+		if rt.connectTenant(tenant, secretMap) != nil {
+			found = append(found, tenant)
+		}
+	}
+	for _, old := range current {
+		TenantLog(log.Fields{"tenant": old.Name, "source": source}).Info("discovered tenant removed")
+		rt.status.removeTenant(old.Name)
+		obsolete = append(obsolete, old)
+	}
+
+	rt.mu.Lock()
+	closed := rt.closed
+	if closed {
+		obsolete = append(obsolete, found...)
+	} else {
+		var tenants []*Tenant
+		added := false
+		for _, tenant := range rt.Tenants {
+			if tenant.source == source {
+				continue
+			}
+			tenants = append(tenants, tenant)
+			if tenant == after {
+				tenants = append(tenants, found...)
+				added = true
+			}
+		}
+		if !added {
+			tenants = append(tenants, found...)
+		}
+		rt.Tenants = tenants
+	}
+	rt.mu.Unlock()
+
+	for _, old := range obsolete {
+		old.close()
+	}
+	if !closed {
+		rt.saveDiscovered(source, accepted)
+	}
+	if len(conflicts) > 0 {
+		return errors.Errorf("reconcile(tenants already discovered by another source: %s)", strings.Join(conflicts, ", "))
+	}
+	return nil
+}
+
+// discoveredRecord - discovered tenant in the state store
+type discoveredRecord struct {
+	Info   TenantInfo `json:"info"`
+	Secret string     `json:"secret,omitempty"`
+}
+
+// stateStore - the state store or nil
+func (rt *Runtime) stateStore() *stateStore {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	return rt.state
+}
+
+// saveDiscovered - remember the tenants of the discovery source, so that they
+// are monitored after a restart even if the source is not available
+func (rt *Runtime) saveDiscovered(source string, tenants []*Tenant) {
+	state := rt.stateStore()
+	if state == nil {
+		return
+	}
+	records := make([]discoveredRecord, 0, len(tenants))
+	for _, tenant := range tenants {
+		records = append(records, discoveredRecord{Info: tenant.origin, Secret: tenant.secret})
+	}
+	if err := state.put(bucketTenants, tenantsVersion, map[string]interface{}{source: records}); err != nil {
+		log.WithField("source", source).WithError(err).Error("can't save discovered tenants")
+	}
+}
+
+// restoreDiscovered - connect the saved tenants of the discovery source, if
+// the source is not available at the start
+func (rt *Runtime) restoreDiscovered(source string, after *Tenant) {
+	state := rt.stateStore()
+	if state == nil {
+		return
+	}
+	var tenants []*Tenant
+	err := state.each(bucketTenants, tenantsVersion, func(key string, data json.RawMessage) error {
+		if key != source {
+			return nil
+		}
+		var records []discoveredRecord
+		if err := json.Unmarshal(data, &records); err != nil {
+			return errors.Wrap(err, "restoreDiscovered(Unmarshal)")
+		}
+		for _, record := range records {
+			tenants = append(tenants, &Tenant{TenantInfo: record.Info, secret: record.Secret})
+		}
+		return nil
+	})
+	if err != nil {
+		log.WithField("source", source).WithError(err).Error("can't read discovered tenants")
+		return
+	}
+	if len(tenants) == 0 {
+		return
+	}
+	log.WithFields(log.Fields{"source": source, "tenants": len(tenants)}).Info("discovery source not available, saved tenants restored")
+	if err := rt.reconcile(source, tenants, after); err != nil {
+		log.WithField("source", source).WithError(err).Error("can't restore discovered tenants")
+	}
+}
+
+// prepare, establish, check and return connection to hana db
+func (rt *Runtime) getConnection(ctx context.Context, tenant *Tenant, connStr string, secretMap internal.Secret) *sql.DB {
+
+	pw, err := GetPassword(secretMap, tenant.secretName())
+	if err != nil {
+		log.WithFields(log.Fields{
+			"tenant": tenant.Name,
+		}).Error("Cannot find password for tenant.")
+		return nil
+	}
+	db := rt.dbConnect(tenant, connStr, pw)
+	if db == nil {
+		log.WithFields(log.Fields{
+			"tenant": tenant.Name,
+		}).Error("Can't get connection.")
+		return nil
+	}
+
+	if err := db.PingContext(ctx); err != nil {
+		log.WithFields(log.Fields{
+			"tenant": tenant.Name,
+		}).Error("Cannot ping tenant:" + err.Error())
+		db.Close()
+		return nil
+	}
+	return db
+}
+
+// connect to hana db
+func (rt *Runtime) dbConnect(tenant *Tenant, connStr, pw string) *sql.DB {
+
+	if rt.SQLDriver != "" {
+		db, err := sql.Open(rt.SQLDriver, "hdb://"+tenant.User+":"+pw+"@"+connStr)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"tenant": tenant.Name,
+			}).Error(err.Error())
+			return nil
+		}
+		return db
+	}
+
+	connector, err := goHdbDriver.NewDSNConnector("hdb://" + tenant.User + ":" + pw + "@" + connStr)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"tenant": tenant.Name,
+		}).Error(err.Error())
+		return nil
+	}
+	connector.SetTimeout(time.Duration(rt.Config.Timeout) * time.Second)
+
+	db := sql.OpenDB(connector)
+	db.SetMaxOpenConns(25)
+	db.SetMaxIdleConns(25)
+	db.SetConnMaxLifetime(5 * time.Minute)
+
+	return db
+}
+
+// applies - tag and version filter match the tenant
+func (tenant *Tenant) applies(tagFilter []string, versionFilter string) bool {
+	if !SubSliceInSlice(tagFilter, tenant.Tags) {
+		return false
+	}
+	if versionFilter == "" {
+		return true
+	}
+	if tenant.Version == "" {
+		return false
+	}
+	return checkVersionRequirement(tenant.Version, versionFilter)
+}
+
+// Selection - select of the query for the tenant with the first granted
+// schema, empty if the query does not apply to the tenant
+func (tenant *Tenant) Selection(query QueryInfo) string {
+	sel, _ := tenant.selection(query, time.Now())
+	return sel
+}
+
+// selection - select of the query for the tenant with the first granted
+// schema and the values of its bound parameters
+func (tenant *Tenant) selection(query QueryInfo, last time.Time) (string, []interface{}) {
+	logFields := query.logFields(tenant)
+	if !tenant.applies(query.TagFilter, query.VersionFilter) {
+		return "", nil
+	}
+
+	schemas := tenant.grantedSchemas(query.SchemaFilter)
+	if len(schemas) == 0 {
+		log.WithFields(logFields).Error("schema filter must include at least one tenant schema")
+		return "", nil
+	}
+	sel, args, err := tenant.statement(query.SQL, tenant.sqlVars(schemas[0], last))
+	if err != nil {
+		log.WithFields(logFields).WithError(err).Error("sql template failed")
+		return "", nil
+	}
+
+	trimmed := strings.TrimSpace(sel)
+	if len(trimmed) < 6 || !strings.EqualFold(trimmed[0:6], "select") {
+		log.WithFields(logFields).Error("Only selects are allowed")
+		return "", nil
+	}
+	return sel, args
+}
+
+// errNoSchema - no schema of the schema filter is granted to the tenant user
+var errNoSchema = errors.New("no schema of SchemaFilter granted")
@@ -0,0 +1,182 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+// configSchemaCmd represents the config schema command
+var configSchemaCmd = &cobra.Command{
+	Use:   "schema",
+	Short: "Print the JSON Schema of the configuration",
+	Long: `With the command config schema you can print the JSON Schema of the configuration file, which is generated from the Go types. Editors can use it to validate toml, yaml and json config files. For example:
+	hana_sql_exporter config schema > examples/schema/hana_sql_exporter.schema.json`,
+	Run: func(cmd *cobra.Command, args []string) {
+		schema, err := ConfigSchema()
+		if err != nil {
+			exit("Can't create schema: ", err)
+		}
+		fmt.Print(string(schema))
+	},
+}
+
+func init() {
+	configCmd.AddCommand(configSchemaCmd)
+}
+
+// descriptions of the config fields in the schema
+var schemaDescriptions = map[string]string{
+	"Config.Secret":                "Encrypted tenant passwords, maintained with the pw command",
+	"Config.Tenants":               "SAP HANA tenants to monitor",
+	"Config.Metrics":               "Metrics with one value column per select",
+	"Config.Queries":               "Selects with one or more metrics",
+	"Config.Include":               "Metric packs like \"hana:core\" and config files or glob patterns like \"conf.d/*.toml\"",
+	"Config.EnableMetrics":         "Names of metrics to enable",
+	"Config.DisableMetrics":        "Names of metrics to disable",
+	"Config.Timeout":               "Scrape timeout in seconds",
+	"Config.Ip":                    "Ip the exporter listens to",
+	"Config.Port":                  "Port the exporter listens to",
+	"Config.LogLevel":              "Minimum log level",
+	"Config.LogFile":               "Log file location",
+	"Config.LogFormat":             "Format of the log entries",
+	"Config.LogMaxSize":            "Megabytes of the log file before it is rotated, default 100, not rotated by size if 0",
+	"Config.LogRotateInterval":     "Seconds between two rotations of the log file, e.g. 86400 for daily files, not rotated by time if 0",
+	"Config.LogMaxBackups":         "Number of rotated log files that are kept, default 7, all if 0",
+	"Config.LogMaxAge":             "Days rotated log files are kept, no limit if 0",
+	"Config.ReadyMinTenants":       "Minimum number of connected tenants for /health/ready, default 1, 0: the number is not checked",
+	"Config.ReadyTenants":          "Tenants that must be connected for /health/ready",
+	"Config.ReadyMaxScrapeAge":     "Maximum age in seconds of the last successful scrape for /health/ready, 0: not checked",
+	"Config.RemoteWrite":           "Prometheus remote write endpoints the collected metrics are pushed to",
+	"Config.RemoteWriteInterval":   "Seconds between two remote write collections, default 60",
+	"Config.OTLP":                  "OpenTelemetry collector endpoints the collected metrics are exported to",
+	"Config.OTLPInterval":          "Seconds between two OTLP collections, default 60",
+	"Config.DisableMetricsHandler": "Don't serve /metrics, e.g. if the metrics are only exported with OTLP",
+	"Config.FileSD":                "Json or yaml files with tenants in the Prometheus file_sd format, watched for changes",
+	"Config.HTTPSD":                "Http endpoints with tenants in the Prometheus http_sd format, polled periodically",
+	"Config.StateFile":             "Json file with the high-water marks and counters of incremental selects, kept in memory if empty",
+	"Config.StateDir":              "Directory of the embedded state store, used instead of StateFile. It keeps the counters of the incremental selects",
+	"FileSDInfo.Files":             "File names or glob patterns",
+	"FileSDInfo.RefreshInterval":   "Seconds between two reads without file changes, default 300",
+	"HTTPSDInfo.URL":               "Url returning the tenant target groups as json",
+	"HTTPSDInfo.RefreshInterval":   "Seconds between two requests, default 60",
+	"HTTPSDInfo.Timeout":           "Http timeout in seconds, default 10",
+	"OTLPInfo.Endpoint":            "http(s)://host:4318 for http/protobuf, host:4317 for grpc",
+	"OTLPInfo.Protocol":            "http/protobuf (default) or grpc",
+	"OTLPInfo.Insecure":            "Use grpc without TLS",
+	"OTLPInfo.Timeout":             "Export timeout in seconds, default 10",
+	"RemoteWriteInfo.URL":          "Remote write url, e.g. http://prometheus:9090/api/v1/write",
+	"RemoteWriteInfo.Timeout":      "Http timeout in seconds, default 10",
+	"RemoteWriteInfo.QueueSize":    "Write requests kept in memory, default 100",
+	"RemoteWriteInfo.MaxRetries":   "Retries of a failed write request, default 5",
+	"RemoteWriteInfo.MinBackoffMs": "Wait time before the first retry in milliseconds, doubled for every retry, default 500",
+	"RemoteWriteInfo.MaxBackoffMs": "Maximum wait time between two retries in milliseconds, default 30000",
+	"RemoteWriteInfo.BufferDir":    "Directory for write requests that could not be sent",
+	"RemoteWriteInfo.MaxBuffer":    "Maximum number of buffered write requests, default 1000",
+	"TenantInfo.Name":              "SAP HANA tenant name",
+	"TenantInfo.Tags":              "Tags describing the system, used by TagFilter",
+	"TenantInfo.ConnStr":           "Connection string <hostname>:<tenant sql port>",
+	"TenantInfo.Hosts":             "Connection strings of the other system replication sites, the primary site is detected",
+	"TenantInfo.User":              "Tenant database user name",
+	"TenantInfo.Usage":             "Additional information about tenant usage",
+	"TenantInfo.Schemas":           "Available schemas for the tenant",
+	"TenantInfo.SystemDB":          "Connection to a system database, its tenant databases are discovered and monitored as well",
+	"TenantInfo.Template":          "Tenant entry without ConnStr whose user, tags, schemas and password are used for the discovered tenants, the system entry if empty",
+	"TenantInfo.Exclude":           "Tenant databases that are not discovered",
+	"TenantInfo.DiscoveryInterval": "Seconds between two discoveries, default 300",
+	"TenantInfo.Vars":              "Values of the {{.Vars.<name>}} template variables of the selects, lower case names",
+	"TenantInfo.LogLevel":          "Minimum log level of the log entries of the tenant, LogLevel if empty",
+	"MetricInfo.Name":              "Metric name, words separated by underscore",
+	"MetricInfo.SQL":               "Select with <SCHEMA> placeholder and template actions like {{.Tenant}} or {{param .LastScrapeTime}}",
+	"MetricInfo.TagFilter":         "Tags a tenant must have",
+	"MetricInfo.SchemaFilter":      "Schemas, glob patterns like SAPABAP* or SAP<SID>, regular expressions like /^SAP.*/ or @abap, the schemas granted to the tenant user replace <SCHEMA>",
+	"MetricInfo.ValueColumn":       "Column with the metric value, the state column of stateset metrics",
+	"MetricInfo.States":            "Allowed states of a stateset metric",
+	"MetricInfo.KeyColumn":         "Increasing column like a timestamp or id, the select reads the rows after {{.LastKey}} and the metric counts them",
+	"MetricInfo.VersionFilter":     "Version condition like \">= 2.00.048\"",
+	"QueryInfo.Metrics":            "Metrics created from the select",
+	"QueryInfo.Name":               "Query name used by /api/v1/query/<name> and the query command",
+	"QueryInfo.Export":             "Allow reading the rows with /api/v1/query/<name> and the query command",
+	"QueryInfo.Site":               "primary: the select runs on the primary site, secondary: on the secondary site of tenants with Hosts",
+	"QueryInfo.Scope":              "tenant: the select runs on every tenant, systemdb: the select runs once on every system database",
+	"QueryInfo.KeyColumn":          "Increasing column like a timestamp or id, the select reads the rows after {{.LastKey}} and the metrics count them",
+	"QueryInfo.DatabaseColumn":     "Column with the database name that assigns the rows of a systemdb query to the tenants, default DATABASE_NAME",
+	"QueryMetricInfo.Labels":       "Columns used as labels",
+	"QueryMetricInfo.States":       "Allowed states of a stateset metric",
+}
+
+// allowed values of config fields
+var schemaEnums = map[string][]string{
+	"MetricType": {"gauge", "counter", "info", "stateset"},
+	"LogLevel":   {"error", "warn", "info", "debug"},
+	"LogFormat":  {"logfmt", "json"},
+	"Protocol":   {"http/protobuf", "grpc"},
+	"Scope":      {"tenant", "systemdb"},
+	"Site":       {"primary", "secondary"},
+}
+
+// ConfigSchema - JSON Schema of the Config struct
+func ConfigSchema() ([]byte, error) {
+	schema := typeSchema(reflect.TypeOf(Config{}), "")
+	schema["$schema"] = "http://json-schema.org/draft-07/schema#"
+	schema["title"] = "hana_sql_exporter configuration"
+
+	out, err := json.MarshalIndent(schema, "", "  ")
+	if err != nil {
+		return nil, errors.Wrap(err, "ConfigSchema(MarshalIndent)")
+	}
+	return append(out, '\n'), nil
+}
+
+// schema of one go type
+func typeSchema(t reflect.Type, field string) map[string]interface{} {
+	schema := make(map[string]interface{})
+
+	switch t.Kind() {
+	case reflect.Struct:
+		properties := make(map[string]interface{})
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" || f.Tag.Get("mapstructure") == "-" {
+				continue
+			}
+			property := typeSchema(f.Type, f.Name)
+			if desc, ok := schemaDescriptions[t.Name()+"."+f.Name]; ok {
+				property["description"] = desc
+			}
+			properties[f.Name] = property
+		}
+		schema["type"] = "object"
+		schema["properties"] = properties
+		schema["additionalProperties"] = false
+	case reflect.Slice:
+		schema["type"] = "array"
+		if t.Elem().Kind() == reflect.Uint8 {
+			schema["items"] = map[string]interface{}{"type": "integer", "minimum": 0, "maximum": 255}
+		} else {
+			schema["items"] = typeSchema(t.Elem(), field)
+		}
+	case reflect.Ptr:
+		// unset values are nil
+		return typeSchema(t.Elem(), field)
+	case reflect.Map:
+		schema["type"] = "object"
+		schema["additionalProperties"] = typeSchema(t.Elem(), field)
+	case reflect.String:
+		schema["type"] = "string"
+		if enum, ok := schemaEnums[field]; ok {
+			schema["enum"] = enum
+		}
+	case reflect.Bool:
+		schema["type"] = "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		schema["type"] = "integer"
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		schema["type"] = "integer"
+		schema["minimum"] = 0
+	}
+	return schema
+}
@@ -0,0 +1,140 @@
+package cmd
+
+import (
+	"context"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// schema filter alias for the schemas with ABAP tables
+const abapAlias = "@abap"
+
+// schemas granted to the user directly or by one of its roles
+const grantedSchemasSelect = `SELECT DISTINCT schema_name FROM sys.granted_privileges
+WHERE object_type = 'SCHEMA'
+AND (grantee = ? OR grantee IN (SELECT role_name FROM sys.effective_roles WHERE user_name = ?))
+ORDER BY schema_name`
+
+// schemas with the ABAP tables TBTCO and T000
+const abapSchemasSelect = `SELECT schema_name FROM sys.tables
+WHERE table_name IN ('TBTCO', 'T000')
+GROUP BY schema_name
+HAVING COUNT(DISTINCT table_name) = 2
+ORDER BY schema_name`
+
+// readSchemas - sys, the schemas granted to the tenant user and the schemas
+// with ABAP tables
+func (tenant *Tenant) readSchemas(ctx context.Context) error {
+	tenant.Schemas = append(tenant.Schemas, "sys")
+
+	user := strings.ToUpper(tenant.User)
+	granted, err := selectStrings(ctx, tenant, grantedSchemasSelect, user, user)
+	if err != nil {
+		return errors.Wrap(err, "readSchemas(granted)")
+	}
+	for _, schema := range granted {
+		if !ContainsString(schema, tenant.Schemas) {
+			tenant.Schemas = append(tenant.Schemas, schema)
+		}
+	}
+
+	// without ABAP schemas only the @abap filter is affected
+	tenant.abapSchemas, err = selectStrings(ctx, tenant, abapSchemasSelect)
+	if err != nil {
+		TenantLog(log.Fields{"tenant": tenant.Name}).WithError(err).Warn("can't detect ABAP schemas")
+	}
+	return nil
+}
+
+// selectStrings - first column of all rows of the select
+func selectStrings(ctx context.Context, tenant *Tenant, sel string, args ...interface{}) ([]string, error) {
+	rows, err := tenant.DB().QueryContext(ctx, sel, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "selectStrings(Query)")
+	}
+	defer rows.Close()
+
+	var values []string
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, errors.Wrap(err, "selectStrings(Scan)")
+		}
+		values = append(values, value)
+	}
+	return values, errors.Wrap(rows.Err(), "selectStrings(rows.Err)")
+}
+
+// grantedSchemas - schemas of the schema filter granted to the tenant user,
+// sys if the filter is empty. Entries are schema names, glob patterns like
+// SAPABAP* or SAP<SID>, regular expressions between slashes like /^SAP.*DB$/
+// or the @abap alias.
+func (tenant *Tenant) grantedSchemas(schemaFilter []string) []string {
+	if len(schemaFilter) == 0 {
+		schemaFilter = []string{"sys"}
+	}
+	var schemas []string
+	add := func(schema string) {
+		if !ContainsString(schema, schemas) {
+			schemas = append(schemas, schema)
+		}
+	}
+
+	for _, entry := range schemaFilter {
+		match, err := tenant.schemaMatcher(entry)
+		if err != nil {
+			TenantLog(log.Fields{"tenant": tenant.Name, "schema": entry}).WithError(err).Warn("invalid schema filter")
+			continue
+		}
+		switch {
+		case low(entry) == abapAlias:
+			for _, schema := range tenant.abapSchemas {
+				add(schema)
+			}
+		case match == nil:
+			// names stay as configured
+			name := strings.ReplaceAll(entry, "<SID>", tenant.SID)
+			if ContainsString(name, tenant.Schemas) {
+				add(name)
+			}
+		default:
+			for _, schema := range tenant.Schemas {
+				if match(schema) {
+					add(schema)
+				}
+			}
+		}
+	}
+	return schemas
+}
+
+// schemaMatcher - case insensitive match of a pattern or regular expression
+// of the schema filter, nil for the @abap alias and schema names
+func (tenant *Tenant) schemaMatcher(entry string) (func(string) bool, error) {
+	if low(entry) == abapAlias {
+		return nil, nil
+	}
+	if len(entry) > 2 && strings.HasPrefix(entry, "/") && strings.HasSuffix(entry, "/") {
+		re, err := regexp.Compile("(?i)" + entry[1:len(entry)-1])
+		if err != nil {
+			return nil, errors.Wrap(err, "schemaMatcher(Compile)")
+		}
+		return re.MatchString, nil
+	}
+
+	pattern := strings.ToUpper(strings.ReplaceAll(entry, "<SID>", tenant.SID))
+	if !strings.ContainsAny(pattern, "*?[") {
+		return nil, nil
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, errors.Wrap(err, "schemaMatcher(Match)")
+	}
+	return func(schema string) bool {
+		ok, _ := path.Match(pattern, strings.ToUpper(schema))
+		return ok
+	}, nil
+}
@@ -0,0 +1,67 @@
+package cmd_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ulranh/hana_sql_exporter/cmd"
+	"github.com/ulranh/hana_sql_exporter/internal/hdbmock"
+)
+
+// schema labels of the records of the metric
+func schemaLabels(data []cmd.MetricData, name string) []string {
+	var schemas []string
+	for _, md := range data {
+		if md.Name != name {
+			continue
+		}
+		for _, record := range md.Stats {
+			for i, label := range record.Labels {
+				if label == "schema" {
+					schemas = append(schemas, record.LabelValues[i])
+				}
+			}
+		}
+	}
+	return schemas
+}
+
+func Test_SchemaFilter(t *testing.T) {
+	assert := assert.New(t)
+
+	drv, err := hdbmock.Register(append([]hdbmock.Rule{
+		{SQL: `granted_privileges`, Columns: []string{"SCHEMA_NAME"}, Rows: [][]interface{}{{"SAPABAP1"}, {"SAPHANADB"}, {"SAPQ01"}, {"ZREPORTS"}}},
+		{SQL: `from sys\.tables`, Columns: []string{"SCHEMA_NAME"}, Rows: [][]interface{}{{"SAPHANADB"}}},
+		{SQL: `m_dummy`, Columns: []string{"CNT"}, Rows: [][]interface{}{{int64(1)}}},
+	}, metadataRules...)...)
+	assert.Nil(err)
+
+	config := e2eConfig(t)
+	config.Tenants = config.Tenants[:1]
+	metric := func(name string, filter ...string) cmd.MetricInfo {
+		return cmd.MetricInfo{Name: name, Help: name, MetricType: "gauge", SQL: "select count(*) cnt from <SCHEMA>.m_dummy", SchemaFilter: filter}
+	}
+	config.Metrics = []cmd.MetricInfo{
+		metric("hana_name", "sapabap1", "sapabap"),
+		metric("hana_glob", "SAPABAP*", "sap<SID>"),
+		metric("hana_regex", "/^sap(abap|hana)/"),
+		metric("hana_abap", "@abap"),
+		metric("hana_invalid", "/sap(/", "[sap"),
+	}
+
+	rt := cmd.NewRuntime(config)
+	rt.SQLDriver = drv.Name()
+	assert.Nil(rt.Connect())
+	defer rt.Close()
+
+	// the grants of the user and its roles are selected
+	_, args := executedArgs(drv, "granted_privileges")
+	assert.Equal([][]interface{}{{"MONITOR", "MONITOR"}}, args)
+
+	data := rt.Scrape()
+	assert.Equal([]string{"sapabap1"}, schemaLabels(data, "hana_name"))
+	assert.Equal([]string{"sapabap1", "sapq01"}, schemaLabels(data, "hana_glob"))
+	assert.Equal([]string{"sapabap1", "saphanadb"}, schemaLabels(data, "hana_regex"))
+	assert.Equal([]string{"saphanadb"}, schemaLabels(data, "hana_abap"))
+	assert.Empty(schemaLabels(data, "hana_invalid"))
+}
@@ -0,0 +1,275 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	defaultFileSDInterval = 300
+	defaultHTTPSDInterval = 60
+	defaultHTTPSDTimeout  = 10
+)
+
+// FileSDInfo - json or yaml files with tenant target groups in the Prometheus
+// file_sd format
+type FileSDInfo struct {
+	Files           []string // file names or glob patterns
+	RefreshInterval uint     // seconds between two reads without file changes
+}
+
+// HTTPSDInfo - http endpoint with tenant target groups in the Prometheus
+// http_sd format
+type HTTPSDInfo struct {
+	URL             string
+	RefreshInterval uint // seconds between two requests
+	Timeout         uint // http timeout in seconds
+}
+
+// targetGroup - file_sd and http_sd entry, the first target is the ConnStr,
+// further targets are system replication Hosts and the labels tenant, user, usage, tags and schemas describe the tenant
+type targetGroup struct {
+	Targets []string          `json:"targets" yaml:"targets"`
+	Labels  map[string]string `json:"labels" yaml:"labels"`
+}
+
+// tenantInfos - tenants of the target groups
+func tenantInfos(groups []targetGroup) ([]TenantInfo, error) {
+	var infos []TenantInfo
+	for i, group := range groups {
+		name := group.Labels["tenant"]
+		if name == "" {
+			return nil, errors.Errorf("tenantInfos(target group %d without tenant label)", i)
+		}
+		if len(group.Targets) == 0 {
+			return nil, errors.Errorf("tenantInfos(tenant %s without target)", name)
+		}
+		infos = append(infos, TenantInfo{
+			Name:    low(name),
+			ConnStr: group.Targets[0],
+			Hosts:   group.Targets[1:],
+			User:    group.Labels["user"],
+			Usage:   group.Labels["usage"],
+			Tags:    splitList(group.Labels["tags"]),
+			Schemas: splitList(group.Labels["schemas"]),
+		})
+	}
+	return infos, nil
+}
+
+// unmarshalTargetGroups - target groups of a json or yaml document
+func unmarshalTargetGroups(content []byte, format string) ([]targetGroup, error) {
+	var groups []targetGroup
+	var err error
+	if format == "yaml" {
+		err = yaml.Unmarshal(content, &groups)
+	} else {
+		err = json.Unmarshal(content, &groups)
+	}
+	return groups, errors.Wrapf(err, "unmarshalTargetGroups(%s)", format)
+}
+
+// Tenants - tenants of all files
+func (sd FileSDInfo) Tenants() ([]TenantInfo, error) {
+	var infos []TenantInfo
+	for _, pattern := range sd.Files {
+		files, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Tenants(Glob %s)", pattern)
+		}
+		for _, file := range files {
+			content, err := ioutil.ReadFile(file)
+			if err != nil {
+				return nil, errors.Wrap(err, "Tenants(ReadFile)")
+			}
+			groups, err := unmarshalTargetGroups(content, formatByExtension(file))
+			if err != nil {
+				return nil, errors.Wrapf(err, "Tenants(%s)", file)
+			}
+			fileInfos, err := tenantInfos(groups)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Tenants(%s)", file)
+			}
+			infos = append(infos, fileInfos...)
+		}
+	}
+	return infos, nil
+}
+
+// Tenants - tenants of the http endpoint
+func (sd HTTPSDInfo) Tenants(ctx context.Context) ([]TenantInfo, error) {
+	timeout := sd.Timeout
+	if timeout == 0 {
+		timeout = defaultHTTPSDTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, sd.URL, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "Tenants(NewRequest)")
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "Tenants(Do)")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("Tenants(status %s)", resp.Status)
+	}
+
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "Tenants(ReadAll)")
+	}
+	groups, err := unmarshalTargetGroups(content, "json")
+	if err != nil {
+		return nil, errors.Wrap(err, "Tenants(unmarshalTargetGroups)")
+	}
+	return tenantInfos(groups)
+}
+
+// inventoryTenants - names of the tenants of all file and http discovery
+// sources, an error if one of the sources can't be read
+func (config *Config) inventoryTenants(ctx context.Context) (map[string]bool, error) {
+	names := make(map[string]bool)
+	for i, sd := range config.FileSD {
+		infos, err := sd.Tenants()
+		if err != nil {
+			return nil, errors.Wrapf(err, "inventoryTenants(file_sd:%d)", i)
+		}
+		for _, info := range infos {
+			names[low(info.Name)] = true
+		}
+	}
+	for i, sd := range config.HTTPSD {
+		infos, err := sd.Tenants(ctx)
+		if err != nil {
+			return nil, errors.Wrapf(err, "inventoryTenants(http_sd:%d)", i)
+		}
+		for _, info := range infos {
+			names[low(info.Name)] = true
+		}
+	}
+	return names, nil
+}
+
+// sdTenants - unconnected tenants of the tenant infos
+func sdTenants(infos []TenantInfo) []*Tenant {
+	tenants := make([]*Tenant, len(infos))
+	for i, info := range infos {
+		tenants[i] = &Tenant{TenantInfo: info}
+	}
+	return tenants
+}
+
+// RefreshFileSD - read the files of the file discovery source and connect and
+// close the tenants accordingly. The tenants stay unchanged, if a file can't
+// be read.
+func (rt *Runtime) RefreshFileSD(pos int) error {
+	infos, err := rt.Config.FileSD[pos].Tenants()
+	if err != nil {
+		return errors.Wrap(err, "RefreshFileSD(Tenants)")
+	}
+	return errors.Wrap(rt.reconcile(fmt.Sprintf("file_sd:%d", pos), sdTenants(infos), nil), "RefreshFileSD(reconcile)")
+}
+
+// RefreshHTTPSD - request the tenants of the http discovery source and
+// connect and close the tenants accordingly. The tenants stay unchanged, if
+// the request fails.
+func (rt *Runtime) RefreshHTTPSD(ctx context.Context, pos int) error {
+	infos, err := rt.Config.HTTPSD[pos].Tenants(ctx)
+	if err != nil {
+		return errors.Wrap(err, "RefreshHTTPSD(Tenants)")
+	}
+	return errors.Wrap(rt.reconcile(fmt.Sprintf("http_sd:%d", pos), sdTenants(infos), nil), "RefreshHTTPSD(reconcile)")
+}
+
+// watchFileSD - read the files of the file discovery source whenever one of
+// them changes and every RefreshInterval seconds until ctx is done
+func (rt *Runtime) watchFileSD(ctx context.Context, pos int) {
+	sd := rt.Config.FileSD[pos]
+	interval := sd.RefreshInterval
+	if interval == 0 {
+		interval = defaultFileSDInterval
+	}
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+
+	// watch the directories, files may be replaced by renames
+	var events chan fsnotify.Event
+	var errs chan error
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.WithError(err).Warn("file watcher not available, files are read every refresh interval")
+	} else {
+		defer watcher.Close()
+		events, errs = watcher.Events, watcher.Errors
+		for _, pattern := range sd.Files {
+			if err := watcher.Add(filepath.Dir(pattern)); err != nil {
+				log.WithField("file", pattern).WithError(err).Warn("can't watch directory")
+			}
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case event := <-events:
+			if !sd.matches(event.Name) {
+				continue
+			}
+		case err := <-errs:
+			log.WithError(err).Warn("file watcher error")
+			continue
+		}
+		if err := rt.RefreshFileSD(pos); err != nil {
+			log.WithError(err).Error("file discovery failed")
+		}
+	}
+}
+
+// matches - true, if the file matches one of the patterns
+func (sd FileSDInfo) matches(file string) bool {
+	for _, pattern := range sd.Files {
+		if ok, _ := filepath.Match(filepath.Clean(pattern), filepath.Clean(file)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// pollHTTPSD - request the tenants of the http discovery source every
+// RefreshInterval seconds until ctx is done
+func (rt *Runtime) pollHTTPSD(ctx context.Context, pos int) {
+	interval := rt.Config.HTTPSD[pos].RefreshInterval
+	if interval == 0 {
+		interval = defaultHTTPSDInterval
+	}
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := rt.RefreshHTTPSD(ctx, pos); err != nil {
+			log.WithError(err).Error("http discovery failed")
+		}
+	}
+}
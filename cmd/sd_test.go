@@ -0,0 +1,158 @@
+package cmd_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ulranh/hana_sql_exporter/cmd"
+	"github.com/ulranh/hana_sql_exporter/internal/hdbmock"
+)
+
+// runtime with the sd sources and passwords for q01 and q02
+func sdRuntime(t *testing.T, config *cmd.Config) *cmd.Runtime {
+	drv, err := hdbmock.Register(metadataRules...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Timeout = 2
+	config.Tenants = []cmd.TenantInfo{{Name: "q01"}, {Name: "q02"}}
+	config.Secret, err = config.AddSecret("q01,q02", []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Tenants = nil
+
+	rt := cmd.NewRuntime(config)
+	rt.SQLDriver = drv.Name()
+	t.Cleanup(rt.Close)
+	return rt
+}
+
+// users of the connected tenants
+func tenantUsers(rt *cmd.Runtime) map[string]string {
+	users := make(map[string]string)
+	for _, tenant := range rt.Tenants {
+		users[tenant.Name] = tenant.User
+	}
+	return users
+}
+
+func Test_FileSD(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	assert.Nil(ioutil.WriteFile(filepath.Join(dir, "a.json"), []byte(`[
+  {"targets": ["q01host:30015"], "labels": {"tenant": "Q01", "user": "monitor", "tags": "abap,erp"}},
+  {"targets": ["q02host:30015"], "labels": {"tenant": "q02", "user": "monitor"}}
+]`), 0644))
+
+	config := &cmd.Config{FileSD: []cmd.FileSDInfo{{Files: []string{filepath.Join(dir, "*.json"), filepath.Join(dir, "*.yml")}}}}
+	rt := sdRuntime(t, config)
+	assert.Nil(rt.Connect())
+	assert.Equal(map[string]string{"q01": "monitor", "q02": "monitor"}, tenantUsers(rt))
+	assert.Equal([]string{"abap", "erp"}, rt.FindTenant("q01").Tags)
+	q01 := rt.FindTenant("q01")
+
+	// q02 moved to a yaml file with another user, q01 is unchanged
+	assert.Nil(ioutil.WriteFile(filepath.Join(dir, "a.json"), []byte(`[{"targets": ["q01host:30015"], "labels": {"tenant": "Q01", "user": "monitor", "tags": "abap,erp"}}]`), 0644))
+	assert.Nil(ioutil.WriteFile(filepath.Join(dir, "b.yml"), []byte("- targets: [q02host:30015]\n  labels:\n    tenant: q02\n    user: monitor2\n"), 0644))
+	assert.Nil(rt.RefreshFileSD(0))
+	assert.Equal(map[string]string{"q01": "monitor", "q02": "monitor2"}, tenantUsers(rt))
+	assert.True(q01 == rt.FindTenant("q01"))
+
+	// broken files keep the tenants
+	assert.Nil(ioutil.WriteFile(filepath.Join(dir, "b.yml"), []byte("- targets: [q02host:30015]\n  labels: {}\n"), 0644))
+	assert.NotNil(rt.RefreshFileSD(0))
+	assert.Equal(2, len(rt.Tenants))
+}
+
+func Test_HTTPSD(t *testing.T) {
+	assert := assert.New(t)
+
+	groups := []map[string]interface{}{
+		{"targets": []string{"q01host:30015"}, "labels": map[string]string{"tenant": "q01", "user": "monitor"}},
+		{"targets": []string{"q02host:30015"}, "labels": map[string]string{"tenant": "q02", "user": "monitor"}},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(groups)
+	}))
+	defer server.Close()
+
+	config := &cmd.Config{HTTPSD: []cmd.HTTPSDInfo{{URL: server.URL}}}
+	rt := sdRuntime(t, config)
+	assert.Nil(rt.Connect())
+	assert.Equal(map[string]string{"q01": "monitor", "q02": "monitor"}, tenantUsers(rt))
+
+	// q01 disappears
+	groups = groups[1:]
+	assert.Nil(rt.RefreshHTTPSD(context.Background(), 0))
+	assert.Equal(map[string]string{"q02": "monitor"}, tenantUsers(rt))
+	status := rt.Status()
+	assert.Equal(1, len(status.Tenants))
+
+	server.Close()
+	assert.NotNil(rt.RefreshHTTPSD(context.Background(), 0))
+	assert.Equal(map[string]string{"q02": "monitor"}, tenantUsers(rt))
+}
+
+func Test_SDAddSecret(t *testing.T) {
+	assert := assert.New(t)
+
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Write([]byte(`[{"targets": ["q05host:30015"], "labels": {"tenant": "q05"}}, {"targets": ["q06host:30015"], "labels": {"tenant": "Q06"}}]`))
+	}))
+	defer server.Close()
+
+	// the inventory is requested once for all tenants
+	config := &cmd.Config{HTTPSD: []cmd.HTTPSDInfo{{URL: server.URL}}}
+	_, err := config.AddSecret("q05,q06", []byte("secret"))
+	assert.Nil(err)
+	assert.Equal(int32(1), atomic.LoadInt32(&requests))
+
+	_, err = config.AddSecret("q07", []byte("secret"))
+	assert.NotNil(err)
+
+	// a source that can't be read is reported
+	dir := t.TempDir()
+	assert.Nil(ioutil.WriteFile(filepath.Join(dir, "a.json"), []byte("no json"), 0644))
+	config.FileSD = []cmd.FileSDInfo{{Files: []string{filepath.Join(dir, "*.json")}}}
+	_, err = config.AddSecret("q05", []byte("secret"))
+	assert.Contains(err.Error(), "file_sd:0")
+}
+
+// the exporter reads changed files
+func Test_E2EFileSDWatch(t *testing.T) {
+	assert := assert.New(t)
+
+	drv, err := hdbmock.Register(metadataRules...)
+	assert.Nil(err)
+	dir := t.TempDir()
+	file := filepath.Join(dir, "tenants.json")
+	assert.Nil(ioutil.WriteFile(file, []byte(`[]`), 0644))
+
+	config := e2eConfig(t)
+	config.Tenants = nil
+	config.FileSD = []cmd.FileSDInfo{{Files: []string{file}}}
+	url := startExporter(t, config, drv)
+
+	assert.Nil(ioutil.WriteFile(file, []byte(`[{"targets": ["q01host:30015"], "labels": {"tenant": "q01", "user": "monitor"}}]`), 0644))
+	var status cmd.Status
+	for i := 0; i < 100 && len(status.Tenants) == 0; i++ {
+		time.Sleep(50 * time.Millisecond)
+		_, body := httpGet(t, url+"/api/v1/status")
+		assert.Nil(json.Unmarshal([]byte(body), &status))
+	}
+	assert.Equal(1, len(status.Tenants))
+	assert.True(status.Tenants[0].Connected)
+}
@@ -0,0 +1,108 @@
+package cmd
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+type resultCacheKey struct{}
+
+// resultCache - results of the selects of one scrape, identical selects on
+// the same connection are executed only once
+type resultCache struct {
+	mu      sync.Mutex
+	results map[resultKey]*cachedResult
+}
+
+type resultKey struct {
+	db   *sql.DB
+	sql  string
+	args string
+}
+
+// cachedResult - converted rows of a select, done is closed when they are
+// available
+type cachedResult struct {
+	done chan struct{}
+	data [][]interface{}
+	cols []string
+	err  error
+}
+
+// withResultCache - context whose selects share their results until the
+// context is done
+func withResultCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, resultCacheKey{}, &resultCache{results: make(map[resultKey]*cachedResult)})
+}
+
+// queryRows - converted rows of the select with the bound parameters on the
+// connection. With a result cache in ctx, the select runs once and the other
+// callers get its result.
+func queryRows(ctx context.Context, db *sql.DB, sel string, args ...interface{}) ([][]interface{}, []string, error) {
+	cache, ok := ctx.Value(resultCacheKey{}).(*resultCache)
+	if !ok {
+		return runRows(ctx, db, sel, args...)
+	}
+
+	key := resultKey{db: db, sql: normalizeSQL(sel), args: fmt.Sprintf("%#v", args)}
+	cache.mu.Lock()
+	result, found := cache.results[key]
+	if !found {
+		result = &cachedResult{done: make(chan struct{})}
+		cache.results[key] = result
+	}
+	cache.mu.Unlock()
+
+	if found {
+		select {
+		case <-result.done:
+			return result.data, result.cols, result.err
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+	}
+	result.data, result.cols, result.err = runRows(ctx, db, sel, args...)
+	close(result.done)
+	return result.data, result.cols, result.err
+}
+
+// runRows - execute the select and convert its rows
+func runRows(ctx context.Context, db *sql.DB, sel string, args ...interface{}) ([][]interface{}, []string, error) {
+	rows, err := db.QueryContext(ctx, sel, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	return RowsConvert(rows)
+}
+
+// normalizeSQL - the select with collapsed whitespace and without trailing
+// semicolon, quoted strings and identifiers stay unchanged
+func normalizeSQL(sel string) string {
+	var b strings.Builder
+	var quote rune
+	space := false
+	for _, r := range strings.TrimRight(strings.TrimSpace(sel), "; \t\r\n") {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case unicode.IsSpace(r):
+			space = true
+			continue
+		}
+		if space {
+			b.WriteRune(' ')
+			space = false
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
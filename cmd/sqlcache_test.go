@@ -0,0 +1,63 @@
+package cmd_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ulranh/hana_sql_exporter/cmd"
+	"github.com/ulranh/hana_sql_exporter/internal/hdbmock"
+)
+
+// number of executed selects containing the text
+func executed(drv *hdbmock.Driver, text string) int {
+	cnt := 0
+	for _, query := range drv.Queries() {
+		if strings.Contains(query, text) {
+			cnt++
+		}
+	}
+	return cnt
+}
+
+func Test_SharedResults(t *testing.T) {
+	assert := assert.New(t)
+
+	drv, err := hdbmock.Register(append([]hdbmock.Rule{
+		{SQL: `m_service_memory`, Columns: []string{"SERVICE_NAME", "USED", "TOTAL"}, Rows: [][]interface{}{{"indexserver", int64(10), int64(20)}}},
+	}, metadataRules...)...)
+	assert.Nil(err)
+
+	config := e2eConfig(t)
+	config.Metrics = []cmd.MetricInfo{
+		{Name: "hana_service_used", Help: "used", MetricType: "gauge", SQL: "select service_name, used, total from <SCHEMA>.m_service_memory", ValueColumn: "used", Labels: []string{"service_name"}, SchemaFilter: []string{"sys"}},
+		{Name: "hana_service_total", Help: "total", MetricType: "gauge", SQL: "select service_name, used, total\n  from <SCHEMA>.m_service_memory;", ValueColumn: "total", Labels: []string{"service_name"}, SchemaFilter: []string{"sys"}},
+		{Name: "hana_service_other", Help: "other", MetricType: "gauge", SQL: "select service_name, used, total from <SCHEMA>.m_service_memory where service_name <> 'x  y'", ValueColumn: "used", SchemaFilter: []string{"sys"}},
+	}
+	config.Queries = []cmd.QueryInfo{
+		{SQL: "select  service_name, used, total from <SCHEMA>.m_service_memory", SchemaFilter: []string{"sys"}, Metrics: []cmd.QueryMetricInfo{
+			{Name: "hana_service_free", Help: "free", MetricType: "gauge", ValueColumn: "total", Labels: []string{"service_name"}},
+		}},
+	}
+
+	rt := cmd.NewRuntime(config)
+	rt.SQLDriver = drv.Name()
+	assert.Nil(rt.Connect())
+	defer rt.Close()
+
+	data := rt.Scrape()
+	names := make(map[string]int)
+	for _, md := range data {
+		names[md.Name] += len(md.Stats)
+	}
+	assert.Equal(map[string]int{"hana_service_used": 2, "hana_service_total": 2, "hana_service_other": 2, "hana_service_free": 2}, names)
+
+	// one select per connected tenant for the identical statements, the
+	// whitespace of string literals counts
+	assert.Equal(4, executed(drv, "m_service_memory"))
+	assert.Equal(2, executed(drv, "'x  y'"))
+
+	// every scrape runs the selects again
+	rt.Scrape()
+	assert.Equal(4, executed(drv, "'x  y'"))
+}
@@ -0,0 +1,211 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type lastScrapeKey struct{}
+
+// SQLVars - values of the template variables of a select
+type SQLVars struct {
+	Tenant         string            // lower case tenant name
+	SID            string            // system id
+	User           string            // tenant database user
+	Version        string            // database version
+	Schema         string            // granted schema, also replaces <SCHEMA>
+	Vars           map[string]string // Vars of the tenant entry with lower case names
+	LastScrapeTime time.Time         // start of the last successful run of the select for the tenant
+	LastKey        interface{}       // high-water mark of the KeyColumn of incremental selects, nil on the first run
+}
+
+// withLastScrape - context with the start of the last successful run of the
+// select for the tenant
+func withLastScrape(ctx context.Context, last time.Time) context.Context {
+	return context.WithValue(ctx, lastScrapeKey{}, last)
+}
+
+// lastScrape - start of the last successful run in ctx, now if there is none
+func lastScrape(ctx context.Context) time.Time {
+	if last, ok := ctx.Value(lastScrapeKey{}).(time.Time); ok && !last.IsZero() {
+		return last
+	}
+	return time.Now()
+}
+
+// sqlVars - template variables of the tenant for the schema
+func (tenant *Tenant) sqlVars(schema string, last time.Time) SQLVars {
+	// the config files deliver lower case variable names
+	vars := make(map[string]string, len(tenant.Vars))
+	for name, value := range tenant.Vars {
+		vars[low(name)] = value
+	}
+	return SQLVars{
+		Tenant:         low(tenant.Name),
+		SID:            tenant.SID,
+		User:           tenant.User,
+		Version:        tenant.Version,
+		Schema:         schema,
+		Vars:           vars,
+		LastScrapeTime: last,
+	}
+}
+
+// statement - the select with the executed template and replaced <SCHEMA>
+// placeholder and the values of its bound parameters. Selects without
+// template actions are returned unchanged. The output of every action is
+// bound, unless it is written with raw, see bindValues.
+func (tenant *Tenant) statement(sel string, vars SQLVars) (string, []interface{}, error) {
+	if !strings.Contains(sel, "{{") {
+		return strings.ReplaceAll(sel, "<SCHEMA>", vars.Schema), nil, nil
+	}
+
+	var values []interface{}
+	funcs := template.FuncMap{
+		// version - true, if the tenant version meets the requirement, e.g. ">= 2.00.048"
+		"version": func(requirement string) bool {
+			return checkVersionRequirement(tenant.Version, requirement)
+		},
+		// param - bound parameter instead of the value in the select
+		"param": func(value interface{}) string {
+			values = append(values, value)
+			return valueMark + strconv.Itoa(len(values)-1) + valueMark
+		},
+		// raw - the value as text of the select, e.g. for identifiers
+		"raw": func(value interface{}) string {
+			return strings.ReplaceAll(fmt.Sprint(value), valueMark, "")
+		},
+	}
+	tmpl, err := template.New("sql").Funcs(funcs).Option("missingkey=error").Parse(sel)
+	if err != nil {
+		return "", nil, errors.Wrap(err, "statement(Parse)")
+	}
+	for _, t := range tmpl.Templates() {
+		bindActions(t.Tree, t.Tree.Root)
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, vars); err != nil {
+		return "", nil, errors.Wrap(err, "statement(Execute)")
+	}
+	sel, args := bindValues(b.String(), values)
+	return strings.ReplaceAll(sel, "<SCHEMA>", vars.Schema), args, nil
+}
+
+// valueMark - encloses the number of a value of param in the executed template
+const valueMark = "\x00"
+
+// bindActions - pass the output of the actions through param, actions that
+// end with param or raw and assignments stay unchanged
+func bindActions(tree *parse.Tree, node parse.Node) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			bindActions(tree, child)
+		}
+	case *parse.IfNode:
+		bindActions(tree, n.List)
+		bindActions(tree, n.ElseList)
+	case *parse.RangeNode:
+		bindActions(tree, n.List)
+		bindActions(tree, n.ElseList)
+	case *parse.WithNode:
+		bindActions(tree, n.List)
+		bindActions(tree, n.ElseList)
+	case *parse.ActionNode:
+		if len(n.Pipe.Decl) > 0 {
+			return
+		}
+		last := n.Pipe.Cmds[len(n.Pipe.Cmds)-1]
+		if ident, ok := last.Args[0].(*parse.IdentifierNode); ok && (ident.Ident == "param" || ident.Ident == "raw") {
+			return
+		}
+		n.Pipe.Cmds = append(n.Pipe.Cmds, &parse.CommandNode{
+			NodeType: parse.NodeCommand,
+			Pos:      n.Pos,
+			Args:     []parse.Node{parse.NewIdentifier("param").SetTree(tree).SetPos(n.Pos)},
+		})
+	}
+}
+
+// bindValues - replace the marked values of param in the select: a value
+// outside of quotes or as a whole string literal becomes a bound parameter,
+// within a longer literal or quoted identifier it is escaped and in comments
+// it is written as is
+func bindValues(sel string, values []interface{}) (string, []interface{}) {
+	var b []byte
+	var args []interface{}
+	var quote byte     // ' or " within a literal or quoted identifier
+	var comment string // -- or /* within a comment
+	literal := -1      // position of the opening quote in b
+	for i := 0; i < len(sel); {
+		c := sel[i]
+		if c == valueMark[0] {
+			end := i + 1 + strings.IndexByte(sel[i+1:], c)
+			n, _ := strconv.Atoi(sel[i+1 : end])
+			value := values[n]
+			i = end + 1
+			switch {
+			case comment != "":
+				b = append(b, fmt.Sprint(value)...)
+			case quote == '\'' && literal == len(b)-1 && strings.HasPrefix(sel[i:], "'") && !strings.HasPrefix(sel[i:], "''"):
+				// '{{.X}}' is the bound value
+				b = append(b[:literal], '?')
+				args = append(args, value)
+				quote = 0
+				i++
+			case quote != 0:
+				q := string(quote)
+				b = append(b, strings.ReplaceAll(fmt.Sprint(value), q, q+q)...)
+			default:
+				b = append(b, '?')
+				args = append(args, value)
+			}
+			continue
+		}
+
+		b = append(b, c)
+		i++
+		next := byte(0)
+		if i < len(sel) {
+			next = sel[i]
+		}
+		switch {
+		case comment == "--":
+			if c == '\n' {
+				comment = ""
+			}
+		case comment == "/*":
+			if c == '*' && next == '/' {
+				b = append(b, next)
+				i++
+				comment = ""
+			}
+		case quote != 0:
+			if c == quote && next == quote {
+				// escaped quote
+				b = append(b, next)
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+			literal = len(b) - 1
+		case c == '-' && next == '-', c == '/' && next == '*':
+			comment = string([]byte{c, next})
+			b = append(b, next)
+			i++
+		}
+	}
+	return string(b), args
+}
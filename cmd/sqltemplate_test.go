@@ -0,0 +1,96 @@
+package cmd_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ulranh/hana_sql_exporter/cmd"
+	"github.com/ulranh/hana_sql_exporter/internal/hdbmock"
+)
+
+// executed selects containing the text with their bound parameters
+func executedArgs(drv *hdbmock.Driver, text string) ([]string, [][]interface{}) {
+	var sels []string
+	var args [][]interface{}
+	allArgs := drv.Args()
+	for i, query := range drv.Queries() {
+		if strings.Contains(query, text) {
+			sels = append(sels, query)
+			args = append(args, allArgs[i])
+		}
+	}
+	return sels, args
+}
+
+func Test_SQLTemplate(t *testing.T) {
+	assert := assert.New(t)
+
+	drv, err := hdbmock.Register(append([]hdbmock.Rule{
+		{SQL: `sapabap1\.tbtc[op]`, Columns: []string{"JOBS"}, Rows: [][]interface{}{{int64(3)}}},
+	}, metadataRules...)...)
+	assert.Nil(err)
+
+	config := e2eConfig(t)
+	config.Tenants[0].Vars = map[string]string{"Client": "100", "job": "o'neil"}
+	config.Tenants[1].Vars = map[string]string{"client": "200", "job": "o'neil"}
+	config.Metrics = []cmd.MetricInfo{
+		{Name: "hana_jobs", Help: "jobs", MetricType: "counter", SchemaFilter: []string{"sapabap1"},
+			SQL: `select count(*) jobs from <SCHEMA>.tbtco where mandt = {{param .Vars.client}} and sid = '{{.SID}}' and tenant = '{{.Tenant}}'{{if version ">= 2.00.050"}} and status = 'F'{{end}} and enddate > {{param .LastScrapeTime}}`},
+		{Name: "hana_missing", Help: "missing variable", MetricType: "gauge", SQL: "select count(*) from <SCHEMA>.tbtco where mandt = {{param .Vars.unknown}}"},
+		{Name: "hana_quoted", Help: "quoted values", MetricType: "gauge", SchemaFilter: []string{"sapabap1"},
+			SQL: `select count(*) jobs from {{raw .Schema}}.tbtcp where jobname like '%{{.Vars.job}}%' and "{{.Tenant}}" = 1 /* {{.User}}, 'x */ and mandt = {{.Vars.client}} -- {{.SID}}'`},
+	}
+
+	rt := cmd.NewRuntime(config)
+	rt.SQLDriver = drv.Name()
+	assert.Nil(rt.Connect())
+	defer rt.Close()
+
+	start := time.Now()
+	rt.Scrape()
+	// the variables are bound, also within quotes
+	sels, args := executedArgs(drv, "tbtco")
+	assert.ElementsMatch([]string{
+		"select count(*) jobs from sapabap1.tbtco where mandt = ? and sid = ? and tenant = ? and status = 'F' and enddate > ?",
+		"select count(*) jobs from sapabap1.tbtco where mandt = ? and sid = ? and tenant = ? and enddate > ?",
+	}, sels)
+	for i := range sels {
+		client, sid := "100", "Q01"
+		if args[i][2] == "q02" {
+			client, sid = "200", "Q02"
+		}
+		assert.Equal(client, args[i][0])
+		assert.Equal(sid, args[i][1])
+		assert.True(args[i][3].(time.Time).Before(start))
+	}
+
+	// values within literals and quoted identifiers are escaped, raw and
+	// comments keep the text
+	sels, args = executedArgs(drv, "tbtcp")
+	assert.ElementsMatch([]string{
+		`select count(*) jobs from sapabap1.tbtcp where jobname like '%o''neil%' and "q01" = 1 /* monitor, 'x */ and mandt = ? -- Q01'`,
+		`select count(*) jobs from sapabap1.tbtcp where jobname like '%o''neil%' and "q02" = 1 /* monitor, 'x */ and mandt = ? -- Q02'`,
+	}, sels)
+	assert.ElementsMatch([][]interface{}{{"100"}, {"200"}}, args)
+
+	// the last successful run is the lower bound of the next one
+	rt.Scrape()
+	_, args = executedArgs(drv, "tbtco")
+	assert.Len(args, 4)
+	for _, arg := range args[2:] {
+		assert.False(arg[3].(time.Time).Before(start))
+	}
+
+	// the metric with the unknown variable fails for every tenant
+	status := rt.Status()
+	for _, run := range status.Metrics[1].Tenants {
+		assert.Contains(run.LastError, "sql template failed")
+	}
+	for _, pos := range []int{0, 2} {
+		for _, run := range status.Metrics[pos].Tenants {
+			assert.Empty(run.LastError)
+		}
+	}
+}
@@ -0,0 +1,354 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	stateFileName  = "state.db"
+	counterVersion = 1          // version of the counter records
+	tenantsVersion = 1          // version of the discovered tenant records
+	bucketCounters = "counters" // states of the incremental selects
+	bucketTenants  = "tenants"  // discovered tenants by discovery source
+)
+
+// errStateInUse - another process holds the state store
+var errStateInUse = errors.New("state store is used by another process")
+
+// corruptError - the state file is damaged, other open errors like missing
+// permissions are no corruption
+type corruptError struct {
+	err error
+}
+
+func (e corruptError) Error() string {
+	return "state store corrupt: " + e.err.Error()
+}
+
+// isCorrupt - true, if bolt rejected the file because of its content
+func isCorrupt(err error) bool {
+	switch err {
+	case bolt.ErrInvalid, bolt.ErrChecksum, bolt.ErrVersionMismatch:
+		return true
+	}
+	// the file is shorter than its two meta pages
+	return err.Error() == "file size too small"
+}
+
+// stateCmd represents the state command
+var stateCmd = &cobra.Command{
+	Use:   "state",
+	Short: "Inspect or reset the persisted runtime state",
+	Long: `The exporter keeps the counters of incremental selects in the bucket counters and the tenants of every discovery source in the bucket tenants of the store of StateDir. The store can't be opened while the exporter is running. For example:
+	hana_sql_exporter state inspect --bucket counters
+	hana_sql_exporter state reset --bucket counters --key q01/sapabap1/abap_jobs_total`,
+}
+
+// stateInspectCmd represents the state inspect command
+var stateInspectCmd = &cobra.Command{
+	Use:   "inspect",
+	Short: "Print the records of the state store as json",
+	Run: func(cmd *cobra.Command, args []string) {
+		bucket, _ := cmd.Flags().GetString("bucket")
+
+		store := openStateCmd(cmd)
+		defer store.close()
+
+		records, err := store.records(bucket)
+		if err != nil {
+			exit("Can't read state: ", err)
+		}
+		out, err := json.MarshalIndent(records, "", "  ")
+		if err != nil {
+			exit("Can't print state: ", err)
+		}
+		fmt.Println(string(out))
+	},
+}
+
+// stateResetCmd represents the state reset command
+var stateResetCmd = &cobra.Command{
+	Use:   "reset",
+	Short: "Delete records of the state store",
+	Long: `With the command state reset all records, the records of a bucket or a single record are deleted. For example:
+	hana_sql_exporter state reset
+	hana_sql_exporter state reset --bucket counters --key q01/sapabap1/abap_jobs_total`,
+	Run: func(cmd *cobra.Command, args []string) {
+		bucket, _ := cmd.Flags().GetString("bucket")
+		key, _ := cmd.Flags().GetString("key")
+		if key != "" && bucket == "" {
+			exit("Problem with flags: ", errors.New("--key needs --bucket"))
+		}
+
+		store := openStateCmd(cmd)
+		defer store.close()
+
+		if err := store.reset(bucket, key); err != nil {
+			exit("Can't reset state: ", err)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(stateCmd)
+	stateCmd.AddCommand(stateInspectCmd)
+	stateCmd.AddCommand(stateResetCmd)
+
+	for _, c := range []*cobra.Command{stateInspectCmd, stateResetCmd} {
+		c.Flags().String("state-dir", "", "directory of the state store, StateDir of the config if empty")
+		c.Flags().String("bucket", "", "bucket of the records, all buckets if empty")
+	}
+	stateResetCmd.Flags().String("key", "", "key of the record, all records of the bucket if empty")
+}
+
+// openStateCmd - state store of the config or the --state-dir flag
+func openStateCmd(cmd *cobra.Command) *stateStore {
+	config, err := getConfig()
+	if err != nil {
+		exit("Can't handle config file: ", err)
+	}
+	if err = config.ApplyFlags(cmd.Flags()); err != nil {
+		exit("Problem with flags: ", err)
+	}
+	if config.StateDir == "" {
+		exit("Problem with config: ", errors.New("no StateDir configured"))
+	}
+	store, err := openStateStore(config.StateDir)
+	if err != nil {
+		exit("Can't open state store: ", err)
+	}
+	return store
+}
+
+// stateRecord - versioned record of the state store, records of another
+// version are ignored
+type stateRecord struct {
+	Version int             `json:"version"`
+	Updated time.Time       `json:"updated"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// stateStore - embedded key/value store of the runtime data in StateDir
+type stateStore struct {
+	db   *bolt.DB
+	path string
+}
+
+// openStateStore - open the store in the directory, a corrupt store is moved
+// aside and replaced by an empty one, other errors are returned
+func openStateStore(dir string) (*stateStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "openStateStore(MkdirAll)")
+	}
+	path := filepath.Join(dir, stateFileName)
+
+	db, err := openBolt(path)
+	if err != nil {
+		if _, ok := errors.Cause(err).(corruptError); !ok {
+			return nil, errors.Wrapf(err, "openStateStore(%s)", path)
+		}
+		corrupt := fmt.Sprintf("%s.corrupt.%s", path, time.Now().Format("20060102150405"))
+		log.WithFields(log.Fields{"file": path, "moved_to": corrupt}).WithError(err).Warn("state store corrupt, starting with an empty store")
+		if err := os.Rename(path, corrupt); err != nil {
+			return nil, errors.Wrap(err, "openStateStore(Rename)")
+		}
+		if db, err = openBolt(path); err != nil {
+			return nil, errors.Wrap(err, "openStateStore(openBolt)")
+		}
+	}
+	return &stateStore{db: db, path: path}, nil
+}
+
+// openBolt - open and check the bolt file
+func openBolt(path string) (db *bolt.DB, err error) {
+	// bolt panics on some damaged pages
+	defer func() {
+		if r := recover(); r != nil {
+			if db != nil {
+				db.Close()
+			}
+			db, err = nil, corruptError{errors.Errorf("openBolt(%v)", r)}
+		}
+	}()
+
+	db, err = bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err == bolt.ErrTimeout {
+		return nil, errStateInUse
+	}
+	if err != nil && isCorrupt(err) {
+		return nil, corruptError{errors.Wrap(err, "openBolt(Open)")}
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "openBolt(Open)")
+	}
+	if err = checkBolt(db); err != nil {
+		db.Close()
+		return nil, corruptError{errors.Wrap(err, "openBolt(checkBolt)")}
+	}
+	return db, nil
+}
+
+// checkBolt - read all buckets and check the pages of the file. tx.Check
+// reads the pages in its own goroutine, where a panic on a damaged page
+// can't be recovered. Therefore the buckets are read here first, faults of
+// the mapped file become panics as well. The errors of tx.Check are read
+// until the channel is closed, before the file can be closed.
+func checkBolt(db *bolt.DB) (err error) {
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.Errorf("checkBolt(%v)", r)
+		}
+	}()
+
+	return db.View(func(tx *bolt.Tx) error {
+		if err := tx.ForEach(func(_ []byte, b *bolt.Bucket) error {
+			return walkBucket(b)
+		}); err != nil {
+			return errors.Wrap(err, "checkBolt(ForEach)")
+		}
+
+		var problems []string
+		for err := range tx.Check() {
+			problems = append(problems, err.Error())
+		}
+		if len(problems) > 0 {
+			return errors.Errorf("checkBolt(%s)", strings.Join(problems, ", "))
+		}
+		return nil
+	})
+}
+
+// walkBucket - read all records and nested buckets of the bucket like
+// tx.Check does
+func walkBucket(b *bolt.Bucket) error {
+	return b.ForEach(func(k, _ []byte) error {
+		if child := b.Bucket(k); child != nil {
+			return walkBucket(child)
+		}
+		return nil
+	})
+}
+
+// close - close the store
+func (store *stateStore) close() error {
+	if store == nil {
+		return nil
+	}
+	return errors.Wrap(store.db.Close(), "close(Close)")
+}
+
+// put - write the records of the bucket with the version
+func (store *stateStore) put(bucket string, version int, values map[string]interface{}) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return errors.Wrap(err, "put(CreateBucketIfNotExists)")
+		}
+		now := time.Now().UTC()
+		for key, value := range values {
+			data, err := json.Marshal(value)
+			if err != nil {
+				return errors.Wrapf(err, "put(Marshal %s)", key)
+			}
+			record, err := json.Marshal(stateRecord{Version: version, Updated: now, Data: data})
+			if err != nil {
+				return errors.Wrapf(err, "put(Marshal record %s)", key)
+			}
+			if err := b.Put([]byte(key), record); err != nil {
+				return errors.Wrapf(err, "put(Put %s)", key)
+			}
+		}
+		return nil
+	})
+}
+
+// each - call fn with the data of every record of the bucket with the
+// version, records of other versions and unreadable records are skipped
+func (store *stateStore) each(bucket string, version int, fn func(key string, data json.RawMessage) error) error {
+	return store.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var record stateRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				log.WithFields(log.Fields{"bucket": bucket, "key": string(k)}).WithError(err).Warn("unreadable state record skipped")
+				return nil
+			}
+			if record.Version != version {
+				log.WithFields(log.Fields{"bucket": bucket, "key": string(k), "version": record.Version}).Info("state record of another version skipped")
+				return nil
+			}
+			return fn(string(k), record.Data)
+		})
+	})
+}
+
+// records - all records of the bucket or of all buckets by bucket and key
+func (store *stateStore) records(bucket string) (map[string]map[string]stateRecord, error) {
+	records := make(map[string]map[string]stateRecord)
+	err := store.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			if bucket != "" && string(name) != bucket {
+				return nil
+			}
+			bucketRecords := make(map[string]stateRecord)
+			records[string(name)] = bucketRecords
+			return b.ForEach(func(k, v []byte) error {
+				var record stateRecord
+				if err := json.Unmarshal(v, &record); err != nil {
+					record.Data = json.RawMessage(fmt.Sprintf("%q", string(v)))
+				}
+				bucketRecords[string(k)] = record
+				return nil
+			})
+		})
+	})
+	return records, errors.Wrap(err, "records(View)")
+}
+
+// reset - delete all buckets, one bucket or one record of the bucket
+func (store *stateStore) reset(bucket, key string) error {
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		if key != "" {
+			b := tx.Bucket([]byte(bucket))
+			if b == nil {
+				return nil
+			}
+			return b.Delete([]byte(key))
+		}
+
+		var names []string
+		err := tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			if bucket == "" || string(name) == bucket {
+				names = append(names, string(name))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if err := tx.DeleteBucket([]byte(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return errors.Wrap(err, "reset(Update)")
+}
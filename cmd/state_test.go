@@ -0,0 +1,293 @@
+package cmd_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ulranh/hana_sql_exporter/cmd"
+	"github.com/ulranh/hana_sql_exporter/internal/hdbmock"
+	bolt "go.etcd.io/bbolt"
+)
+
+// stateConfig - config with an incremental job counter and the state directory
+func stateConfig(t *testing.T, dir string) *cmd.Config {
+	config := e2eConfig(t)
+	config.Tenants = config.Tenants[:1]
+	config.StateDir = dir
+	config.Queries = []cmd.QueryInfo{
+		{SQL: "select id, status from <SCHEMA>.tbtco{{if .LastKey}} where id > {{param .LastKey}}{{end}}", KeyColumn: "ID", SchemaFilter: []string{"sapabap1"}, Metrics: []cmd.QueryMetricInfo{
+			{Name: "abap_jobs_total", Help: "jobs", MetricType: "counter", Labels: []string{"STATUS"}},
+		}},
+	}
+	return config
+}
+
+// stateRecords - records of the counters bucket of the state store in dir
+func stateRecords(t *testing.T, dir string) map[string]map[string]interface{} {
+	db, err := bolt.Open(filepath.Join(dir, "state.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	records := make(map[string]map[string]interface{})
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("counters"))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			record := make(map[string]interface{})
+			records[string(k)] = record
+			return json.Unmarshal(v, &record)
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func Test_StateStore(t *testing.T) {
+	assert := assert.New(t)
+
+	drv, err := registerJobs(int64(1), int64(2))
+	assert.Nil(err)
+	dir := t.TempDir()
+	config := stateConfig(t, dir)
+
+	rt := cmd.NewRuntime(config)
+	rt.SQLDriver = drv.Name()
+	assert.Nil(rt.Connect())
+	data := rt.Scrape()
+	assert.Equal(map[string]float64{"a": 2}, valuesBy(data, "abap_jobs_total", "status"))
+	rt.Close()
+
+	records := stateRecords(t, dir)
+	assert.Len(records, 1)
+	assert.Equal(float64(1), records["q01/sapabap1/abap_jobs_total"]["version"])
+	assert.NotEmpty(records["q01/sapabap1/abap_jobs_total"]["updated"])
+
+	// the counters continue after a restart
+	drv, err = registerJobs(int64(3))
+	assert.Nil(err)
+	rt = cmd.NewRuntime(config)
+	rt.SQLDriver = drv.Name()
+	assert.Nil(rt.Connect())
+	data = rt.Scrape()
+	assert.Equal(map[string]float64{"a": 3}, valuesBy(data, "abap_jobs_total", "status"))
+	_, args := executedArgs(drv, "where id > ?")
+	assert.Equal([]interface{}{int64(2)}, args[len(args)-1])
+	rt.Close()
+}
+
+func Test_StateVersion(t *testing.T) {
+	assert := assert.New(t)
+
+	// records of another version are ignored
+	dir := t.TempDir()
+	db, err := bolt.Open(filepath.Join(dir, "state.db"), 0600, nil)
+	assert.Nil(err)
+	assert.Nil(db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("counters"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("q01/sapabap1/abap_jobs_total"), []byte(`{"version":99,"data":{"totals":{"abap_jobs_total":{"a":100}}}}`))
+	}))
+	assert.Nil(db.Close())
+
+	drv, err := registerJobs(int64(1))
+	assert.Nil(err)
+	rt := cmd.NewRuntime(stateConfig(t, dir))
+	rt.SQLDriver = drv.Name()
+	assert.Nil(rt.Connect())
+	data := rt.Scrape()
+	assert.Equal(map[string]float64{"a": 1}, valuesBy(data, "abap_jobs_total", "status"))
+	rt.Close()
+
+	assert.Equal(float64(1), stateRecords(t, dir)["q01/sapabap1/abap_jobs_total"]["version"])
+}
+
+func Test_StateCorruption(t *testing.T) {
+	assert := assert.New(t)
+
+	// a corrupt store is moved aside and replaced by an empty one
+	dir := t.TempDir()
+	assert.Nil(ioutil.WriteFile(filepath.Join(dir, "state.db"), []byte("no bolt database"), 0600))
+
+	drv, err := registerJobs(int64(1))
+	assert.Nil(err)
+	rt := cmd.NewRuntime(stateConfig(t, dir))
+	rt.SQLDriver = drv.Name()
+	assert.Nil(rt.Connect())
+	data := rt.Scrape()
+	assert.Equal(map[string]float64{"a": 1}, valuesBy(data, "abap_jobs_total", "status"))
+	rt.Close()
+
+	corrupt, err := filepath.Glob(filepath.Join(dir, "state.db.corrupt.*"))
+	assert.Nil(err)
+	assert.Len(corrupt, 1)
+	assert.Len(stateRecords(t, dir), 1)
+}
+
+func Test_StateNotCorrupt(t *testing.T) {
+	assert := assert.New(t)
+
+	// errors that are no corruption keep the file and the StateFile is used
+	dir := t.TempDir()
+	assert.Nil(os.Mkdir(filepath.Join(dir, "state.db"), 0700))
+
+	drv, err := registerJobs(int64(1))
+	assert.Nil(err)
+	rt := cmd.NewRuntime(stateConfig(t, dir))
+	rt.SQLDriver = drv.Name()
+	assert.Nil(rt.Connect())
+	rt.Close()
+
+	corrupt, err := filepath.Glob(filepath.Join(dir, "state.db.corrupt.*"))
+	assert.Nil(err)
+	assert.Len(corrupt, 0)
+	info, err := os.Stat(filepath.Join(dir, "state.db"))
+	assert.Nil(err)
+	assert.True(info.IsDir())
+}
+
+func Test_StateDiscoveredTenants(t *testing.T) {
+	assert := assert.New(t)
+
+	// response of the http discovery, empty if it is not available
+	var body atomic.Value
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if body.Load().(string) == "" {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(body.Load().(string)))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	connect := func() *cmd.Runtime {
+		config := &cmd.Config{HTTPSD: []cmd.HTTPSDInfo{{URL: server.URL}}, StateDir: dir}
+		rt := sdRuntime(t, config)
+		assert.Nil(rt.Connect())
+		return rt
+	}
+
+	body.Store(`[{"targets": ["q01host:30015"], "labels": {"tenant": "q01", "user": "monitor"}}]`)
+	rt := connect()
+	assert.Equal(map[string]string{"q01": "monitor"}, tenantUsers(rt))
+	rt.Close()
+
+	// the source is not available after the restart: the saved tenants are used
+	body.Store("")
+	rt = connect()
+	assert.Equal(map[string]string{"q01": "monitor"}, tenantUsers(rt))
+
+	// the source is back without tenants
+	body.Store(`[]`)
+	assert.Nil(rt.RefreshHTTPSD(context.Background(), 0))
+	assert.Equal(0, len(rt.Tenants))
+	rt.Close()
+
+	body.Store("")
+	rt = connect()
+	assert.Equal(0, len(rt.Tenants))
+}
+
+// damagedState - bolt file in dir whose counters page is overwritten with
+// the byte, the meta pages stay valid
+func damagedState(t *testing.T, dir string, fill byte) {
+	path := filepath.Join(dir, "state.db")
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var root int64
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("counters"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 200; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("q01/sapabap1/abap_jobs_%03d", i)), []byte(`{"version":1,"data":{}}`)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.View(func(tx *bolt.Tx) error {
+		root = int64(tx.Bucket([]byte("counters")).Root())
+		return nil
+	})
+	pageSize := db.Info().PageSize
+	db.Close()
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	// keep the page id, damage flags, count and data
+	garbage := bytes.Repeat([]byte{fill}, pageSize-8)
+	if _, err := f.WriteAt(garbage, root*int64(pageSize)+8); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_StateDamaged(t *testing.T) {
+	assert := assert.New(t)
+
+	// damaged pages that make bolt panic or read outside of the file are
+	// detected before the pages are checked
+	for _, fill := range []byte{0xff, 0x01, 0x02} {
+		dir := t.TempDir()
+		damagedState(t, dir, fill)
+
+		drv, err := registerJobs(int64(1))
+		assert.Nil(err)
+		rt := cmd.NewRuntime(stateConfig(t, dir))
+		rt.SQLDriver = drv.Name()
+		assert.Nil(rt.Connect())
+		data := rt.Scrape()
+		assert.Equal(map[string]float64{"a": 1}, valuesBy(data, "abap_jobs_total", "status"))
+		rt.Close()
+
+		corrupt, err := filepath.Glob(filepath.Join(dir, "state.db.corrupt.*"))
+		assert.Nil(err)
+		assert.Len(corrupt, 1, fmt.Sprintf("fill %#x", fill))
+		assert.Len(stateRecords(t, dir), 1)
+	}
+
+	// the check goroutines of bolt are done
+	stack := make([]byte, 1<<20)
+	stack = stack[:runtime.Stack(stack, true)]
+	assert.NotContains(string(stack), "bbolt.(*Tx).check")
+}
+
+// registerJobs - driver with active jobs of the ids
+func registerJobs(ids ...int64) (*hdbmock.Driver, error) {
+	var rows [][]interface{}
+	for _, id := range ids {
+		rows = append(rows, []interface{}{id, "A"})
+	}
+	return hdbmock.Register(append([]hdbmock.Rule{
+		{SQL: `sapabap1\.tbtco`, Columns: []string{"ID", "STATUS"}, Rows: rows},
+	}, metadataRules...)...)
+}
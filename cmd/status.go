@@ -0,0 +1,344 @@
+package cmd
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Status - state of the exporter shown by /status and /api/v1/status
+type Status struct {
+	Started time.Time      `json:"started"`
+	Tenants []TenantStatus `json:"tenants"`
+	Metrics []MetricStatus `json:"metrics"`
+	Queries []QueryStatus  `json:"queries"`
+}
+
+// TenantStatus - connection state and metadata of one tenant
+type TenantStatus struct {
+	Name      string   `json:"name"`
+	ConnStr   string   `json:"conn_str"`
+	Connected bool     `json:"connected"`
+	Error     string   `json:"error,omitempty"`
+	SID       string   `json:"sid"`
+	Version   string   `json:"version"`
+	Usage     string   `json:"usage"`
+	Schemas   []string `json:"schemas"`
+}
+
+// MetricStatus - last runs of one MetricInfo
+type MetricStatus struct {
+	Name     string      `json:"name"`
+	SQL      string      `json:"sql"`
+	Disabled bool        `json:"disabled"`
+	Tenants  []RunStatus `json:"tenants"`
+}
+
+// QueryStatus - last runs of one QueryInfo
+type QueryStatus struct {
+	SQL      string      `json:"sql"`
+	Metrics  []string    `json:"metrics"`
+	Disabled bool        `json:"disabled"`
+	Tenants  []RunStatus `json:"tenants"`
+}
+
+// RunStatus - last run of a metric or query for one applicable tenant,
+// Records counts the metric records, a row can give several
+type RunStatus struct {
+	Tenant     string    `json:"tenant"`
+	LastRun    time.Time `json:"last_run"`
+	DurationMs int64     `json:"duration_ms"`
+	Records    int       `json:"records"`
+	LastError  string    `json:"last_error,omitempty"`
+}
+
+// statusStore - concurrency safe store of tenant states and runs
+type statusStore struct {
+	mu      sync.RWMutex
+	started time.Time
+	tenants map[string]TenantStatus
+	runs    map[runKey]RunStatus
+	success map[runKey]time.Time // start of the last run without errors
+
+	lastScrape    time.Time // end of the last scrape
+	lastScrapeOk  time.Time // end of the last successful scrape
+	lastScrapeErr error
+}
+
+// errScrapeTimeout - the scrape did not finish within the timeout
+var errScrapeTimeout = errors.New("scrape timeout")
+
+// runKey - metric or query position and tenant name
+type runKey struct {
+	kind   string
+	pos    int
+	tenant string
+}
+
+// newStatusStore - empty status store
+func newStatusStore() *statusStore {
+	return &statusStore{
+		started: time.Now(),
+		tenants: make(map[string]TenantStatus),
+		runs:    make(map[runKey]RunStatus),
+		success: make(map[runKey]time.Time),
+	}
+}
+
+// recordTenant - connection state of a tenant, err is nil if connected
+func (s *statusStore) recordTenant(tenant *Tenant, err error) {
+	if s == nil {
+		return
+	}
+	ts := TenantStatus{
+		Name:      tenant.Name,
+		ConnStr:   tenant.ConnStr,
+		Connected: err == nil,
+		SID:       tenant.SID,
+		Version:   tenant.Version,
+		Usage:     tenant.Usage,
+		Schemas:   tenant.Schemas,
+	}
+	if err != nil {
+		ts.Error = err.Error()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tenants[low(tenant.Name)] = ts
+}
+
+// recordPing - result of the latest ping of a connected tenant, the tenant
+// information of recordTenant stays unchanged
+func (s *statusStore) recordPing(name string, err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ts, ok := s.tenants[low(name)]
+	if !ok {
+		return
+	}
+	ts.Connected = err == nil
+	ts.Error = ""
+	if err != nil {
+		ts.Error = err.Error()
+	}
+	s.tenants[low(name)] = ts
+}
+
+// removeTenant - forget the state and the runs of a tenant that no longer exists
+func (s *statusStore) removeTenant(name string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.tenants, low(name))
+	for key := range s.runs {
+		if key.tenant == low(name) {
+			delete(s.runs, key)
+			delete(s.success, key)
+		}
+	}
+}
+
+// recordRun - result of a metric ("metric") or query ("query") run for a tenant
+func (s *statusStore) recordRun(kind string, pos int, tenant string, start time.Time, records int, errs []error) {
+	if s == nil {
+		return
+	}
+	run := RunStatus{
+		Tenant:     tenant,
+		LastRun:    start,
+		DurationMs: time.Since(start).Milliseconds(),
+		Records:    records,
+	}
+	if len(errs) > 0 {
+		msgs := make([]string, len(errs))
+		for i, err := range errs {
+			msgs[i] = err.Error()
+		}
+		run.LastError = strings.Join(msgs, "; ")
+	}
+
+	key := runKey{kind, pos, low(tenant)}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.runs[key] = run
+	if len(errs) == 0 {
+		s.success[key] = start
+	}
+}
+
+// lastSuccess - start of the last run of the metric or query for the tenant
+// without errors, the start of the exporter if there is none
+func (s *statusStore) lastSuccess(kind string, pos int, tenant string) time.Time {
+	if s == nil {
+		return time.Time{}
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if start, ok := s.success[runKey{kind, pos, low(tenant)}]; ok {
+		return start
+	}
+	return s.started
+}
+
+// recordScrape - result of a complete scrape, err is nil if successful
+func (s *statusStore) recordScrape(err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastScrape = time.Now()
+	s.lastScrapeErr = err
+	if err != nil {
+		return
+	}
+	s.lastScrapeOk = s.lastScrape
+}
+
+// tenantRuns - runs of a metric or query sorted by tenant name
+func (s *statusStore) tenantRuns(kind string, pos int) []RunStatus {
+	runs := []RunStatus{}
+	for key, run := range s.runs {
+		if key.kind == kind && key.pos == pos {
+			runs = append(runs, run)
+		}
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i].Tenant < runs[j].Tenant })
+	return runs
+}
+
+// Status - snapshot of tenant states and the last runs of all metrics and queries
+func (rt *Runtime) Status() Status {
+	status := Status{
+		Tenants: []TenantStatus{},
+		Metrics: []MetricStatus{},
+		Queries: []QueryStatus{},
+	}
+	s := rt.status
+	if s == nil {
+		s = newStatusStore()
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	status.Started = s.started
+	for _, ts := range s.tenants {
+		status.Tenants = append(status.Tenants, ts)
+	}
+	sort.Slice(status.Tenants, func(i, j int) bool { return status.Tenants[i].Name < status.Tenants[j].Name })
+
+	for mPos, metric := range rt.Config.Metrics {
+		status.Metrics = append(status.Metrics, MetricStatus{
+			Name:     metric.Name,
+			SQL:      metric.SQL,
+			Disabled: metric.Disabled,
+			Tenants:  s.tenantRuns("metric", mPos),
+		})
+	}
+	for qPos, query := range rt.Config.Queries {
+		qs := QueryStatus{
+			SQL:      query.SQL,
+			Metrics:  []string{},
+			Disabled: query.Disabled,
+			Tenants:  s.tenantRuns("query", qPos),
+		}
+		for _, metric := range query.Metrics {
+			qs.Metrics = append(qs.Metrics, metric.Name)
+		}
+		status.Queries = append(status.Queries, qs)
+	}
+	return status
+}
+
+// StatusHandler - status as json
+func (rt *Runtime) StatusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(rt.Status()); err != nil {
+		log.WithError(err).Error("StatusHandler(Encode)")
+	}
+}
+
+// StatusPageHandler - status as html page
+func (rt *Runtime) StatusPageHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := statusPage.Execute(w, rt.Status()); err != nil {
+		log.WithError(err).Error("StatusPageHandler(Execute)")
+	}
+}
+
+var statusPage = template.Must(template.New("status").Funcs(template.FuncMap{
+	"join": strings.Join,
+	"time": func(t time.Time) string {
+		if t.IsZero() {
+			return "-"
+		}
+		return t.Format("2006-01-02 15:04:05")
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>hana_sql_exporter status</title>
+<style>
+body { font-family: sans-serif; font-size: 14px; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; vertical-align: top; }
+th { background: #eee; }
+.error { color: #b00; }
+pre { margin: 0; white-space: pre-wrap; max-width: 60em; }
+</style>
+</head>
+<body>
+<h1>hana_sql_exporter status</h1>
+<p>Started: {{time .Started}} - <a href="/metrics">metrics</a> - <a href="/api/v1/status">json</a></p>
+
+<h2>Tenants</h2>
+<table>
+<tr><th>Name</th><th>ConnStr</th><th>Connected</th><th>SID</th><th>Version</th><th>Usage</th><th>Schemas</th></tr>
+{{range .Tenants}}<tr>
+<td>{{.Name}}</td><td>{{.ConnStr}}</td>
+<td>{{if .Connected}}yes{{else}}<span class="error">no: {{.Error}}</span>{{end}}</td>
+<td>{{.SID}}</td><td>{{.Version}}</td><td>{{.Usage}}</td><td>{{join .Schemas ", "}}</td>
+</tr>{{end}}
+</table>
+
+<h2>Metrics</h2>
+<table>
+<tr><th>Name</th><th>SQL</th><th>Tenant</th><th>Last run</th><th>Duration ms</th><th>Records</th><th>Last error</th></tr>
+{{range .Metrics}}{{$m := .}}{{if .Tenants}}{{range $i, $r := .Tenants}}<tr>
+{{if eq $i 0}}<td rowspan="{{len $m.Tenants}}">{{$m.Name}}{{if $m.Disabled}} (disabled){{end}}</td><td rowspan="{{len $m.Tenants}}"><pre>{{$m.SQL}}</pre></td>{{end}}
+<td>{{$r.Tenant}}</td><td>{{time $r.LastRun}}</td><td>{{$r.DurationMs}}</td><td>{{$r.Records}}</td><td class="error">{{$r.LastError}}</td>
+</tr>{{end}}{{else}}<tr>
+<td>{{.Name}}{{if .Disabled}} (disabled){{end}}</td><td><pre>{{.SQL}}</pre></td><td colspan="5">no applicable tenant</td>
+</tr>{{end}}{{end}}
+</table>
+
+<h2>Queries</h2>
+<table>
+<tr><th>Metrics</th><th>SQL</th><th>Tenant</th><th>Last run</th><th>Duration ms</th><th>Records</th><th>Last error</th></tr>
+{{range .Queries}}{{$q := .}}{{if .Tenants}}{{range $i, $r := .Tenants}}<tr>
+{{if eq $i 0}}<td rowspan="{{len $q.Tenants}}">{{join $q.Metrics ", "}}{{if $q.Disabled}} (disabled){{end}}</td><td rowspan="{{len $q.Tenants}}"><pre>{{$q.SQL}}</pre></td>{{end}}
+<td>{{$r.Tenant}}</td><td>{{time $r.LastRun}}</td><td>{{$r.DurationMs}}</td><td>{{$r.Records}}</td><td class="error">{{$r.LastError}}</td>
+</tr>{{end}}{{else}}<tr>
+<td>{{join .Metrics ", "}}{{if .Disabled}} (disabled){{end}}</td><td><pre>{{.SQL}}</pre></td><td colspan="5">no applicable tenant</td>
+</tr>{{end}}{{end}}
+</table>
+</body>
+</html>
+`))
@@ -0,0 +1,74 @@
+package cmd_test
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/ulranh/hana_sql_exporter/cmd"
+	"github.com/ulranh/hana_sql_exporter/internal/hdbmock"
+)
+
+func Test_StatusHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	config := getTestConfig(2, 2)
+	config.Queries = []cmd.QueryInfo{
+		{
+			SQL:     "select host, count(*) as cnt from m_connections group by host",
+			Metrics: []cmd.QueryMetricInfo{{Name: "q1"}, {Name: "q2"}},
+		},
+	}
+
+	rt := cmd.NewRuntime(config)
+	rec := httptest.NewRecorder()
+	rt.StatusHandler(rec, httptest.NewRequest("GET", "/api/v1/status", nil))
+	assert.Equal(200, rec.Code)
+	assert.Equal("application/json", rec.Header().Get("Content-Type"))
+
+	var status cmd.Status
+	assert.Nil(json.Unmarshal(rec.Body.Bytes(), &status))
+	assert.Equal(2, len(status.Metrics))
+	assert.Equal(config.Metrics[0].Name, status.Metrics[0].Name)
+	assert.Empty(status.Metrics[0].Tenants)
+	assert.Equal([]string{"q1", "q2"}, status.Queries[0].Metrics)
+
+	rec = httptest.NewRecorder()
+	rt.StatusPageHandler(rec, httptest.NewRequest("GET", "/status", nil))
+	assert.Equal(200, rec.Code)
+	assert.True(strings.Contains(rec.Body.String(), "q1, q2"))
+	assert.True(strings.Contains(rec.Body.String(), "no applicable tenant"))
+}
+
+func Test_StatusRecords(t *testing.T) {
+	assert := assert.New(t)
+
+	drv, err := hdbmock.Register(append([]hdbmock.Rule{
+		{SQL: `m_connections`, Columns: []string{"HOST", "CNT", "IDLE"}, Rows: [][]interface{}{{"h1", int64(3), int64(1)}}},
+	}, metadataRules...)...)
+	assert.Nil(err)
+
+	config := e2eConfig(t)
+	config.Tenants = config.Tenants[:1]
+	config.Queries = []cmd.QueryInfo{
+		{
+			SQL: "select host, count(*) as cnt, 1 as idle from m_connections group by host",
+			Metrics: []cmd.QueryMetricInfo{
+				{Name: "q1", MetricType: "gauge", ValueColumn: "cnt", Labels: []string{"host"}},
+				{Name: "q2", MetricType: "gauge", ValueColumn: "idle", Labels: []string{"host"}},
+			},
+		},
+	}
+	rt := cmd.NewRuntime(config)
+	rt.SQLDriver = drv.Name()
+	assert.Nil(rt.Connect())
+	defer rt.Close()
+
+	// one row gives a record for every metric of the query
+	rt.Scrape()
+	status := rt.Status()
+	assert.Equal(1, len(status.Queries[0].Tenants))
+	assert.Equal(2, status.Queries[0].Tenants[0].Records)
+}
@@ -22,6 +22,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
@@ -34,6 +35,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"github.com/ulranh/hana_sql_exporter/internal"
 )
 
 type collector struct {
@@ -71,57 +73,22 @@ var webCmd = &cobra.Command{
 		if err != nil {
 			exit("Can't handle config file: ", err)
 		}
-		if config.Timeout == 0 {
-			config.Timeout, err = cmd.Flags().GetUint("timeout")
-			if err != nil {
-				exit("Problem with timeout flag: ", err)
-			}
-		}
-		if config.Ip == "" {
-			config.Ip, err = cmd.Flags().GetString("ip")
-			if err != nil {
-				exit("Problem with ip flag: ", err)
-			}
-			if config.Ip == ""  {
-				config.Ip = "127.0.0.1"
-			}
-		}
-		if config.Port == "" {
-			config.Port, err = cmd.Flags().GetString("port")
-			if err != nil {
-				exit("Problem with port flag: ", err)
-			}
-		}
-
-		if config.LogLevel == "" {
-			config.LogLevel, err = cmd.Flags().GetString("log-level")
-			if err != nil {
-				exit("Problem with log level: ", err)
-			}
+		// precedence: flag > environment > config file > default
+		err = config.ApplyFlags(cmd.Flags())
+		if err != nil {
+			exit("Problem with flags: ", err)
 		}
+		config.ApplyDefaults()
 
-		SetLogLevel(config.LogLevel)
-		if config.LogFile == "" {
-			config.LogFile, err = cmd.Flags().GetString("log-file")
-			if err != nil {
-				exit("Problem with log file: ", err)
-			}
+		f, err := SetLogging(config)
+		if err != nil {
+			exit("Can't set up logging: ", err)
 		}
-
-		if config.LogFile != "" {
-			f, err := os.OpenFile(config.LogFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
-			if err != nil {
-				exit("error opening file: %v", err)
-			}
+		if f != nil {
 			defer f.Close() // 确保文件最终会被关闭
-			log.SetOutput(f)
 		}
 
-		// set data func
-		config.DataFunc = config.GetMetricData
-		config.QueryDataFunc = config.GetQueryMetricData
-
-		err = config.Web()
+		err = NewRuntime(config).Web()
 		if err != nil {
 			exit("Can't call exporter: ", err)
 		}
@@ -131,11 +98,13 @@ var webCmd = &cobra.Command{
 func init() {
 	RootCmd.AddCommand(webCmd)
 
-	webCmd.PersistentFlags().UintP("timeout", "t", 30, "scrape timeout of the hana_sql_exporter in seconds.")
-	webCmd.PersistentFlags().StringP("ip", "i", "0.0.0.0", "ip, the hana_sql_exporter listens to.")
-	webCmd.PersistentFlags().StringP("port", "p", "9888", "port, the hana_sql_exporter listens to.")
-	webCmd.PersistentFlags().StringP("log-file", "l", "log.log", "logfile, the logfile location")
-	webCmd.PersistentFlags().String("log-level", "error", "logfile, the log level")
+	webCmd.PersistentFlags().UintP("timeout", "t", defaultTimeout, "scrape timeout of the hana_sql_exporter in seconds.")
+	webCmd.PersistentFlags().StringP("ip", "i", defaultIp, "ip, the hana_sql_exporter listens to.")
+	webCmd.PersistentFlags().StringP("port", "p", defaultPort, "port, the hana_sql_exporter listens to.")
+	webCmd.PersistentFlags().StringP("log-file", "l", defaultLogFile, "logfile, the logfile location")
+	webCmd.PersistentFlags().String("log-level", defaultLogLevel, "logfile, the log level")
+	webCmd.PersistentFlags().String("log-format", defaultLogFormat, "format of the log entries, logfmt or json")
+	webCmd.PersistentFlags().String("state-dir", "", "directory of the state store, overrides StateDir of the config")
 }
 
 // create new collector
@@ -156,8 +125,10 @@ func (c *collector) Collect(ch chan<- prometheus.Metric) {
 	stats := c.stats()
 
 	var valueType = map[string]prometheus.ValueType{
-		"gauge":   prometheus.GaugeValue,
-		"counter": prometheus.CounterValue,
+		"gauge":    prometheus.GaugeValue,
+		"counter":  prometheus.CounterValue,
+		"info":     prometheus.GaugeValue,
+		"stateset": prometheus.GaugeValue,
 	}
 
 	for _, mi := range stats {
@@ -180,10 +151,18 @@ func HealthHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // Web - start collector and web server
-func (config *Config) Web() error {
+func (rt *Runtime) Web() error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	return rt.Serve(ctx)
+}
+
+// Serve - connect the tenants and serve the exporter until ctx is done
+func (rt *Runtime) Serve(ctx context.Context) error {
 	var err error
+	config := rt.Config
 
-	log.Info("开始初始化HANA SQL Exporter服务")
+	log.Info("exporter starting")
 
 	// 添加恢复机制
 	// defer func() {
@@ -192,132 +171,45 @@ func (config *Config) Web() error {
 	// 	}
 	// }()
 
-	config.Tenants, err = config.prepare()
+	err = rt.Connect()
 	if err != nil {
-		log.WithError(err).Error("租户准备失败")
-		return errors.Wrap(err, "租户准备失败")
+		log.WithError(err).Error("tenant preparation failed")
+		return errors.Wrap(err, "Serve(Connect)")
 	}
 
 	// close tenant connections at the end
-	for i := range config.Tenants {
-		defer config.Tenants[i].conn.Close()
-	}
-
-	// // 设置数据采集函数
-	// config.DataFunc = config.GetMetricData
-	// config.QueryDataFunc = config.GetQueryMetricData
-
-	stats := func() []MetricData {
-		start := time.Now()
-		log.Debug("开始收集指标数据")
-
-		// 使用带超时的上下文控制
-		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.Timeout)*time.Second)
-		defer cancel()
-
-		// 创建错误通道
-		// errChan := make(chan error, 1)
-
-		// 创建结果通道
-		resultChan := make(chan []MetricData, 1)
-
-		go func() {
-			// 使用通道并发收集指标数据
-			metricChan := make(chan []MetricData, 2)
-
-			// 并发收集单指标和多指标数据
-			go func() {
-				metrics := config.CollectMetrics()
-				metricChan <- metrics
-			}()
-
-			go func() {
-				queryMetrics := config.CollectQueryMetrics()
-				metricChan <- queryMetrics
-			}()
-
-			// 等待两个收集过程完成
-			var allMetrics []MetricData
-			existingMetricLableValues := make(map[string]struct{})
-
-			// 处理收集到的指标数据
-			for i := 0; i < 2; i++ {
-				metrics := <-metricChan
-				
-				// 检查并合并指标
-				for _, m := range metrics {
-					// 创建一个新的Stats切片用于存储非重复的统计数据
-					var uniqueStats []MetricRecord
-					for _, stat := range m.Stats {
-						key := m.Name + strings.Join(stat.LabelValues, "|")
-						if _, exists := existingMetricLableValues[key]; exists {
-							// 将labels和values组合成键值对形式
-							labelPairs := make([]string, len(stat.Labels))
-							for i := range stat.Labels {
-								labelPairs[i] = fmt.Sprintf("%s:%s", stat.Labels[i], stat.LabelValues[i])
-							}
-							log.WithFields(log.Fields{
-								"metric": m.Name,
-								"labels": strings.Join(labelPairs, ","),
-							}).Warn("跳过重复的指标行")
-							continue
-						}
-						uniqueStats = append(uniqueStats, stat)
-						existingMetricLableValues[key] = struct{}{}
-					}
-					// 更新指标的Stats为去重后的结果
-					m.Stats = uniqueStats
-					if len(m.Stats) > 0 {
-						allMetrics = append(allMetrics, m)
-					}
-				}
-			}
-
-
-			select {
-			case <-ctx.Done():
-				return
-			case resultChan <- allMetrics:
-			}
-		}()
-
-		// 等待结果或超时
-		select {
-		case <-ctx.Done():
-			log.Error("指标收集超时")
-			return []MetricData{}
-		case result := <-resultChan:
-			duration := time.Since(start)
-			log.WithFields(log.Fields{
-				"metrics_count": len(result),
-				"duration_ms":   duration.Milliseconds(),
-			}).Info("指标数据收集完成")
-			return result
-		}
-	}
+	defer rt.Close()
 
 	// start collector
-	log.Info("注册Prometheus收集器")
-	c := newCollector(stats)
-	prometheus.MustRegister(c)
-	if !log.IsLevelEnabled(log.DebugLevel) {
-		prometheus.Unregister(collectors.NewGoCollector())
-		prometheus.Unregister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	log.Info("collector registered")
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(newCollector(rt.Scrape))
+	// tenants with their own debug level don't count
+	if level, _ := parseLogLevel(config.LogLevel); level == log.DebugLevel {
+		registry.MustRegister(collectors.NewGoCollector())
+		registry.MustRegister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
 	}
 
 	// 设置采集处理器选项
 	handlerOpts := promhttp.HandlerOpts{
-		MaxRequestsInFlight: 10, // 限制并发请求数
-		Timeout:             time.Duration(config.Timeout) * time.Second,
+		MaxRequestsInFlight: 10,                                            // 限制并发请求数
+		Timeout:             time.Duration(config.Timeout+1) * time.Second, // Scrape handles its own timeout first
 		EnableOpenMetrics:   true,
 	}
-	handler := promhttp.HandlerFor(prometheus.DefaultGatherer, handlerOpts)
+	handler := promhttp.HandlerFor(registry, handlerOpts)
 
 	// start http server
-	log.WithField("ip", config.Ip).WithField("port", config.Port).Info("启动HTTP服务器")
+	log.WithField("ip", config.Ip).WithField("port", config.Port).Info("http server starting")
 	mux := http.NewServeMux()
-	mux.Handle("/metrics", handler)
+	if !config.DisableMetricsHandler {
+		mux.Handle("/metrics", handler)
+	}
 	mux.HandleFunc("/health", HealthHandler) // 添加健康检查接口
+	mux.HandleFunc("/health/live", LiveHandler)
+	mux.HandleFunc("/health/ready", rt.ReadyHandler)
+	mux.HandleFunc("/status", rt.StatusPageHandler)
+	mux.HandleFunc("/api/v1/status", rt.StatusHandler)
+	mux.HandleFunc("/api/v1/query/", rt.QueryHandler)
 	mux.HandleFunc("/", RootHandler)
 
 	server := &http.Server{
@@ -328,342 +220,309 @@ func (config *Config) Web() error {
 		IdleTimeout:  120 * time.Second,
 	}
 
+	// push the metrics to the remote write and OTLP endpoints
+	rwCtx, rwCancel := context.WithCancel(ctx)
+	defer rwCancel()
+	if len(config.RemoteWrite) > 0 {
+		go func() {
+			if err := rt.PushRemoteWrite(rwCtx); err != nil {
+				log.WithError(err).Error("remote write stopped")
+			}
+		}()
+	}
+	if len(config.OTLP) > 0 {
+		go func() {
+			if err := rt.PushOTLP(rwCtx); err != nil {
+				log.WithError(err).Error("otlp export stopped")
+			}
+		}()
+	}
+
+	// connect the tenants that failed at startup later
+	go rt.retryEvery(rwCtx)
+
+	// discover the tenants of the system databases
+	for _, tenant := range rt.tenantList() {
+		if tenant.SystemDB {
+			go rt.discoverEvery(rwCtx, tenant)
+		}
+	}
+	for pos := range config.FileSD {
+		go rt.watchFileSD(rwCtx, pos)
+	}
+	for pos := range config.HTTPSD {
+		go rt.pollHTTPSD(rwCtx, pos)
+	}
+
 	// 优雅关闭服务
 	go func() {
-		sigChan := make(chan os.Signal, 1)
-		signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
-		<-sigChan
-		log.Info("接收到关闭信号，正在优雅关闭服务...")
+		<-ctx.Done()
+		log.Info("shutdown requested")
 
 		shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 		defer cancel()
 
 		if err := server.Shutdown(shutdownCtx); err != nil {
-			log.WithError(err).Error("服务关闭出错")
+			log.WithError(err).Error("shutdown failed")
 		}
 	}()
 
 	log.WithFields(log.Fields{
 		"address": server.Addr,
 		"timeout": config.Timeout,
-	}).Info("HTTP服务器配置完成，开始监听")
+	}).Info("http server listening")
 
 	err = server.ListenAndServe()
 	if err != nil && err != http.ErrServerClosed {
-		log.WithError(err).Error("HTTP服务器启动失败")
+		log.WithError(err).Error("http server failed")
 		return errors.Wrap(err, "web(ListenAndServe)")
 	}
 	log.WithFields(log.Fields{
-		"url": fmt.Sprintf("http://%s:%s", config.Ip,config.Port),
-	}).Info("服务启动成功，可以通过以下地址访问")
-	fmt.Printf("服务启动成功，可以通过以下地址访问: http://%s:%s\n", config.Ip,config.Port)
+		"url": fmt.Sprintf("http://%s:%s", config.Ip, config.Port),
+	}).Info("http server stopped")
 	return nil
 }
 
+// Scrape - collect all metrics and queries of all tenants within the timeout
+func (rt *Runtime) Scrape() []MetricData {
+	start := time.Now()
+	log.Debug("scrape started")
+
+	// 使用带超时的上下文控制
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(rt.Config.Timeout)*time.Second)
+	defer cancel()
+	ctx = withResultCache(ctx)
+
+	// 创建错误通道
+	// errChan := make(chan error, 1)
+
+	// 创建结果通道
+	resultChan := make(chan []MetricData, 1)
+
+	go func() {
+		// reconnect tenants after a system replication takeover first
+		replication := rt.CheckReplication(ctx)
+		rt.checkTenants()
+
+		// 使用通道并发收集指标数据
+		metricChan := make(chan []MetricData, 2)
+
+		// 并发收集单指标和多指标数据
+		go func() {
+			metrics := rt.CollectMetrics(ctx)
+			metricChan <- metrics
+		}()
+
+		go func() {
+			queryMetrics := rt.CollectQueryMetrics(ctx)
+			metricChan <- queryMetrics
+		}()
+
+		// 等待两个收集过程完成
+		var allMetrics []MetricData
+		existingMetricLableValues := make(map[string]struct{})
+
+		// 处理收集到的指标数据
+		for i := 0; i < 2; i++ {
+			metrics := <-metricChan
+
+			// 检查并合并指标
+			for _, m := range metrics {
+				// 创建一个新的Stats切片用于存储非重复的统计数据
+				var uniqueStats []MetricRecord
+				for _, stat := range m.Stats {
+					key := m.Name + strings.Join(stat.LabelValues, "|")
+					if _, exists := existingMetricLableValues[key]; exists {
+						// 将labels和values组合成键值对形式
+						labelPairs := make([]string, len(stat.Labels))
+						for i := range stat.Labels {
+							labelPairs[i] = fmt.Sprintf("%s:%s", stat.Labels[i], stat.LabelValues[i])
+						}
+						log.WithFields(log.Fields{
+							"metric": m.Name,
+							"labels": strings.Join(labelPairs, ","),
+						}).Warn("duplicate metric row skipped")
+						continue
+					}
+					uniqueStats = append(uniqueStats, stat)
+					existingMetricLableValues[key] = struct{}{}
+				}
+				// 更新指标的Stats为去重后的结果
+				m.Stats = uniqueStats
+				if len(m.Stats) > 0 {
+					allMetrics = append(allMetrics, m)
+				}
+			}
+		}
+		if len(replication.Stats) > 0 {
+			allMetrics = append(allMetrics, replication)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case resultChan <- allMetrics:
+		}
+	}()
+
+	// 等待结果或超时
+	select {
+	case <-ctx.Done():
+		log.WithField("duration_ms", time.Since(start).Milliseconds()).Error("scrape timed out")
+		rt.status.recordScrape(errScrapeTimeout)
+		return []MetricData{}
+	case result := <-resultChan:
+		if err := rt.counters.save(); err != nil {
+			log.WithError(err).Error("can't save state")
+		}
+		if len(result) == 0 {
+			rt.status.recordScrape(errors.New("no metrics collected"))
+		} else {
+			rt.status.recordScrape(nil)
+		}
+		duration := time.Since(start)
+		log.WithFields(log.Fields{
+			"metrics_count": len(result),
+			"duration_ms":   duration.Milliseconds(),
+		}).Info("scrape finished")
+		return result
+	}
+}
+
 // RootHandler - message, when calling mithout /metrics
 func RootHandler(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "prometheus hana_sql_exporter: please call <host>:<port>/metrics")
 }
 
 // CollectMetrics - collecting all metrics and fetch the results
-func (config *Config) CollectMetrics() []MetricData {
+func (rt *Runtime) CollectMetrics(ctx context.Context) []MetricData {
 	var wg sync.WaitGroup
-	metricCnt := len(config.Metrics)
-	metricsC := make(chan MetricData, metricCnt)
-	errC := make(chan error, metricCnt)
+	metrics := rt.Config.Metrics
+	results := make([]MetricData, len(metrics))
 
 	// 创建采集任务
-	for mPos := range config.Metrics {
+	for mPos := range metrics {
 		wg.Add(1)
 		go func(mPos int) {
 			defer wg.Done()
 			defer func() {
 				if r := recover(); r != nil {
 					log.WithFields(log.Fields{
-						"metric": config.Metrics[mPos].Name,
+						"metric": metrics[mPos].Name,
 						"panic":  r,
-					}).Error("指标采集发生严重错误")
-					errC <- fmt.Errorf("metric %s panic: %v", config.Metrics[mPos].Name, r)
+					}).Error("metric collection panicked")
 				}
 			}()
 
-			var stats []MetricRecord
-
-			stats = config.CollectMetric(mPos)
-
-			if len(stats) == 0 {
-				log.WithFields(log.Fields{
-					"metric": config.Metrics[mPos].Name,
-				}).Error("指标采集失败")
-				errC <- fmt.Errorf("metric %s failed", config.Metrics[mPos].Name)
-				return
-			}
-
-			metricsC <- MetricData{
-				Name:       getMetricNameWithUnit(config.Metrics[mPos].Name, config.Metrics[mPos].Unit),
-				Help:       config.Metrics[mPos].Help,
-				MetricType: config.Metrics[mPos].MetricType,
-				Stats:      stats,
+			results[mPos] = MetricData{
+				Name:       getMetricName(metrics[mPos].Name, metrics[mPos].Unit, metrics[mPos].MetricType),
+				Help:       metrics[mPos].Help,
+				MetricType: metrics[mPos].MetricType,
+				Stats:      rt.CollectMetric(ctx, mPos),
 			}
 		}(mPos)
 	}
 
 	// 等待所有任务完成
-	go func() {
-		wg.Wait()
-		close(metricsC)
-		close(errC)
-	}()
+	wg.Wait()
 
-	// 收集结果和错误
+	// 收集结果，保持配置中的顺序
 	var metricsData []MetricData
-	var errors []error
-
-	for i := 0; i < metricCnt; i++ {
-		select {
-		case metric := <-metricsC:
-			if metric.Stats != nil && len(metric.Stats) > 0 {
-				metricsData = append(metricsData, metric)
-			}
-		case err := <-errC:
-			if err != nil {
-				errors = append(errors, err)
-			}
+	failed := 0
+	for mPos, metric := range results {
+		if len(metric.Stats) == 0 {
+			log.WithFields(log.Fields{
+				"metric": metrics[mPos].Name,
+			}).Error("metric collection failed")
+			failed++
+			continue
 		}
+		metricsData = append(metricsData, metric)
 	}
 
 	// 记录采集结果统计
 	log.WithFields(log.Fields{
-		"total_metrics":      metricCnt,
+		"total_metrics":      len(metrics),
 		"successful_metrics": len(metricsData),
-		"failed_metrics":     len(errors),
-	}).Info("指标采集完成")
+		"failed_metrics":     failed,
+	}).Info("metrics collected")
 
 	return metricsData
 }
 
 // CollectMetric - collecting one metric for every tenants
-func (config *Config) CollectMetric(mPos int) []MetricRecord {
-
-	// set timeout
-	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(time.Duration(config.Timeout)*time.Second))
-	defer cancel()
-
-	tenantCnt := len(config.Tenants)
-	metricC := make(chan []MetricRecord, tenantCnt)
+func (rt *Runtime) CollectMetric(ctx context.Context, mPos int) []MetricRecord {
+	query := rt.Config.Metrics[mPos].Query()
 
-	// 添加WaitGroup来等待所有goroutine完成
+	tenants := rt.tenantList()
+	results := make([][]MetricRecord, len(tenants))
 	var wg sync.WaitGroup
-
-	for tPos := range config.Tenants {
+	for tPos := range tenants {
 		wg.Add(1)
 		go func(tPos int) {
 			defer wg.Done()
-			metricC <- config.DataFunc(mPos, tPos)
+			for _, md := range rt.collect(ctx, "metric", mPos, tenants[tPos], query) {
+				results[tPos] = append(results[tPos], md.Stats...)
+			}
 		}(tPos)
 	}
+	wg.Wait()
 
-	// 在单独的goroutine中等待所有任务完成并关闭通道
-	// 等待所有goroutine完成
-	go func() {
-		wg.Wait()
-		close(metricC)
-	}()
-	// collect data
+	// collect data in tenant order
 	var sData []MetricRecord
-	for mc := range metricC {
-		select {
-		case <-ctx.Done():
-			return sData
-		default:
-			if mc != nil {
-				sData = append(sData, mc...)
-			}
-		}
+	for _, records := range results {
+		sData = append(sData, records...)
 	}
 	return sData
 }
 
-// GetMetricData - metric data for one tenant
-func (config *Config) GetMetricData(mPos, tPos int) []MetricRecord {
-	m := config.Metrics[mPos]
-	if m.Disabled {
+// collect - run the query for the tenant with the collector and record the
+// run, nil if the query is disabled or does not apply to the tenant
+func (rt *Runtime) collect(ctx context.Context, kind string, pos int, tenant *Tenant, query QueryInfo) []MetricData {
+	if query.Disabled || !tenant.applies(query.TagFilter, query.VersionFilter) {
 		return nil
 	}
+
 	start := time.Now()
-	logFields := log.Fields{
-		"metric": config.Metrics[mPos].Name,
-		"tenant": config.Tenants[tPos].Name,
-	}
+	ctx = withLastScrape(ctx, rt.status.lastSuccess(kind, pos, tenant.Name))
+	ctx = withCounters(ctx, rt.counters)
+	data, err := rt.collector().Collect(ctx, tenant, query)
 
-	// 获取所有匹配的schema
-	var matchedSchemas []string
-	for _, schema := range config.Metrics[mPos].SchemaFilter {
-		if ContainsString(schema, config.Tenants[tPos].Schemas) {
-			matchedSchemas = append(matchedSchemas, schema)
-		}
+	records := 0
+	for _, md := range data {
+		records += len(md.Stats)
 	}
-
-	if len(matchedSchemas) == 0 {
-		log.WithFields(logFields).Error("metrics schema filter must include at least one tenant schema")
-		return nil
-	}
-
-	var allMetrics []MetricRecord
-	var errors []error
-
-	// 遍历所有匹配的schema执行查询
-	for _, schema := range matchedSchemas {
-		schemaLogFields := log.Fields{
-			"metric": config.Metrics[mPos].Name,
-			"tenant": config.Tenants[tPos].Name,
-			"schema": schema,
-		}
-
-		// 替换SQL中的schema占位符
-		sel := strings.ReplaceAll(config.Metrics[mPos].SQL, "<SCHEMA>", schema)
-		log.WithFields(schemaLogFields).WithField("sql", sel).Debug("执行SQL查询")
-
-
-		// 设置查询超时
-		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.Timeout)*time.Second)
-		rows, err := config.Tenants[tPos].conn.QueryContext(ctx, sel)
-
-		if err != nil {
-			cancel()
-			log.WithFields(schemaLogFields).WithError(err).WithField("sql", sel).Error("数据读取失败")
-			errors = append(errors, fmt.Errorf("schema %s data read failed: %v", schema, err))
-			continue
-		}
-
-		data, cols, err := config.Tenants[tPos].RowsConvert(rows)
-		if err != nil {
-			cancel()
-			log.WithFields(schemaLogFields).WithError(err).Error("数据转换处理失败")
-			errors = append(errors, fmt.Errorf("schema %s convert results failed: %v", schema, err))
-			continue
-		}
-		cancel()
-		// 处理查询结果
-		md, err := config.Tenants[tPos].GetMetricRows(config.Metrics[mPos].Name, data, cols, config.Metrics[mPos].Labels, config.Metrics[mPos].ValueColumn)
-		if err != nil {
-			log.WithFields(schemaLogFields).WithError(err).Error("处理查询结果失败")
-			errors = append(errors, fmt.Errorf("schema %s process results failed: %v", schema, err))
-			continue
-		}
-
-		// 更新schema标签
-		for i := range md {
-			for j, label := range md[i].Labels {
-				if label == "schema" {
-					md[i].LabelValues[j] = low(schema)
-					break
-				}
-			}
-		}
-
-		// 自动添加unit标签会导致在grafana中无法合并多个指标，所以暂时不自动添加unit标签，如果需要单元信息，在grafana中手动添加
-		// 比如：同时进行指标的计数与求和，使用merge功能合并时，因为存在多个unit标签，无法合并在同一个table中显示。
-		// 指标名称本身就带有单位信息，所以不需要再添加unit标签
-
-		// 如果unit不为空，添加unit标签
-		// if config.Metrics[mPos].Unit != "" {
-		// 	for i := range md {
-		// 		// 检查是否已存在unit标签
-		// 		unitLabelExists := false
-		// 		for _, label := range md[i].Labels {
-		// 			if low(label) == "unit" {
-		// 				unitLabelExists = true
-		// 				break
-		// 			}
-		// 		}
-		// 		if !unitLabelExists {
-		// 			md[i].Labels = append(md[i].Labels, "unit")
-		// 			md[i].LabelValues = append(md[i].LabelValues, low(config.Metrics[mPos].Unit))
-		// 		}
-		// 	}
-		// }
-
-		allMetrics = append(allMetrics, md...)
-	}
-
-	duration := time.Since(start)
-	log.WithFields(log.Fields{
-		"metric":       config.Metrics[mPos].Name,
-		"tenant":       config.Tenants[tPos].Name,
-		"schemas":      len(matchedSchemas),
-		"rows_count":   len(allMetrics),
-		"errors_count": len(errors),
-		"duration_ms":  duration.Milliseconds(),
-	}).Info("指标数据采集完成")
-
-	if len(errors) > 0 {
-		log.WithFields(logFields).WithField("errors", errors).Error("部分schema查询失败")
+	var errs []error
+	if err != nil {
+		errs = append(errs, err)
 	}
-
-	return allMetrics
+	rt.status.recordRun(kind, pos, tenant.Name, start, records, errs)
+	return data
 }
 
-// GetSelection - prepare the db selection
-func (config *Config) GetSelection(mPos, tPos int) string {
-	// 检查版本要求
-	if config.Metrics[mPos].VersionFilter != "" {
-		version, err := config.GetHanaVersion(tPos)
-		if err != nil {
-			log.WithFields(log.Fields{
-				"metric": config.Metrics[mPos].Name,
-				"tenant": config.Tenants[tPos].Name,
-				"error":  err,
-			}).Error("获取数据库版本失败")
-			return ""
-		}
-		if !config.CheckVersionRequirement(version, config.Metrics[mPos].VersionFilter) {
-			log.WithFields(log.Fields{
-				"metric":      config.Metrics[mPos].Name,
-				"tenant":      config.Tenants[tPos].Name,
-				"version":     version,
-				"requirement": config.Metrics[mPos].VersionFilter,
-			}).Debug("数据库版本不满足要求，跳过该指标")
-			return ""
-		}
-	}
-
-	// all values of metrics tag filter must be in tenants tags, otherwise the
-	// metric is not relevant for the tenant
-	if !SubSliceInSlice(config.Metrics[mPos].TagFilter, config.Tenants[tPos].Tags) {
-		return ""
-	}
-
-	sel := strings.TrimSpace(config.Metrics[mPos].SQL)
-	if !strings.EqualFold(sel[0:6], "select") {
-		log.WithFields(log.Fields{
-			"metric": config.Metrics[mPos].Name,
-			"tenant": config.Tenants[tPos].Name,
-		}).Error("Only selects are allowed")
-		return ""
-	}
-
-	// 获取所有匹配的schema
-	var matchedSchemas []string
-	for _, schema := range config.Metrics[mPos].SchemaFilter {
-		if ContainsString(schema, config.Tenants[tPos].Schemas) {
-			matchedSchemas = append(matchedSchemas, schema)
-		}
-	}
-
-	if len(matchedSchemas) == 0 {
-		log.WithFields(log.Fields{
-			"metric": config.Metrics[mPos].Name,
-			"tenant": config.Tenants[tPos].Name,
-		}).Error("metrics schema filter must include at least one tenant schema")
-		return ""
+// Query - the metric as query with a single metric
+func (metric MetricInfo) Query() QueryInfo {
+	return QueryInfo{
+		SQL:           metric.SQL,
+		TagFilter:     metric.TagFilter,
+		SchemaFilter:  metric.SchemaFilter,
+		VersionFilter: metric.VersionFilter,
+		Disabled:      metric.Disabled,
+		KeyColumn:     metric.KeyColumn,
+		Metrics: []QueryMetricInfo{{
+			Name:        metric.Name,
+			Help:        metric.Help,
+			MetricType:  metric.MetricType,
+			ValueColumn: metric.ValueColumn,
+			Unit:        metric.Unit,
+			Labels:      metric.Labels,
+			States:      metric.States,
+		}},
 	}
-
-	// 使用第一个匹配的schema作为SQL查询
-	return strings.ReplaceAll(config.Metrics[mPos].SQL, "<SCHEMA>", matchedSchemas[0])
 }
 
-func (tenent *TenantInfo) RowsConvert(rows *sql.Rows) ([][]interface{}, []string, error) {
+// RowsConvert - all rows with the column names
+func RowsConvert(rows *sql.Rows) ([][]interface{}, []string, error) {
 	//exact the sql.Rows out
 	cols, err := rows.Columns()
 	if err != nil {
@@ -695,7 +554,7 @@ func (tenent *TenantInfo) RowsConvert(rows *sql.Rows) ([][]interface{}, []string
 }
 
 // GetMetricRows - return the metric values
-func (tenant *TenantInfo) GetMetricRows(metricName string, rows [][]interface{}, cols []string, labels []string, valueColumn string) ([]MetricRecord, error) {
+func (tenant *Tenant) GetMetricRows(metricName string, rows [][]interface{}, cols []string, labels []string, valueColumn string) ([]MetricRecord, error) {
 	label_search := ""
 	if len(labels) > 0 {
 		label_search = low(strings.Join(labels, ","))
@@ -716,7 +575,7 @@ func (tenant *TenantInfo) GetMetricRows(metricName string, rows [][]interface{},
 		}
 	}
 
-	meta := tenant.Config.getSharedMetaData(tenant.Index)
+	meta := tenant.sharedMetaData()
 
 	var md []MetricRecord
 	for _, values := range rows {
@@ -749,7 +608,7 @@ func (tenant *TenantInfo) GetMetricRows(metricName string, rows [][]interface{},
 								"type":   "string",
 								"value":  v,
 								"metric": metricName,
-							}).Warn("GetMetricRows: 字符串值无法转换为浮点数，使用默认值0")
+							}).Warn("value is no number, using 0")
 							data.Value = 0
 						}
 					}
@@ -759,35 +618,21 @@ func (tenant *TenantInfo) GetMetricRows(metricName string, rows [][]interface{},
 						data.Value = fVal
 					} else {
 						data.Value = 0
-						
-							log.WithFields(log.Fields{
-								"error":  err,
-								"type":   fmt.Sprintf("%T", v),
-								"value":  v,
-								"metric": metricName,
-							}).Warn("GetMetricRows: 不支持的值类型，使用默认值0")
-						
+
+						log.WithFields(log.Fields{
+							"error":  err,
+							"type":   fmt.Sprintf("%T", v),
+							"value":  v,
+							"metric": metricName,
+						}).Warn("unsupported value type, using 0")
+
 					}
 				}
 			} else {
 				// 处理标签列
 				strVal := convertToString(*(values[i].(*interface{})))
-					if len(labels) > 0 {
-						if strings.Contains(label_search, low(cols[i])) {
-							// 检查是否已存在该标签
-							labelExists := false
-							for _, existingLabel := range data.Labels {
-								if existingLabel == low(cols[i]) {
-									labelExists = true
-									break
-								}
-							}
-							if !labelExists {
-								data.Labels = append(data.Labels, low(cols[i]))
-								data.LabelValues = append(data.LabelValues, low(strings.Join(strings.Split(strVal, " "), "_")))
-							}
-						}
-					} else {
+				if len(labels) > 0 {
+					if strings.Contains(label_search, low(cols[i])) {
 						// 检查是否已存在该标签
 						labelExists := false
 						for _, existingLabel := range data.Labels {
@@ -801,6 +646,20 @@ func (tenant *TenantInfo) GetMetricRows(metricName string, rows [][]interface{},
 							data.LabelValues = append(data.LabelValues, low(strings.Join(strings.Split(strVal, " "), "_")))
 						}
 					}
+				} else {
+					// 检查是否已存在该标签
+					labelExists := false
+					for _, existingLabel := range data.Labels {
+						if existingLabel == low(cols[i]) {
+							labelExists = true
+							break
+						}
+					}
+					if !labelExists {
+						data.Labels = append(data.Labels, low(cols[i]))
+						data.LabelValues = append(data.LabelValues, low(strings.Join(strings.Split(strVal, " "), "_")))
+					}
+				}
 			}
 		}
 		md = append(md, data)
@@ -809,127 +668,337 @@ func (tenant *TenantInfo) GetMetricRows(metricName string, rows [][]interface{},
 	return md, nil
 }
 
-// add missing information to tenant struct
-func (config *Config) prepare() ([]TenantInfo, error) {
-	log.Info("开始准备租户连接和信息收集")
-	var tenantsOk []TenantInfo
+// GetTypedMetricRows - return the metric values depending on the metric type
+func (tenant *Tenant) GetTypedMetricRows(metricName, metricType string, states []string, rows [][]interface{}, cols []string, labels []string, valueColumn string) ([]MetricRecord, error) {
+	switch low(metricType) {
+	case "info":
+		return tenant.GetInfoRows(rows, cols)
+	case "stateset":
+		return tenant.GetStateSetRows(metricName, states, rows, cols, labels, valueColumn)
+	default:
+		return tenant.GetMetricRows(metricName, rows, cols, labels, valueColumn)
+	}
+}
+
+// GetInfoRows - one record with value 1 per row, all selected columns are labels
+func (tenant *Tenant) GetInfoRows(rows [][]interface{}, cols []string) ([]MetricRecord, error) {
+	if len(cols) < 1 {
+		return nil, errors.New("GetInfoRows(no columns)")
+	}
+
+	var md []MetricRecord
+	for _, values := range rows {
+		data := tenant.baseRecord()
+		data.Value = 1
+		for i := range values {
+			strVal := ""
+			if values[i] != nil && *(values[i].(*interface{})) != nil {
+				strVal = convertToString(*(values[i].(*interface{})))
+			}
+			data.addLabel(cols[i], strVal)
+		}
+		md = append(md, data)
+	}
+	return md, nil
+}
+
+// GetStateSetRows - one record per allowed state and row, the state column
+// decides which of the records has the value 1
+func (tenant *Tenant) GetStateSetRows(metricName string, states []string, rows [][]interface{}, cols []string, labels []string, valueColumn string) ([]MetricRecord, error) {
+	if len(cols) < 1 {
+		return nil, errors.New("GetStateSetRows(no columns)")
+	}
+	if len(states) == 0 {
+		return nil, errors.New("GetStateSetRows(no states defined)")
+	}
 
-	// 初始化版本缓存
-	// config.versionMutex.Lock()
-	// config.versionCache = make(map[int]string)
-	// config.versionMutex.Unlock()
+	stateColumnIndex := 0
+	if valueColumn != "" {
+		for i, col := range cols {
+			if strings.EqualFold(col, valueColumn) {
+				stateColumnIndex = i
+				break
+			}
+		}
+	}
 
-	// adapt config.Metrics schema filter
-	config.AdaptSchemaFilter()
+	label_search := low(strings.Join(labels, ","))
+	stateLabel := low(metricName)
 
-	secretMap, err := config.GetSecretMap()
-	if err != nil {
-		log.WithError(err).Error("获取密钥映射失败")
-		return nil, errors.Wrap(err, "prepare(getSecretMap)")
+	var md []MetricRecord
+	for _, values := range rows {
+		data := tenant.baseRecord()
+		state := ""
+		for i := range values {
+			if values[i] == nil || *(values[i].(*interface{})) == nil {
+				continue
+			}
+			strVal := convertToString(*(values[i].(*interface{})))
+			if i == stateColumnIndex {
+				state = strings.TrimSpace(strVal)
+				continue
+			}
+			if len(labels) == 0 || strings.Contains(label_search, low(cols[i])) {
+				data.addLabel(cols[i], strVal)
+			}
+		}
+
+		for _, s := range states {
+			record := MetricRecord{
+				Labels:      append(append([]string{}, data.Labels...), stateLabel),
+				LabelValues: append(append([]string{}, data.LabelValues...), s),
+			}
+			if strings.EqualFold(s, state) {
+				record.Value = 1
+			}
+			md = append(md, record)
+		}
 	}
+	return md, nil
+}
 
-	for i := 0; i < len(config.Tenants); i++ {
-		log.WithFields(log.Fields{
-			"tenant":   config.Tenants[i].Name,
-			"conn_str": config.Tenants[i].ConnStr,
-		}).Info("尝试建立租户数据库连接")
+// baseRecord - record with the default labels of every tenant metric
+func (tenant *Tenant) baseRecord() MetricRecord {
+	meta := tenant.sharedMetaData()
+	return MetricRecord{
+		Labels:      append([]string{"tenant", "usage", "schema"}, meta.Labels...),
+		LabelValues: append([]string{low(tenant.Name), low(tenant.Usage), ""}, meta.LabelValues...),
+	}
+}
 
-		config.Tenants[i].conn = config.getConnection(i, secretMap)
-		if config.Tenants[i].conn == nil {
-			log.WithField("tenant", config.Tenants[i].Name).Error("建立数据库连接失败，跳过该租户")
-			continue
+// addLabel - add column as label, if the label does not exist yet
+func (data *MetricRecord) addLabel(col, strVal string) {
+	for _, existingLabel := range data.Labels {
+		if existingLabel == low(col) {
+			return
 		}
+	}
+	data.Labels = append(data.Labels, low(col))
+	data.LabelValues = append(data.LabelValues, low(strings.Join(strings.Split(strVal, " "), "_")))
+}
 
-		// get tenant usage and hana-user schema information
-		log.WithField("tenant", config.Tenants[i].Name).Debug("开始收集租户使用信息和schema权限")
-		err = config.collectRemainingTenantInfos(i)
+// Connect - connect the tenants of the config and add the missing
+// information, tenants that can't be connected are left out. The tenant
+// databases of system databases are discovered afterwards.
+func (rt *Runtime) Connect() error {
+	log.Info("connecting tenants")
+	if rt.status == nil {
+		rt.status = newStatusStore()
+	}
+	if rt.counters == nil {
+		rt.counters = newCounterStore(rt.Config.StateFile)
+	}
+	if rt.Config.StateDir != "" && rt.state == nil {
+		state, err := openStateStore(rt.Config.StateDir)
 		if err != nil {
-			log.WithFields(log.Fields{
-				"tenant": config.Tenants[i].Name,
-				"error":  err,
-			}).Error("收集租户信息失败 - 租户将被移除")
-			continue
+			log.WithError(err).Error("can't open state store, StateFile is used instead")
 		}
+		rt.state = state
+		rt.counters.state = state
+	}
+	if err := rt.counters.load(); err != nil {
+		log.WithError(err).Error("can't read state, the incremental counters start at 0")
+	}
 
-		// 获取并缓存版本信息
-		// version, err := config.getHanaVersionFromDB(i)
-		// if err != nil {
-		// 	log.WithFields(log.Fields{
-		// 		"tenant": config.Tenants[i].Name,
-		// 		"error":  err,
-		// 	}).Error("获取数据库版本失败")
-		// 	continue
-		// }
-		err = config.retrieveMetadata(i)
-		if err != nil {
-			log.WithFields(log.Fields{
-				"tenant": config.Tenants[i].Name,
-				"error":  err,
-			}).Error("获取数据库元数据失败")
+	secretMap, err := rt.Config.GetSecretMap()
+	if err != nil {
+		log.WithError(err).Error("secret map not readable")
+		return errors.Wrap(err, "Connect(getSecretMap)")
+	}
+
+	var tenants []*Tenant
+	var pending []TenantInfo
+	for _, info := range rt.Config.Tenants {
+		if rt.Config.isTemplate(info.Name) {
+			TenantLog(log.Fields{"tenant": info.Name}).Debug("tenant template not connected")
 			continue
 		}
-		// config.versionMutex.Lock()
-		// config.versionCache[i] = version
-		// config.versionMutex.Unlock()
+		// the tenant is a copy, the config stays unchanged
+		if tenant := rt.connectTenant(&Tenant{TenantInfo: info}, secretMap); tenant != nil {
+			tenants = append(tenants, tenant)
+		} else {
+			pending = append(pending, info)
+		}
+	}
 
-		log.WithFields(log.Fields{
-			"tenant":  config.Tenants[i].Name,
-			"usage":   config.Tenants[i].Usage,
-			"schemas": len(config.Tenants[i].Schemas),
-		}).Info("租户元信息收集完成")
+	rt.mu.Lock()
+	rt.Tenants = tenants
+	rt.pending = pending
+	rt.mu.Unlock()
 
-		config.Tenants[i].Config = config
-		config.Tenants[i].Index = i
-		tenantsOk = append(tenantsOk, config.Tenants[i])
+	// sources that are not available start with the tenants of the last run
+	for _, tenant := range tenants {
+		if tenant.SystemDB {
+			if err := rt.Discover(context.Background(), tenant); err != nil {
+				log.WithField("tenant", tenant.Name).WithError(err).Error("tenant discovery failed")
+				rt.restoreDiscovered("systemdb:"+tenant.Name, tenant)
+			}
+		}
+	}
+	for _, info := range pending {
+		if info.SystemDB {
+			rt.restoreDiscovered("systemdb:"+info.Name, nil)
+		}
+	}
+	for pos := range rt.Config.FileSD {
+		if err := rt.RefreshFileSD(pos); err != nil {
+			log.WithError(err).Error("file discovery failed")
+			rt.restoreDiscovered(fmt.Sprintf("file_sd:%d", pos), nil)
+		}
+	}
+	for pos := range rt.Config.HTTPSD {
+		if err := rt.RefreshHTTPSD(context.Background(), pos); err != nil {
+			log.WithError(err).Error("http discovery failed")
+			rt.restoreDiscovered(fmt.Sprintf("http_sd:%d", pos), nil)
+		}
 	}
 
-	log.WithField("total_tenants", len(tenantsOk)).Info("租户准备完成")
-	return tenantsOk, nil
+	log.WithField("total_tenants", len(rt.tenantList())).Info("tenants connected")
+	return nil
 }
 
-// get tenant usage and hana-user schema information
-func (config *Config) collectRemainingTenantInfos(tPos int) error {
+// RetryTenants - connect the configured tenants that could not be connected
+// before, the newly connected tenants are returned
+func (rt *Runtime) RetryTenants(ctx context.Context) []*Tenant {
+	rt.mu.RLock()
+	pending := append([]TenantInfo(nil), rt.pending...)
+	rt.mu.RUnlock()
+	if len(pending) == 0 {
+		return nil
+	}
 
-	// get tenant usage information
-	row := config.Tenants[tPos].conn.QueryRow("select usage from sys.m_database")
-	err := row.Scan(&config.Tenants[tPos].Usage)
+	secretMap, err := rt.Config.GetSecretMap()
 	if err != nil {
-		return errors.Wrap(err, "collectRemainingTenantInfos(Scan)")
+		log.WithError(err).Error("secret map not readable")
+		return nil
 	}
 
-	// append sys schema to tenant schemas
-	config.Tenants[tPos].Schemas = append(config.Tenants[tPos].Schemas, "sys")
-
-	// append remaining user schema privileges
-	rows, err := config.Tenants[tPos].conn.Query("select schema_name from sys.granted_privileges where object_type='SCHEMA' and grantee=$1", strings.ToUpper(config.Tenants[tPos].User))
-	if err != nil {
-		return errors.Wrap(err, "collectRemainingTenantInfos(Query)")
+	var connected []*Tenant
+	var failed []TenantInfo
+	for _, info := range pending {
+		if tenant := rt.connectTenant(&Tenant{TenantInfo: info}, secretMap); tenant != nil {
+			connected = append(connected, tenant)
+		} else {
+			failed = append(failed, info)
+		}
 	}
 
-	for rows.Next() {
-		var schema string
-		err := rows.Scan(&schema)
-		if err != nil {
-			return errors.Wrap(err, "collectRemainingTenantInfos(Scan)")
+	rt.mu.Lock()
+	if rt.closed {
+		rt.mu.Unlock()
+		for _, tenant := range connected {
+			tenant.close()
 		}
-		config.Tenants[tPos].Schemas = append(config.Tenants[tPos].Schemas, schema)
+		return nil
 	}
-	if err = rows.Err(); err != nil {
-		return errors.Wrap(err, "collectRemainingTenantInfos(rows.Err)")
+	rt.Tenants = append(rt.Tenants, connected...)
+	rt.pending = failed
+	rt.mu.Unlock()
+
+	for _, tenant := range connected {
+		if tenant.SystemDB {
+			if err := rt.Discover(ctx, tenant); err != nil {
+				log.WithField("tenant", tenant.Name).WithError(err).Error("tenant discovery failed")
+			}
+		}
 	}
-	return nil
+	return connected
 }
 
-// AdaptSchemaFilter - add sys schema to SchemaFilter if it does not exists
-func (config *Config) AdaptSchemaFilter() {
+// retryEvery - retry the tenants that are not connected every
+// reconnectInterval until ctx is done
+func (rt *Runtime) retryEvery(ctx context.Context) {
+	ticker := time.NewTicker(reconnectInterval)
+	defer ticker.Stop()
 
-	for mPos := range config.Metrics {
-		if len(config.Metrics[mPos].SchemaFilter) == 0 {
-			config.Metrics[mPos].SchemaFilter = append(config.Metrics[mPos].SchemaFilter, "sys")
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, tenant := range rt.RetryTenants(ctx) {
+			if tenant.SystemDB {
+				go rt.discoverEvery(ctx, tenant)
+			}
 		}
 	}
 }
 
+// connectTenant - connect the tenant and add the missing information, nil if
+// the tenant can't be connected
+func (rt *Runtime) connectTenant(tenant *Tenant, secretMap internal.Secret) *Tenant {
+	tenant.Schemas = append([]string{}, tenant.Schemas...)
+
+	TenantLog(log.Fields{
+		"tenant":   tenant.Name,
+		"conn_str": tenant.ConnStr,
+	}).Info("tenant connecting")
+
+	if len(tenant.Hosts) > 0 {
+		tenant.sites = rt.connectSites(context.Background(), tenant, secretMap)
+	} else {
+		tenant.conn = rt.getConnection(context.Background(), tenant, tenant.ConnStr, secretMap)
+	}
+	if tenant.DB() == nil {
+		log.WithField("tenant", tenant.Name).Error("tenant connection failed, tenant skipped")
+		rt.status.recordTenant(tenant, errors.New("no connection, check password and ConnStr"))
+		tenant.close()
+		return nil
+	}
+
+	if tenant.LogLevel != "" {
+		setTenantLogLevel(tenant.Name, tenant.LogLevel)
+	}
+
+	// get tenant usage and hana-user schema information
+	TenantLog(log.Fields{"tenant": tenant.Name}).Debug("reading tenant usage and schemas")
+	err := tenant.collectRemainingTenantInfos()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"tenant": tenant.Name,
+			"error":  err,
+		}).Error("tenant information not readable, tenant removed")
+		rt.status.recordTenant(tenant, err)
+		tenant.close()
+		return nil
+	}
+
+	err = tenant.retrieveMetadata()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"tenant": tenant.Name,
+			"error":  err,
+		}).Error("tenant metadata not readable")
+		rt.status.recordTenant(tenant, err)
+		tenant.close()
+		return nil
+	}
+
+	TenantLog(log.Fields{
+		"tenant":  tenant.Name,
+		"usage":   tenant.Usage,
+		"schemas": len(tenant.Schemas),
+	}).Info("tenant connected")
+
+	rt.status.recordTenant(tenant, nil)
+	return tenant
+}
+
+// get tenant usage and hana-user schema information
+func (tenant *Tenant) collectRemainingTenantInfos() error {
+
+	// get tenant usage information
+	row := tenant.DB().QueryRow("select usage from sys.m_database")
+	err := row.Scan(&tenant.Usage)
+	if err != nil {
+		return errors.Wrap(err, "collectRemainingTenantInfos(Scan)")
+	}
+
+	// append sys and the granted schemas of the user and its roles
+	return errors.Wrap(tenant.readSchemas(context.Background()), "collectRemainingTenantInfos(readSchemas)")
+}
+
 // ContainsString - true, if slice contains string
 func ContainsString(str string, slice []string) bool {
 	for _, s := range slice {
@@ -966,175 +1035,136 @@ func FirstValueInSlice(subSlice []string, slice []string) string {
 	return ""
 }
 
-// ---------------------------------------------------------------------
-
-// GetTestData1 - for testing purpose only
-func (config *Config) GetTestData1(mPos, tPos int) []MetricRecord {
-	mr := []MetricRecord{
-		{
-			999.0,
-			[]string{"l" + strconv.Itoa(mPos) + strconv.Itoa(tPos)},
-			[]string{"lv" + strconv.Itoa(mPos) + strconv.Itoa(tPos)},
-		},
-	}
-	return mr
-}
-
-// GetTestData2 - for testing purpose only
-func (config *Config) GetTestData2(mPos, tPos int) []MetricRecord {
-	return nil
-}
-
 // CollectQueryMetrics - 收集所有多指标查询的结果
-func (config *Config) CollectQueryMetrics() []MetricData {
+func (rt *Runtime) CollectQueryMetrics(ctx context.Context) []MetricData {
 	var wg sync.WaitGroup
-	queryCnt := len(config.Queries)
-	queriesC := make(chan []MetricData, queryCnt)
+	results := make([][]MetricData, len(rt.Config.Queries))
 
-	for qPos := range config.Queries {
+	for qPos := range rt.Config.Queries {
 		wg.Add(1)
 		go func(qPos int) {
 			defer wg.Done()
-			queriesC <- config.CollectQueryMetric(qPos)
+			results[qPos] = rt.CollectQueryMetric(ctx, qPos)
 		}(qPos)
 	}
-
-	go func() {
-		wg.Wait()
-		close(queriesC)
-	}()
+	wg.Wait()
 
 	var metricsData []MetricData
-	for query := range queriesC {
-		if query != nil {
-			metricsData = append(metricsData, query...)
-		}
+	for _, query := range results {
+		metricsData = append(metricsData, query...)
 	}
-
 	return metricsData
 }
 
 // CollectQueryMetric - 为每个租户收集一个查询的多个指标
-func (config *Config) CollectQueryMetric(qPos int) []MetricData {
-	// 设置超时
-	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(time.Duration(config.Timeout)*time.Second))
-	defer cancel()
+func (rt *Runtime) CollectQueryMetric(ctx context.Context, qPos int) []MetricData {
+	query := rt.Config.Queries[qPos]
+	if query.systemDB() {
+		return rt.collectSystemDB(ctx, qPos, query)
+	}
 
-	tenantCnt := len(config.Tenants)
-	metricC := make(chan []MetricData, tenantCnt)
+	tenants := rt.tenantList()
+	if query.secondary() {
+		tenants = secondarySites(tenants)
+	}
+	results := make([][]MetricData, len(tenants))
 	var wg sync.WaitGroup
-	for tPos := range config.Tenants {
+	for tPos := range tenants {
 		wg.Add(1)
 		go func(tPos int) {
 			defer wg.Done()
-
-			metricC <- config.QueryDataFunc(qPos, tPos)
+			results[tPos] = rt.collect(ctx, "query", qPos, tenants[tPos], query)
 		}(tPos)
 	}
-	go func() {
-		wg.Wait()
-		close(metricC)
-	}()
-	// 收集数据
+	wg.Wait()
+
+	// 按租户顺序收集数据
 	var sData []MetricData
-	for mc := range metricC {
-		select {
-		case <-ctx.Done():
-			return sData
-		default:
-			if mc != nil {
-				sData = append(sData, mc...)
-			}
-		}
+	for _, data := range results {
+		sData = append(sData, data...)
 	}
 	return sData
 }
 
-// GetQueryMetricData - 为一个租户获取查询的多个指标数据
-func (config *Config) GetQueryMetricData(qPos, tPos int) []MetricData {
-	if config.Queries[qPos].Disabled {
-		return nil
-	}
+// SQLCollector - runs the select of a query with every granted schema on
+// the tenant connection
+type SQLCollector struct{}
+
+// Collect - metrics of the query for one tenant, on failing schemas the
+// metrics of the remaining schemas are returned together with the error
+func (SQLCollector) Collect(ctx context.Context, tenant *Tenant, query QueryInfo) ([]MetricData, error) {
+	logFields := query.logFields(tenant)
 
 	// 检查所有子指标是否都被禁用
 	allDisabled := true
-	for _, metric := range config.Queries[qPos].Metrics {
+	for _, metric := range query.Metrics {
 		if !metric.Disabled {
 			allDisabled = false
 			break
 		}
 	}
 	if allDisabled {
-		log.WithFields(log.Fields{
-			"query":   config.Queries[qPos].SQL,
-			"tenant":  config.Tenants[tPos].Name,
-			"metrics": len(config.Queries[qPos].Metrics),
-		}).Info("跳过执行查询，所有子指标已禁用")
-		return nil
+		TenantLog(logFields).Info("query skipped, all metrics disabled")
+		return nil, nil
+	}
+	db := tenant.DB()
+	if db == nil {
+		return nil, errors.Errorf("Collect(tenant %s is not connected)", tenant.Name)
 	}
 
 	start := time.Now()
-	logFields := log.Fields{
-		"query":  config.Queries[qPos].SQL,
-		"tenant": config.Tenants[tPos].Name,
-	}
 
 	// 获取所有匹配的schema
-	var matchedSchemas []string
-	if len(config.Queries[qPos].SchemaFilter) == 0 {
-		config.Queries[qPos].SchemaFilter = []string{"sys"}
-	}
-
-	for _, schema := range config.Queries[qPos].SchemaFilter {
-		if ContainsString(schema, config.Tenants[tPos].Schemas) {
-			matchedSchemas = append(matchedSchemas, schema)
-		}
-	}
-
+	matchedSchemas := tenant.grantedSchemas(query.SchemaFilter)
 	if len(matchedSchemas) == 0 {
 		log.WithFields(logFields).Error("query schema filter must include at least one tenant schema")
-		return nil
+		return nil, errNoSchema
 	}
 
 	var allMetrics []MetricData
+	var errs []error
 	// 遍历所有匹配的schema执行查询
 	for _, schema := range matchedSchemas {
-		// 替换SQL中的schema占位符
-		sel := strings.ReplaceAll(config.Queries[qPos].SQL, "<SCHEMA>", schema)
-		log.WithFields(logFields).WithField("schema", schema).WithField("sql", sel).Debug("执行SQL查询")
-
-		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.Timeout)*time.Second)
-
-		rows, err := config.Tenants[tPos].conn.QueryContext(ctx, sel)
+		// incremental selects only read the rows after the high-water mark
+		if query.incremental() {
+			md, err := tenant.collectIncremental(ctx, db, query, schema)
+			if err != nil {
+				log.WithFields(logFields).WithField("schema", schema).WithError(err).Error("incremental query failed")
+				errs = append(errs, fmt.Errorf("schema %s incremental query failed: %v", schema, err))
+			}
+			allMetrics = append(allMetrics, md...)
+			continue
+		}
 
-		// rows, err := config.Tenants[tPos].conn.Query(sel)
+		// 替换SQL中的schema占位符和模板变量
+		sel, args, err := tenant.statement(query.SQL, tenant.sqlVars(schema, lastScrape(ctx)))
 		if err != nil {
-			cancel()
-			log.WithFields(logFields).WithField("schema", schema).WithField("sql", sel).WithError(err).Error("执行SQL查询失败")
+			log.WithFields(logFields).WithField("schema", schema).WithError(err).Error("sql template failed")
+			errs = append(errs, fmt.Errorf("schema %s sql template failed: %v", schema, err))
 			continue
 		}
-		data, cols, err := config.Tenants[tPos].RowsConvert(rows)
+		TenantLog(logFields).WithField("schema", schema).WithField("sql", sel).Debug("query running")
+
+		// identical selects of the scrape share their rows
+		data, cols, err := queryRows(ctx, db, sel, args...)
 		if err != nil {
-			cancel()
-			log.WithFields(logFields).WithField("schema", schema).WithError(err).Error("数据转换处理失败")
+			log.WithFields(logFields).WithField("schema", schema).WithField("sql", sel).WithError(err).Error("query failed")
+			errs = append(errs, fmt.Errorf("schema %s data read failed: %v", schema, err))
 			continue
 		}
-		cancel()
+
 		// 处理查询结果
-		var metricsData []MetricData
-		for _, metric := range config.Queries[qPos].Metrics {
+		for _, metric := range query.Metrics {
 			if metric.Disabled {
 				continue
 			}
-			metricData := MetricData{
-				Name:       getMetricNameWithUnit(metric.Name, metric.Unit),
-				Help:       metric.Help,
-				MetricType: metric.MetricType,
-			}
-
-			md, err := config.Tenants[tPos].GetMetricRows(metric.Name, data, cols, metric.Labels, metric.ValueColumn)
+			md, err := tenant.typedRows(query, metric, data, cols)
 			if err != nil {
-				log.WithFields(logFields).WithField("schema", schema).WithError(err).Error("处理查询结果失败")
+				log.WithFields(logFields).WithField("schema", schema).WithError(err).Error("query result processing failed")
+				errs = append(errs, fmt.Errorf("schema %s metric %s process results failed: %v", schema, metric.Name, err))
+				continue
+			}
+			if len(md) == 0 {
 				continue
 			}
 
@@ -1148,121 +1178,83 @@ func (config *Config) GetQueryMetricData(qPos, tPos int) []MetricData {
 				}
 			}
 
-			// 自动添加unit标签会导致在grafana中无法合并多个指标，所以暂时不自动添加unit标签，如果需要单元信息，在grafana中手动添加
-			// 比如：同时进行指标的计数与求和，使用merge功能合并时，因为存在多个unit标签，无法合并在同一个table中显示。
-			// 指标名称本身就带有单位信息，所以不需要再添加unit标签
-
-			// 如果unit不为空，添加unit标签
-			// if metric.Unit != "" {
-			// 	for i := range md {
-			// 		// 检查是否已存在unit标签
-			// 		unitLabelExists := false
-			// 		for _, label := range md[i].Labels {
-			// 			if low(label) == "unit" {
-			// 				unitLabelExists = true
-			// 				break
-			// 			}
-			// 		}
-			// 		if !unitLabelExists {
-			// 			md[i].Labels = append(md[i].Labels, "unit")
-			// 			md[i].LabelValues = append(md[i].LabelValues, low(metric.Unit))
-			// 		}
-			// 	}
-			// }
-
-			metricData.Stats = append(metricData.Stats, md...)
-			if len(metricData.Stats) > 0 {
-				metricsData = append(metricsData, metricData)
-			}
+			// 指标名称本身就带有单位信息，所以不自动添加unit标签，
+			// 否则在grafana中无法合并多个指标
+			allMetrics = append(allMetrics, MetricData{
+				Name:       getMetricName(metric.Name, metric.Unit, metric.MetricType),
+				Help:       metric.Help,
+				MetricType: metric.MetricType,
+				Stats:      md,
+			})
 		}
-		allMetrics = append(allMetrics, metricsData...)
 	}
 
-	duration := time.Since(start)
-	log.WithFields(log.Fields{
-		"query":       config.Queries[qPos].SQL,
-		"tenant":      config.Tenants[tPos].Name,
+	TenantLog(logFields).WithFields(log.Fields{
 		"schemas":     len(matchedSchemas),
-		"metrics":     len(allMetrics),
-		"duration_ms": duration.Milliseconds(),
-	}).Debug("查询数据收集完成")
+		"records":     len(allMetrics),
+		"errors":      len(errs),
+		"duration_ms": time.Since(start).Milliseconds(),
+	}).Debug("query finished")
 
-	return allMetrics
+	return allMetrics, joinErrors(errs)
 }
 
-// GetSelection - prepare the db selection for multi-metric query
-func (config *Config) GetQuerySelection(qPos, tPos int) string {
-	// 检查版本要求
-	if config.Queries[qPos].VersionFilter != "" {
-		version, err := config.GetHanaVersion(tPos)
-		if err != nil {
-			log.WithFields(log.Fields{
-				"query":  config.Queries[qPos].SQL,
-				"tenant": config.Tenants[tPos].Name,
-				"error":  err,
-			}).Error("获取数据库版本失败")
-			return ""
-		}
-		if !config.CheckVersionRequirement(version, config.Queries[qPos].VersionFilter) {
-			log.WithFields(log.Fields{
-				"query":       config.Queries[qPos].SQL,
-				"tenant":      config.Tenants[tPos].Name,
-				"version":     version,
-				"requirement": config.Queries[qPos].VersionFilter,
-			}).Debug("数据库版本不满足要求，跳过该查询")
-			return ""
-		}
+// typedRows - records of one metric of the query, the records of systemdb
+// queries get the database name of their row
+func (tenant *Tenant) typedRows(query QueryInfo, metric QueryMetricInfo, data [][]interface{}, cols []string) ([]MetricRecord, error) {
+	if !query.systemDB() {
+		return tenant.GetTypedMetricRows(metric.Name, metric.MetricType, metric.States, data, cols, metric.Labels, metric.ValueColumn)
 	}
 
-	// all values of query tag filter must be in tenants tags
-	if !SubSliceInSlice(config.Queries[qPos].TagFilter, config.Tenants[tPos].Tags) {
-		return ""
+	dbPos := -1
+	for i, col := range cols {
+		if strings.EqualFold(col, query.databaseColumn()) {
+			dbPos = i
+			break
+		}
 	}
-
-	sel := strings.TrimSpace(config.Queries[qPos].SQL)
-	if !strings.EqualFold(sel[0:6], "select") {
-		log.WithFields(log.Fields{
-			"query":  config.Queries[qPos].SQL,
-			"tenant": config.Tenants[tPos].Name,
-		}).Error("Only selects are allowed")
-		return ""
+	if dbPos < 0 {
+		return nil, errors.Errorf("typedRows(database column %s missing)", query.databaseColumn())
 	}
 
-	if len(config.Queries[qPos].SchemaFilter) == 0 {
-		config.Queries[qPos].SchemaFilter = []string{"sys"}
-	}
-	// 获取所有匹配的schema
-	var matchedSchemas []string
-	for _, schema := range config.Queries[qPos].SchemaFilter {
-		if ContainsString(schema, config.Tenants[tPos].Schemas) {
-			matchedSchemas = append(matchedSchemas, schema)
+	var md []MetricRecord
+	for _, row := range data {
+		records, err := tenant.GetTypedMetricRows(metric.Name, metric.MetricType, metric.States, [][]interface{}{row}, cols, metric.Labels, metric.ValueColumn)
+		if err != nil {
+			return nil, errors.Wrap(err, "typedRows(GetTypedMetricRows)")
+		}
+		database := ""
+		if v := *(row[dbPos].(*interface{})); v != nil {
+			database = convertToString(v)
+		}
+		for i := range records {
+			records[i].setLabel("database_name", database)
 		}
+		md = append(md, records...)
 	}
+	return md, nil
+}
 
-	if len(matchedSchemas) == 0 {
-		log.WithFields(log.Fields{
-			"query":  config.Queries[qPos].SQL,
-			"tenant": config.Tenants[tPos].Name,
-		}).Error("query schema filter must include at least one tenant schema")
-		return ""
+// setLabel - change the value of an existing label
+func (data *MetricRecord) setLabel(label, value string) {
+	for i := range data.Labels {
+		if data.Labels[i] == label {
+			data.LabelValues[i] = value
+			return
+		}
 	}
-
-	// 使用第一个匹配的schema作为SQL查询
-	return strings.ReplaceAll(config.Queries[qPos].SQL, "<SCHEMA>", matchedSchemas[0])
 }
 
-// GetHanaVersion - 获取SAP HANA数据库版本
-func (config *Config) GetHanaVersion(tPos int) (string, error) {
-	// 从缓存中获取版本信息
-	// config.versionMutex.RLock()
-	version := config.Tenants[tPos].Version
-	// config.versionMutex.RUnlock()
-
-	if version == "" {
-		return "", errors.New("version information not found in cache")
+// joinErrors - one error with all messages, nil without errors
+func joinErrors(errs []error) error {
+	if len(errs) == 0 {
+		return nil
 	}
-
-	return version, nil
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return errors.New(strings.Join(msgs, "; "))
 }
 
 // func (config *Config) getHanaVersionFromDB(tPos int) (string, error) {
@@ -1275,16 +1267,24 @@ func (config *Config) GetHanaVersion(tPos int) (string, error) {
 // 	return version, nil
 // }
 
+// blanks after a version operator
+var versionOperatorBlanks = regexp.MustCompile(`(>=|<=|>|<|=)\s+`)
+
 // CheckVersionRequirement - 检查版本是否满足要求
 func (config *Config) CheckVersionRequirement(version, requirement string) bool {
+	return checkVersionRequirement(version, requirement)
+}
+
+// checkVersionRequirement - version matches all conditions of the requirement
+func checkVersionRequirement(version, requirement string) bool {
 	// 解析版本要求
 	req := strings.TrimSpace(requirement)
 	if req == "" {
 		return true
 	}
 
-	// 分割多个条件
-	conditions := strings.Split(req, " ")
+	// 分割多个条件, blanks between operator and version are allowed (">= 2.00.040")
+	conditions := strings.Fields(versionOperatorBlanks.ReplaceAllString(req, "$1"))
 
 	for _, cond := range conditions {
 		cond = strings.TrimSpace(cond)
@@ -1348,7 +1348,7 @@ func (config *Config) CheckVersionRequirement(version, requirement string) bool
 func parseFractionToFloat(value string) (float64, error) {
 	// 去除前导和尾随空格
 	value = strings.TrimSpace(value)
-	
+
 	parts := strings.Split(value, "/")
 	if len(parts) == 2 {
 		// 处理分数形式
@@ -1361,11 +1361,11 @@ func parseFractionToFloat(value string) (float64, error) {
 			return 0, err
 		}
 		if denominator == 0 {
-			return 0, fmt.Errorf("除数不能为零")
+			return 0, fmt.Errorf("division by zero")
 		}
 		return numerator / denominator, nil
 	}
-	
+
 	// 处理普通数值
 	return strconv.ParseFloat(value, 64)
 }
@@ -1422,8 +1422,8 @@ func convertToString(v interface{}) string {
 	}
 }
 
-// retrieveMetadata 获取数据库元数据并填充到TenantInfo
-func (config *Config) retrieveMetadata(tId int) error {
+// retrieveMetadata 获取数据库元数据并填充到Tenant
+func (tenant *Tenant) retrieveMetadata() error {
 	query := `SELECT
 (SELECT value FROM M_SYSTEM_OVERVIEW WHERE section = 'System' AND name = 'Instance ID') SID,
 (SELECT value FROM M_SYSTEM_OVERVIEW WHERE section = 'System' AND name = 'Instance Number') INSNR,
@@ -1431,35 +1431,46 @@ m.database_name,
 m.version
 FROM m_database m`
 
-	row := config.Tenants[tId].conn.QueryRow(query)
+	row := tenant.DB().QueryRow(query)
 	err := row.Scan(
-		&config.Tenants[tId].SID,
-		&config.Tenants[tId].InstanceNumber,
-		&config.Tenants[tId].DatabaseName,
-		&config.Tenants[tId].Version,
+		&tenant.SID,
+		&tenant.InstanceNumber,
+		&tenant.DatabaseName,
+		&tenant.Version,
 	)
 	if err != nil {
 		log.WithFields(log.Fields{
-			"tenant": config.Tenants[tId].Name,
+			"tenant": tenant.Name,
 			"error":  err,
-		}).Error("获取数据库元数据失败")
+		}).Error("tenant metadata not readable")
 		return err
 	}
 	return nil
 }
 
 // 获取共享的元数据标签记录
-func (config *Config) getSharedMetaData(tId int) MetricRecord {
+func (tenant *Tenant) sharedMetaData() MetricRecord {
 	return MetricRecord{
 		Labels: []string{"sid", "insnr", "database_name"},
 		LabelValues: []string{
-			config.Tenants[tId].SID,
-			config.Tenants[tId].InstanceNumber,
-			config.Tenants[tId].DatabaseName,
+			tenant.SID,
+			tenant.InstanceNumber,
+			tenant.DatabaseName,
 		},
 	}
 }
 
+// getMetricName - final metric name, info metrics always end with _info
+func getMetricName(name, unit, metricType string) string {
+	if low(metricType) == "info" {
+		if strings.HasSuffix(strings.ToLower(name), "_info") {
+			return name
+		}
+		return name + "_info"
+	}
+	return getMetricNameWithUnit(name, unit)
+}
+
 func getMetricNameWithUnit(name, unit string) string {
 	if unit == "" {
 		return name
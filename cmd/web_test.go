@@ -1,8 +1,8 @@
 package cmd_test
 
 import (
+	"context"
 	"database/sql"
-	"fmt"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
@@ -11,151 +11,163 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
-// func (config *cmd.Config) getTestData1(mPos, tPos int) []metricRecord {
-// 	mr := []metricRecord{
-// 		metricRecord{
-// 			999.0,
-// 			[]string{"l" + strconv.Itoa(mPos) + strconv.Itoa(tPos)},
-// 			[]string{"lv" + strconv.Itoa(mPos) + strconv.Itoa(tPos)},
-// 		},
-// 	}
-// 	return mr
-// }
-
 // 0 metrics, 0 tenants
 func Test_CollectMetrics00(t *testing.T) {
 	assert := assert.New(t)
-	config := getTestConfig(0, 1)
-	config.DataFunc = config.GetTestData1
+	rt := getTestRuntime(0, 0)
 
-	res := config.CollectMetrics()
+	res := rt.CollectMetrics(context.Background())
 	assert.Nil(res)
 }
 
 // 0 metrics, 1 tenants
 func Test_CollectMetrics01(t *testing.T) {
 	assert := assert.New(t)
-	config := getTestConfig(0, 1)
-	config.DataFunc = config.GetTestData1
+	rt := getTestRuntime(0, 1)
 
-	res := config.CollectMetrics()
+	res := rt.CollectMetrics(context.Background())
 	assert.Nil(res)
 }
 
 // 1 metrics, 0 tenants
 func Test_CollectMetrics10(t *testing.T) {
 	assert := assert.New(t)
-	config := getTestConfig(1, 0)
-	config.DataFunc = config.GetTestData1
+	rt := getTestRuntime(1, 0)
 
-	res := config.CollectMetrics()
+	res := rt.CollectMetrics(context.Background())
 	assert.Nil(res)
 }
 
 // 1 tenant, 1 metric
 func Test_CollectMetrics11(t *testing.T) {
 	assert := assert.New(t)
-	config := getTestConfig(1, 1)
-	config.DataFunc = config.GetTestData1
+	rt := getTestRuntime(1, 1)
 
-	res := config.CollectMetrics()
-	// assert.Nil(res)
-	assert.Equal(res, []cmd.MetricData{{Name: "m1", Help: "h1", MetricType: "gauge", Stats: []cmd.MetricRecord{{Value: 999, Labels: []string{"l00"}, LabelValues: []string{"lv00"}}}}})
+	res := rt.CollectMetrics(context.Background())
+	assert.Equal([]cmd.MetricData{{Name: "m1", Help: "h1", MetricType: "gauge", Stats: []cmd.MetricRecord{{Value: 999, Labels: []string{"l_m1"}, LabelValues: []string{"lv_d01"}}}}}, res)
 }
 
 // 2 metrics, 1 tenant
 func Test_CollectMetrics21(t *testing.T) {
 	assert := assert.New(t)
-	config := getTestConfig(2, 1)
-	config.DataFunc = config.GetTestData1
+	rt := getTestRuntime(2, 1)
 
-	res := config.CollectMetrics()
-	fmt.Println("21: ", res)
-	fmt.Println("21: ", []cmd.MetricData{{Name: "m1", Help: "h1", MetricType: "gauge", Stats: []cmd.MetricRecord{{Value: 999, Labels: []string{"l00"}, LabelValues: []string{"lv00"}}}}, {Name: "m2", Help: "h2", MetricType: "gauge", Stats: []cmd.MetricRecord{{Value: 999, Labels: []string{"l10"}, LabelValues: []string{"lv10"}}}}})
-	assert.Equal(true, cmp.Equal(res, []cmd.MetricData{{Name: "m1", Help: "h1", MetricType: "gauge", Stats: []cmd.MetricRecord{{Value: 999, Labels: []string{"l00"}, LabelValues: []string{"lv00"}}}}, {Name: "m2", Help: "h2", MetricType: "gauge", Stats: []cmd.MetricRecord{{Value: 999, Labels: []string{"l10"}, LabelValues: []string{"lv10"}}}}}))
+	res := rt.CollectMetrics(context.Background())
+	assert.Equal(true, cmp.Equal(res, []cmd.MetricData{{Name: "m1", Help: "h1", MetricType: "gauge", Stats: []cmd.MetricRecord{{Value: 999, Labels: []string{"l_m1"}, LabelValues: []string{"lv_d01"}}}}, {Name: "m2", Help: "h2", MetricType: "gauge", Stats: []cmd.MetricRecord{{Value: 999, Labels: []string{"l_m2"}, LabelValues: []string{"lv_d01"}}}}}))
 }
 
-// 1 metric, 2 tenants
+// 1 metric, 2 tenants: records in tenant order
 func Test_CollectMetrics12(t *testing.T) {
 	assert := assert.New(t)
-	config := getTestConfig(1, 2)
-	config.DataFunc = config.GetTestData1
+	rt := getTestRuntime(1, 2)
 
-	res := config.CollectMetrics()
-	fmt.Println("12: ", res)
-	fmt.Println("12: ", []cmd.MetricData{{Name: "m1", Help: "h1", MetricType: "gauge", Stats: []cmd.MetricRecord{{Value: 999, Labels: []string{"l01"}, LabelValues: []string{"lv01"}}, {Value: 999, Labels: []string{"l00"}, LabelValues: []string{"lv00"}}}}})
-	assert.Equal(true, cmp.Equal(res, []cmd.MetricData{{Name: "m1", Help: "h1", MetricType: "gauge", Stats: []cmd.MetricRecord{{Value: 999, Labels: []string{"l01"}, LabelValues: []string{"lv01"}}, {Value: 999, Labels: []string{"l00"}, LabelValues: []string{"lv00"}}}}}))
+	res := rt.CollectMetrics(context.Background())
+	assert.Equal(true, cmp.Equal(res, []cmd.MetricData{{Name: "m1", Help: "h1", MetricType: "gauge", Stats: []cmd.MetricRecord{{Value: 999, Labels: []string{"l_m1"}, LabelValues: []string{"lv_d01"}}, {Value: 999, Labels: []string{"l_m1"}, LabelValues: []string{"lv_D02"}}}}}))
 }
 
 func Test_CollectNilMetrics(t *testing.T) {
 	assert := assert.New(t)
-	config := getTestConfig(2, 3)
-	config.DataFunc = config.GetTestData2
+	rt := getTestRuntime(2, 3)
+	rt.Collector = testCollector{empty: true}
 
-	res := config.CollectMetrics()
+	res := rt.CollectMetrics(context.Background())
 	assert.Nil(res)
 }
 
+// the metric m3 only applies to tenants with the tag erp
+func Test_CollectMetricsTagFilter(t *testing.T) {
+	assert := assert.New(t)
+	rt := getTestRuntime(3, 3)
+	rt.Tenants[2].Tags = []string{"erp"}
+
+	res := rt.CollectMetrics(context.Background())
+	assert.Equal(3, len(res))
+	assert.Equal("m3", res[2].Name)
+	assert.Equal([]cmd.MetricRecord{{Value: 999, Labels: []string{"l_m3"}, LabelValues: []string{"lv_d03"}}}, res[2].Stats)
+}
+
+func Test_CollectQueryMetrics(t *testing.T) {
+	assert := assert.New(t)
+	rt := getTestRuntime(0, 2)
+	rt.Config.Queries = []cmd.QueryInfo{
+		{SQL: "select host, cnt from m_connections", Metrics: []cmd.QueryMetricInfo{{Name: "q1"}, {Name: "q2"}}},
+		{SQL: "select host, cnt from m_connections", Disabled: true, Metrics: []cmd.QueryMetricInfo{{Name: "q3"}}},
+	}
+
+	res := rt.CollectQueryMetrics(context.Background())
+	var names []string
+	for _, md := range res {
+		names = append(names, md.Name+":"+md.Stats[0].LabelValues[0])
+	}
+	assert.Equal([]string{"q1:lv_d01", "q2:lv_d01", "q1:lv_D02", "q2:lv_D02"}, names)
+}
+
 func Test_GetMetricRows(t *testing.T) {
 
 	assert := assert.New(t)
 
-	config := getTestConfig(1, 1)
-	ti := config.Tenants[0]
+	ti := cmd.Tenant{TenantInfo: cmd.TenantInfo{Name: "d01"}}
 
 	// rows.Columns
 	rows := &sql.Rows{}
-	data, cols, err := ti.RowsConvert(rows)
+	data, cols, err := cmd.RowsConvert(rows)
 	assert.NotNil(err)
 
 	_, err = ti.GetMetricRows("test", data, cols, []string{}, "")
 	assert.NotNil(err)
 }
 
-func Test_GetSelection(t *testing.T) {
+func Test_Selection(t *testing.T) {
 	assert := assert.New(t)
 
 	// tag not in tagfilter
 	config := getTestConfig(3, 3)
-	res := config.GetSelection(2, 2)
+	tenant := cmd.Tenant{TenantInfo: config.Tenants[2]}
+	res := tenant.Selection(config.Metrics[2].Query())
 	assert.Equal(res, "")
 
 	// only selects are allowed
 	config = getTestConfig(4, 1)
-	res = config.GetSelection(3, 0)
+	tenant = cmd.Tenant{TenantInfo: config.Tenants[0]}
+	res = tenant.Selection(config.Metrics[3].Query())
 	assert.Equal(res, "")
 
 	// metrics schema filter must include a tenant schema
 	config = getTestConfig(2, 2)
-	res = config.GetSelection(1, 1)
+	tenant = cmd.Tenant{TenantInfo: config.Tenants[1]}
+	res = tenant.Selection(config.Metrics[1].Query())
 	assert.Equal(res, "")
 
+	// version filter needs the tenant version
 	config = getTestConfig(1, 1)
-	res = config.GetSelection(0, 0)
-	assert.Equal(res, "select count(*) from sys.m_blocked_transactions")
-}
+	query := config.Metrics[0].Query()
+	query.VersionFilter = ">= 2.00.040"
+	tenant = cmd.Tenant{TenantInfo: config.Tenants[0]}
+	assert.Equal("", tenant.Selection(query))
+	tenant.Version = "2.00.059.00"
+	assert.Equal("select count(*) from sys.m_blocked_transactions", tenant.Selection(query))
 
-func Test_AdaptSchemaFilter(t *testing.T) {
+	config = getTestConfig(1, 1)
+	tenant = cmd.Tenant{TenantInfo: config.Tenants[0]}
+	res = tenant.Selection(config.Metrics[0].Query())
+	assert.Equal(res, "select count(*) from sys.m_blocked_transactions")
 
-	var mi = []cmd.MetricInfo{
-		{
-			SchemaFilter: []string{},
-		},
-		{
-			SchemaFilter: []string{},
-		},
-	}
-	var config = cmd.Config{
-		Metrics: mi,
-	}
+	// an empty schema filter means sys and is not stored in the config
+	query = cmd.QueryInfo{SQL: "select * from <SCHEMA>.m_connections"}
+	assert.Equal("select * from sys.m_connections", tenant.Selection(query))
+	assert.Nil(query.SchemaFilter)
+}
 
+func Test_MetricQuery(t *testing.T) {
 	assert := assert.New(t)
 
-	config.AdaptSchemaFilter()
-	for _, metric := range mi {
-		b := cmd.ContainsString("sys", metric.SchemaFilter)
-		assert.Equal(b, true)
-	}
+	metric := cmd.MetricInfo{Name: "m1", Help: "h1", MetricType: "stateset", SQL: "select 1 from dummy", SchemaFilter: []string{"sys"}, ValueColumn: "v", Unit: "bytes", Labels: []string{"l"}, States: []string{"a"}, Disabled: true}
+	assert.Equal(cmd.QueryInfo{
+		SQL:          "select 1 from dummy",
+		SchemaFilter: []string{"sys"},
+		Disabled:     true,
+		Metrics:      []cmd.QueryMetricInfo{{Name: "m1", Help: "h1", MetricType: "stateset", ValueColumn: "v", Unit: "bytes", Labels: []string{"l"}, States: []string{"a"}}},
+	}, metric.Query())
 }
 
 func Test_ContainsString(t *testing.T) {
@@ -232,7 +244,9 @@ func TestCheckVersionRequirement_Combined(t *testing.T) {
 		{"above max", "3.1.0", ">=1.0.0 <=3.0.0", false},
 		{"mixed conditions", "2.0.0", ">1.5.0 <2.5.0", true},
 		{"invalid format", "2.0", "=2.0.0", false},
-	};
+		{"blank after operator", "2.00.059", ">= 2.00.040 < 2.00.060", true},
+		{"blank after operator below min", "2.00.030", ">= 2.00.040", false},
+	}
 
 	config := &cmd.Config{}
 
@@ -240,9 +254,56 @@ func TestCheckVersionRequirement_Combined(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			result := config.CheckVersionRequirement(tt.version, tt.requirement)
 			if result != tt.expected {
-				t.Errorf("expected %v but got %v for version %s with requirement %s", 
+				t.Errorf("expected %v but got %v for version %s with requirement %s",
 					tt.expected, result, tt.version, tt.requirement)
 			}
 		})
 	}
 }
+
+func testRow(values ...interface{}) []interface{} {
+	row := make([]interface{}, len(values))
+	for i := range values {
+		v := values[i]
+		row[i] = &v
+	}
+	return row
+}
+
+func Test_GetInfoRows(t *testing.T) {
+	assert := assert.New(t)
+
+	ti := cmd.Tenant{TenantInfo: cmd.TenantInfo{Name: "d01"}}
+
+	rows := [][]interface{}{testRow("2.00.059", "Production")}
+	res, err := ti.GetTypedMetricRows("hdb_build", "info", nil, rows, []string{"VERSION", "USAGE_TYPE"}, nil, "")
+	assert.Nil(err)
+	assert.Equal(1, len(res))
+	assert.Equal(1.0, res[0].Value)
+	assert.Equal([]string{"tenant", "usage", "schema", "sid", "insnr", "database_name", "version", "usage_type"}, res[0].Labels)
+	assert.Equal([]string{"d01", "", "", "", "", "", "2.00.059", "production"}, res[0].LabelValues)
+
+	_, err = ti.GetInfoRows(rows, []string{})
+	assert.NotNil(err)
+}
+
+func Test_GetStateSetRows(t *testing.T) {
+	assert := assert.New(t)
+
+	ti := cmd.Tenant{TenantInfo: cmd.TenantInfo{Name: "d01"}}
+
+	rows := [][]interface{}{testRow("YES", "indexserver")}
+	cols := []string{"ACTIVE_STATUS", "SERVICE_NAME"}
+	res, err := ti.GetTypedMetricRows("hdb_service_active", "stateset", []string{"YES", "NO", "STOPPING"}, rows, cols, nil, "active_status")
+	assert.Nil(err)
+	assert.Equal(3, len(res))
+	for i, value := range []float64{1, 0, 0} {
+		assert.Equal(value, res[i].Value)
+		assert.Equal("hdb_service_active", res[i].Labels[len(res[i].Labels)-1])
+		assert.Equal("indexserver", res[i].LabelValues[len(res[i].LabelValues)-2])
+	}
+
+	// states are mandatory
+	_, err = ti.GetTypedMetricRows("hdb_service_active", "stateset", nil, rows, cols, nil, "active_status")
+	assert.NotNil(err)
+}
@@ -0,0 +1,229 @@
+// Package hdbmock is a database/sql driver that replays scripted result sets.
+// It stands in for go-hdb in tests: every select is answered by the first
+// rule whose DSN and SQL patterns match.
+package hdbmock
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Ping - pseudo select matched against the rules when a connection is pinged.
+// Without a matching rule the ping succeeds.
+const Ping = "PING"
+
+// Rule - scripted answer for all selects matching SQL on connections matching DSN
+type Rule struct {
+	DSN     string          // regular expression for the data source name, all if empty
+	SQL     string          // case insensitive regular expression for the select
+	Columns []string        // column names of the result set
+	Types   []string        // database type names of the columns, NVARCHAR if missing
+	Rows    [][]interface{} // result rows, values are passed unchanged to Scan
+	Err     error           // error returned instead of the result set
+	Delay   time.Duration   // wait time before the answer, aborted by the query context
+}
+
+// Driver - registered driver with its rules and the log of executed selects
+type Driver struct {
+	name string
+
+	mu      sync.Mutex
+	rules   []rule
+	queries []string
+	args    [][]interface{}
+}
+
+type rule struct {
+	Rule
+	dsn *regexp.Regexp
+	sql *regexp.Regexp
+}
+
+var driverCnt int64
+
+// Register - register a new driver with the rules under a unique name
+func Register(rules ...Rule) (*Driver, error) {
+	d := Driver{name: fmt.Sprintf("hdbmock%d", atomic.AddInt64(&driverCnt, 1))}
+	if err := d.Replace(rules...); err != nil {
+		return nil, errors.Wrap(err, "Register(Replace)")
+	}
+	sql.Register(d.name, &d)
+	return &d, nil
+}
+
+// Replace - answer all following selects with the new rules
+func (d *Driver) Replace(rules ...Rule) error {
+	var compiled []rule
+	for _, r := range rules {
+		cr := rule{Rule: r}
+		var err error
+		if r.DSN != "" {
+			if cr.dsn, err = regexp.Compile(r.DSN); err != nil {
+				return errors.Wrapf(err, "Replace(DSN %s)", r.DSN)
+			}
+		}
+		if cr.sql, err = regexp.Compile("(?is)" + r.SQL); err != nil {
+			return errors.Wrapf(err, "Replace(SQL %s)", r.SQL)
+		}
+		compiled = append(compiled, cr)
+	}
+	d.mu.Lock()
+	d.rules = compiled
+	d.mu.Unlock()
+	return nil
+}
+
+// Name - driver name for sql.Open
+func (d *Driver) Name() string {
+	return d.name
+}
+
+// Queries - all selects executed so far, pings excluded
+func (d *Driver) Queries() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string(nil), d.queries...)
+}
+
+// Args - bound parameters of all selects executed so far, in the order of Queries
+func (d *Driver) Args() [][]interface{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([][]interface{}(nil), d.args...)
+}
+
+// Open - implements driver.Driver
+func (d *Driver) Open(dsn string) (driver.Conn, error) {
+	return &conn{driver: d, dsn: dsn}, nil
+}
+
+// first rule for the select on the data source
+func (d *Driver) match(dsn, query string) (*rule, bool) {
+	d.mu.Lock()
+	rules := d.rules
+	d.mu.Unlock()
+	for i := range rules {
+		r := &rules[i]
+		if r.dsn != nil && !r.dsn.MatchString(dsn) {
+			continue
+		}
+		if r.sql.MatchString(query) {
+			return r, true
+		}
+	}
+	return nil, false
+}
+
+type conn struct {
+	driver *Driver
+	dsn    string
+}
+
+func (c *conn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("hdbmock: prepared statements are not supported")
+}
+
+func (c *conn) Close() error {
+	return nil
+}
+
+func (c *conn) Begin() (driver.Tx, error) {
+	return nil, errors.New("hdbmock: transactions are not supported")
+}
+
+// Ping - implements driver.Pinger
+func (c *conn) Ping(ctx context.Context) error {
+	r, ok := c.driver.match(c.dsn, Ping)
+	if !ok {
+		return nil
+	}
+	if err := wait(ctx, r.Delay); err != nil {
+		return err
+	}
+	return r.Err
+}
+
+// QueryContext - implements driver.QueryerContext
+func (c *conn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	values := make([]interface{}, len(args))
+	for i, arg := range args {
+		values[i] = arg.Value
+	}
+	c.driver.mu.Lock()
+	c.driver.queries = append(c.driver.queries, query)
+	c.driver.args = append(c.driver.args, values)
+	c.driver.mu.Unlock()
+
+	r, ok := c.driver.match(c.dsn, query)
+	if !ok {
+		return nil, errors.Errorf("hdbmock: no rule for %q", query)
+	}
+	if err := wait(ctx, r.Delay); err != nil {
+		return nil, err
+	}
+	if r.Err != nil {
+		return nil, r.Err
+	}
+	return &rows{rule: r}, nil
+}
+
+// wait for delay or until ctx is done
+func wait(ctx context.Context, delay time.Duration) error {
+	if delay == 0 {
+		return nil
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+type rows struct {
+	rule *rule
+	pos  int
+}
+
+func (r *rows) Columns() []string {
+	return r.rule.Columns
+}
+
+func (r *rows) Close() error {
+	return nil
+}
+
+func (r *rows) Next(dest []driver.Value) error {
+	if r.pos >= len(r.rule.Rows) {
+		return io.EOF
+	}
+	row := r.rule.Rows[r.pos]
+	r.pos++
+	for i := range dest {
+		if i < len(row) {
+			dest[i] = row[i]
+		} else {
+			dest[i] = nil
+		}
+	}
+	return nil
+}
+
+// ColumnTypeDatabaseTypeName - implements driver.RowsColumnTypeDatabaseTypeName
+func (r *rows) ColumnTypeDatabaseTypeName(index int) string {
+	if index < len(r.rule.Types) {
+		return r.rule.Types[index]
+	}
+	return "NVARCHAR"
+}
@@ -16,17 +16,8 @@ package main
 
 import (
 	"github.com/ulranh/hana_sql_exporter/cmd"
-
-	log "github.com/sirupsen/logrus"
 )
 
 func main() {
-	
-	log.SetFormatter(&log.TextFormatter{
-		DisableColors:   true,
-		FullTimestamp:   true,
-		TimestampFormat: "02-01-2006 15:04:05",
-	})
-
 	cmd.Execute()
 }